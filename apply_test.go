@@ -0,0 +1,120 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"sync/atomic"
+	"testing"
+)
+
+// faultyApply is armed to break the next apply of WALs, once
+type faultyApply struct {
+	armed atomic.Bool
+	panic bool // panic instead of failing
+}
+
+// fire tells whether the apply must fail, and panics if it must panic
+func (f *faultyApply) fire() bool {
+	if !f.armed.CompareAndSwap(true, false) {
+		return false
+	}
+	if f.panic {
+		panic(errors.New("apply failed"))
+	}
+	return true
+}
+
+// faultyLevelDbProvider skips or panics in the armed MustApplyWal, which has no error to return
+type faultyLevelDbProvider struct {
+	*balance.LevelDbProvider
+	*faultyApply
+}
+
+func (p *faultyLevelDbProvider) MustApplyWal(load model.LockerValue, walis []model.Wal) {
+	if p.fire() {
+		return
+	}
+	p.LevelDbProvider.MustApplyWal(load, walis)
+}
+
+type faultySqlProvider struct {
+	*balance.SqlProvider
+	*faultyApply
+}
+
+func (p *faultySqlProvider) ApplyWal(load model.LockerValue, walis []interface{}) error {
+	if p.fire() {
+		return errors.New("apply failed")
+	}
+	return p.SqlProvider.ApplyWal(load, walis)
+}
+
+var applyFaults = []struct {
+	name  string
+	panic bool
+}{
+	{"error", false},
+	{"panic", true},
+}
+
+func TestApplyFailureLevelDb(t *testing.T) {
+	ctx := context.Background()
+	for _, fault := range applyFaults {
+		t.Run(fault.name, func(t *testing.T) {
+			kv := &memkv.MemKv{}
+			store := newEngineStore(kv, false)
+			faulty := &faultyApply{panic: fault.panic}
+			store.BusinessProvider = &faultyLevelDbProvider{store.BusinessProvider.(*balance.LevelDbProvider), faulty}
+			tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+			tccCode, _, _, err := tccStore.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+			mustTcc(t, "Must", tccCode, err)
+
+			// the wal is durable, so the try succeeds and the cached value is dropped
+			faulty.armed.Store(true)
+			tccCode, _, _, err = tccStore.Try(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+			mustTcc(t, "Try", tccCode, err)
+			if faulty.armed.Load() {
+				t.Fatal("the apply of the try was not broken")
+			}
+			if a := account(t, store, kv, "alice"); a.Available != 70 || a.Frozen != 30 || a.Seq != 2 {
+				t.Fatalf("alice has %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+			}
+		})
+	}
+}
+
+func TestApplyFailureSql(t *testing.T) {
+	ctx := context.Background()
+	for _, fault := range applyFaults {
+		t.Run(fault.name, func(t *testing.T) {
+			fixture, err := walocktest.NewSqlFixture(openSqlite(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			faulty := &faultyApply{panic: fault.panic}
+			fixture.Store.BusinessProvider = &faultySqlProvider{fixture.Provider, faulty}
+			tccCode, _, _, err := fixture.Store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+			mustTcc(t, "Must", tccCode, err)
+
+			// the wal is committed, so the try succeeds and the cached value is dropped
+			faulty.armed.Store(true)
+			tccCode, _, _, err = fixture.Store.Try(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+			mustTcc(t, "Try", tccCode, err)
+			if faulty.armed.Load() {
+				t.Fatal("the apply of the try was not broken")
+			}
+			value, err := fixture.Store.Get(ctx, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a := value.(*balance.Account); a.Available != 70 || a.Frozen != 30 || a.Seq != 2 {
+				t.Fatalf("alice has %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+			}
+		})
+	}
+}
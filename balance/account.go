@@ -0,0 +1,117 @@
+// Package balance is a ready-made account balance business provider for both walock stores:
+// Try freezes, Confirm deducts the frozen amount, Cancel unfreezes and Must credits.
+// It can be used as is or copied as a template for other resources.
+package balance
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/latifrons/walock/model"
+)
+
+// Business error codes
+const (
+	ErrInvalidAmount       = "INVALID_AMOUNT"
+	ErrInsufficientBalance = "INSUFFICIENT_BALANCE"
+)
+
+// Operations recorded in Wal
+const (
+	OpTry     = "try"     // Available -> Frozen
+	OpConfirm = "confirm" // Frozen is deducted
+	OpCancel  = "cancel"  // Frozen -> Available
+	OpMust    = "must"    // Available is credited
+)
+
+// Account is the model.LockerValue of the balance providers
+type Account struct {
+	Key       model.LockerKey
+	Available int64
+	Frozen    int64
+	Seq       uint64 // sequence of the last applied WAL of the key
+	DbVersion uint64 `json:"-"`
+	Dirty     bool   `json:"-"`
+}
+
+func (a *Account) GetVersion() uint64 {
+	return a.Seq
+}
+
+func (a *Account) GetDbVersion() uint64 {
+	return a.DbVersion
+}
+
+func (a *Account) SetDbVersion(v uint64) {
+	a.DbVersion = v
+}
+
+func (a *Account) SetDirty(dirty bool) {
+	a.Dirty = dirty
+}
+
+func (a *Account) IsDirty() bool {
+	return a.Dirty
+}
+
+// Wal is one change of an account. Seq starts at 1 and increases by one per WAL of the key.
+type Wal struct {
+	Key      model.LockerKey
+	Seq      uint64
+	Op       string
+	GlobalId string
+	BranchId string
+	Amount   int64
+	Epoch    uint64 `json:",omitempty"` // lease epoch the WAL was written under. 0 without a lease
+}
+
+// SetEpoch implements walock.EpochWal
+func (w *Wal) SetEpoch(epoch uint64) {
+	w.Epoch = epoch
+}
+
+// SetSeq implements walock.SeqWal
+func (w *Wal) SetSeq(seq uint64) {
+	w.Seq = seq
+}
+
+// GetSeq implements walock.SeqWal
+func (w *Wal) GetSeq() uint64 {
+	return w.Seq
+}
+
+// Apply applies the WAL. WALs the account has already seen are skipped, so replays are idempotent.
+// A gap in the sequence is an error: a WAL is missing and the account would be wrong.
+func (a *Account) Apply(wal *Wal) (err error) {
+	if wal.Seq <= a.Seq {
+		return
+	}
+	if wal.Seq != a.Seq+1 {
+		return fmt.Errorf("wal seq gap on %s: account %d, wal %d", a.Key, a.Seq, wal.Seq)
+	}
+	switch wal.Op {
+	case OpTry:
+		a.Available -= wal.Amount
+		a.Frozen += wal.Amount
+	case OpConfirm:
+		a.Frozen -= wal.Amount
+	case OpCancel:
+		a.Frozen -= wal.Amount
+		a.Available += wal.Amount
+	case OpMust:
+		a.Available += wal.Amount
+	default:
+		return fmt.Errorf("unknown balance op %q", wal.Op)
+	}
+	a.Seq = wal.Seq
+	return
+}
+
+func EncodeWal(wal *Wal) ([]byte, error) {
+	return json.Marshal(wal)
+}
+
+func DecodeWal(bytes []byte) (wal *Wal, err error) {
+	wal = &Wal{}
+	err = json.Unmarshal(bytes, wal)
+	return
+}
@@ -0,0 +1,175 @@
+package balance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock/model"
+)
+
+// Persister keeps the flushed accounts of LevelDbProvider
+type Persister interface {
+	// Load returns found false if the account was never saved
+	Load(key model.LockerKey) (account *Account, found bool, err error)
+	Save(account *Account) error
+	Keys() ([]model.LockerKey, error)
+}
+
+// LevelDbProvider is a walock.BusinessProviderLevelDb, a walock.WalFactory and a walock.ValueFactory: it returns typed
+// WALs which the store encodes with its codec and keeps in seq order, and lets the store snapshot accounts.
+type LevelDbProvider struct {
+	Rules
+	Persister Persister
+}
+
+func (f *LevelDbProvider) InitDefault() {
+	f.Rules.InitDefault()
+}
+
+func (f *LevelDbProvider) NewValue(key model.LockerKey) model.LockerValue {
+	return &Account{Key: key}
+}
+
+func (f *LevelDbProvider) NewWal() interface{} {
+	return &Wal{}
+}
+
+// walOf returns the typed WAL, decoding JSON WalBytes written before the store had codecs
+func walOf(w model.Wal) (wal *Wal, err error) {
+	if v, ok := w.Value.(*Wal); ok {
+		return v, nil
+	}
+	return DecodeWal(w.WalBytes)
+}
+
+func (f *LevelDbProvider) LoadPersistedValue(key model.LockerKey) (v model.LockerValue, err error) {
+	account, found, err := f.Persister.Load(key)
+	if err != nil {
+		return
+	}
+	if !found {
+		account = &Account{Key: key}
+	}
+	account.DbVersion = account.Seq
+	v = account
+	return
+}
+
+func (f *LevelDbProvider) GenerateWalTry(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, tryBody interface{}) (ok bool, code string, message string, tryWali model.Wal, err error) {
+	ok, code, message, wal := f.Rules.Try(tccContext, value.(*Account), tryBody)
+	if ok {
+		tryWali = model.Wal{Value: wal}
+	}
+	return
+}
+
+// GenerateWalConfirm panics on a corrupted reservation since the interface has no error to return.
+// The store fails the call with a PanicError and writes nothing.
+func (f *LevelDbProvider) GenerateWalConfirm(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali model.Wal) (confirmWali model.Wal) {
+	reservation, err := walOf(reservationWali)
+	if err != nil {
+		panic(err)
+	}
+	return model.Wal{Value: f.Rules.Confirm(tccContext, value.(*Account), reservation)}
+}
+
+// GenerateWalCancel panics on a corrupted reservation. See GenerateWalConfirm.
+func (f *LevelDbProvider) GenerateWalCancel(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali model.Wal) (revertWali model.Wal) {
+	reservation, err := walOf(reservationWali)
+	if err != nil {
+		panic(err)
+	}
+	return model.Wal{Value: f.Rules.Cancel(tccContext, value.(*Account), reservation)}
+}
+
+func (f *LevelDbProvider) GenerateWalMust(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, mustBody interface{}) (ok bool, code string, message string, mustWali model.Wal, err error) {
+	ok, code, message, wal := f.Rules.Must(tccContext, value.(*Account), mustBody)
+	if ok {
+		mustWali = model.Wal{Value: wal}
+	}
+	return
+}
+
+func (f *LevelDbProvider) MustApplyWal(load model.LockerValue, walis []model.Wal) {
+	account := load.(*Account)
+	for _, w := range walis {
+		wal, err := walOf(w)
+		if err != nil {
+			panic(err)
+		}
+		if wal.Seq != w.Seq {
+			panic(fmt.Errorf("wal %s holds seq %d", w.Key, wal.Seq))
+		}
+		err = account.Apply(wal)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Traverse walks the persisted accounts
+func (f *LevelDbProvider) Traverse(fun func(key model.LockerKey, value model.LockerValue) bool) {
+	for _, key := range f.Keys() {
+		account, found, err := f.Persister.Load(key)
+		if err != nil || !found {
+			continue
+		}
+		if !fun(key, account) {
+			return
+		}
+	}
+}
+
+func (f *LevelDbProvider) Keys() []model.LockerKey {
+	keys, _ := f.Persister.Keys()
+	return keys
+}
+
+func (f *LevelDbProvider) PersistValue(value model.LockerValue) error {
+	account := *value.(*Account)
+	account.Dirty = false
+	return f.Persister.Save(&account)
+}
+
+// KvPersister saves accounts as JSON in a model.KvStoreOperator, usually the one of the store
+type KvPersister struct {
+	Kv     model.KvStoreOperator
+	Prefix string // defaults to "ACC-"
+}
+
+func (p *KvPersister) InitDefault() {
+	if p.Prefix == "" {
+		p.Prefix = "ACC-"
+	}
+}
+
+func (p *KvPersister) Load(key model.LockerKey) (account *Account, found bool, err error) {
+	bytes, err := p.Kv.Get([]byte(p.Prefix + string(key)))
+	if errors.Is(err, model.ErrNotFound) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	account = &Account{}
+	err = json.Unmarshal(bytes, account)
+	found = err == nil
+	return
+}
+
+func (p *KvPersister) Save(account *Account) (err error) {
+	bytes, err := json.Marshal(account)
+	if err != nil {
+		return
+	}
+	return p.Kv.Put([]byte(p.Prefix+string(account.Key)), bytes)
+}
+
+func (p *KvPersister) Keys() (keys []model.LockerKey, err error) {
+	err = p.Kv.Scan([]byte(p.Prefix), func(key, value []byte) bool {
+		keys = append(keys, model.LockerKey(key[len(p.Prefix):]))
+		return true
+	})
+	return
+}
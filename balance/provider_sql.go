@@ -0,0 +1,356 @@
+package balance
+
+import (
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+type AccountRecord struct {
+	LockKey    string `gorm:"size:100;primarykey"`
+	Available  int64
+	Frozen     int64
+	Seq        uint64
+	UpdateTime time.Time
+}
+
+type WalRecord struct {
+	Id         uint64 `gorm:"primarykey"`
+	LockKey    string `gorm:"size:100;uniqueIndex:idx_lock_key_seq"`
+	Seq        uint64 `gorm:"uniqueIndex:idx_lock_key_seq"`
+	Op         string `gorm:"size:20"`
+	GlobalId   string `gorm:"size:100;index:idx_global_branch"`
+	BranchId   string `gorm:"size:100;index:idx_global_branch"`
+	Amount     int64
+	Epoch      uint64
+	CreateTime time.Time `gorm:"index"`
+}
+
+// ActiveKeyRecord is a recently used key. Position 0 is the most recent.
+type ActiveKeyRecord struct {
+	LockKey  string `gorm:"size:100;primarykey"`
+	Position int
+}
+
+const (
+	compactBatchSize = 1000
+	loadBatchSize    = 1000
+)
+
+// SqlProvider is a walock.BusinessProviderSql and a walock.WalLoaderSql keeping accounts and WALs in two tables,
+// and the active keys in a third. The unique (lock_key, seq) index makes a WAL written twice fail the transaction.
+type SqlProvider struct {
+	Rules
+	DbRw               *gorm.DB // used by Traverse and Keys, which get no transaction
+	AccountTableName   string   // defaults to "balance_account"
+	WalTableName       string   // defaults to "balance_wal"
+	ActiveKeyTableName string   // defaults to "balance_active_key"
+}
+
+func (f *SqlProvider) InitDefault() {
+	f.Rules.InitDefault()
+	if f.AccountTableName == "" {
+		f.AccountTableName = "balance_account"
+	}
+	if f.WalTableName == "" {
+		f.WalTableName = "balance_wal"
+	}
+	if f.ActiveKeyTableName == "" {
+		f.ActiveKeyTableName = "balance_active_key"
+	}
+}
+
+// AutoMigrate creates or updates the tables
+func (f *SqlProvider) AutoMigrate(tx *gorm.DB) (err error) {
+	err = tx.Table(f.AccountTableName).AutoMigrate(&AccountRecord{})
+	if err != nil {
+		return
+	}
+	err = tx.Table(f.WalTableName).AutoMigrate(&WalRecord{})
+	if err != nil {
+		return
+	}
+	return tx.Table(f.ActiveKeyTableName).AutoMigrate(&ActiveKeyRecord{})
+}
+
+func toAccount(record *AccountRecord) *Account {
+	return &Account{
+		Key:       model.LockerKey(record.LockKey),
+		Available: record.Available,
+		Frozen:    record.Frozen,
+		Seq:       record.Seq,
+	}
+}
+
+func toWal(record *WalRecord) *Wal {
+	return &Wal{
+		Key:      model.LockerKey(record.LockKey),
+		Seq:      record.Seq,
+		Op:       record.Op,
+		GlobalId: record.GlobalId,
+		BranchId: record.BranchId,
+		Amount:   record.Amount,
+		Epoch:    record.Epoch,
+	}
+}
+
+func (f *SqlProvider) LoadPersistedValue(tx *gorm.DB, key model.LockerKey) (v model.LockerValue, err error) {
+	var record AccountRecord
+	err = tx.Table(f.AccountTableName).Where("lock_key = ?", string(key)).Take(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+		v = &Account{Key: key}
+		return
+	}
+	if err != nil {
+		return
+	}
+	account := toAccount(&record)
+	account.DbVersion = account.Seq
+	v = account
+	return
+}
+
+// LoadPersistedValues loads the accounts of the keys in one query per loadBatchSize keys
+func (f *SqlProvider) LoadPersistedValues(tx *gorm.DB, keys []model.LockerKey) (values map[model.LockerKey]model.LockerValue, err error) {
+	values = make(map[model.LockerKey]model.LockerValue, len(keys))
+	for start := 0; start < len(keys); start += loadBatchSize {
+		batch := make([]string, 0, loadBatchSize)
+		for _, key := range keys[start:min(start+loadBatchSize, len(keys))] {
+			batch = append(batch, string(key))
+		}
+		var records []AccountRecord
+		err = tx.Table(f.AccountTableName).Where("lock_key IN ?", batch).Find(&records).Error
+		if err != nil {
+			return
+		}
+		for i := range records {
+			account := toAccount(&records[i])
+			account.DbVersion = account.Seq
+			values[account.Key] = account
+		}
+	}
+	for _, key := range keys {
+		if values[key] == nil {
+			values[key] = &Account{Key: key}
+		}
+	}
+	return
+}
+
+func (f *SqlProvider) GenerateWalTry(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, tryBody interface{}) (ok bool, code string, message string, tryWali interface{}, err error) {
+	ok, code, message, wal := f.Rules.Try(tccContext, value.(*Account), tryBody)
+	if ok {
+		tryWali = wal
+	}
+	return
+}
+
+func (f *SqlProvider) GenerateWalConfirm(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali interface{}) (confirmWali interface{}) {
+	return f.Rules.Confirm(tccContext, value.(*Account), reservationWali.(*Wal))
+}
+
+func (f *SqlProvider) GenerateWalCancel(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali interface{}) (revertWali interface{}) {
+	return f.Rules.Cancel(tccContext, value.(*Account), reservationWali.(*Wal))
+}
+
+func (f *SqlProvider) GenerateWalMust(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, mustBody interface{}) (ok bool, code string, message string, mustWali interface{}, err error) {
+	ok, code, message, wal := f.Rules.Must(tccContext, value.(*Account), mustBody)
+	if ok {
+		mustWali = wal
+	}
+	return
+}
+
+// LoadReservation finds the try WAL of the branch
+func (f *SqlProvider) LoadReservation(tx *gorm.DB, tccContext *model.TccContext) (wal interface{}, ok bool, code string, message string, err error) {
+	var record WalRecord
+	err = tx.Table(f.WalTableName).
+		Where("global_id = ? AND branch_id = ? AND op = ?", tccContext.GlobalId, tccContext.BranchId, OpTry).
+		Take(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+		code = consts.ErrReservationNotFound
+		message = "reservation not found: " + tccContext.String()
+		return
+	}
+	if err != nil {
+		return
+	}
+	wal = toWal(&record)
+	ok = true
+	return
+}
+
+// LoadWals returns the WALs of the key with a seq above after, in seq order
+func (f *SqlProvider) LoadWals(tx *gorm.DB, key model.LockerKey, after uint64) (walis []interface{}, err error) {
+	var records []WalRecord
+	err = tx.Table(f.WalTableName).
+		Where("lock_key = ? AND seq > ?", string(key), after).
+		Order("seq").
+		Find(&records).Error
+	if err != nil {
+		return
+	}
+	for i := range records {
+		walis = append(walis, toWal(&records[i]))
+	}
+	return
+}
+
+// CatchupWals applies the WALs with a seq above the one of the account.
+// WalockStoreSqlDb calls LoadWals instead.
+func (f *SqlProvider) CatchupWals(tx *gorm.DB, key model.LockerKey, load model.LockerValue) (err error) {
+	walis, err := f.LoadWals(tx, key, load.GetVersion())
+	if err != nil {
+		return
+	}
+	return f.ApplyWal(load, walis)
+}
+
+// CompactWals deletes the WALs up to persistedVersion. A try WAL is kept until its confirm or cancel WAL
+// is persisted too, since LoadReservation reads it.
+func (f *SqlProvider) CompactWals(tx *gorm.DB, key model.LockerKey, persistedVersion uint64) (deleted int, err error) {
+	var records []WalRecord
+	err = tx.Table(f.WalTableName).
+		Where("lock_key = ? AND seq <= ?", string(key), persistedVersion).
+		Find(&records).Error
+	if err != nil {
+		return
+	}
+	settled := make(map[model.TccContext]bool)
+	for _, record := range records {
+		if record.Op == OpConfirm || record.Op == OpCancel {
+			settled[model.TccContext{GlobalId: record.GlobalId, BranchId: record.BranchId}] = true
+		}
+	}
+	ids := make([]uint64, 0, len(records))
+	for _, record := range records {
+		if record.Op != OpTry || settled[model.TccContext{GlobalId: record.GlobalId, BranchId: record.BranchId}] {
+			ids = append(ids, record.Id)
+		}
+	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > compactBatchSize {
+			n = compactBatchSize
+		}
+		result := tx.Table(f.WalTableName).Where("id IN ?", ids[:n]).Delete(&WalRecord{})
+		if result.Error != nil {
+			err = result.Error
+			return
+		}
+		deleted += int(result.RowsAffected)
+		ids = ids[n:]
+	}
+	return
+}
+
+func (f *SqlProvider) ApplyWal(load model.LockerValue, walis []interface{}) (err error) {
+	account := load.(*Account)
+	for _, wali := range walis {
+		err = account.Apply(wali.(*Wal))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// FlushWal refuses with a walock.StaleEpochError a WAL stamped with an older lease epoch than the last WAL of the key
+func (f *SqlProvider) FlushWal(tx *gorm.DB, wali interface{}) error {
+	wal := wali.(*Wal)
+	if wal.Epoch != 0 {
+		var current uint64
+		err := tx.Table(f.WalTableName).Where("lock_key = ?", string(wal.Key)).Select("COALESCE(MAX(epoch), 0)").Scan(&current).Error
+		if err != nil {
+			return err
+		}
+		if current > wal.Epoch {
+			return &walock.StaleEpochError{Key: wal.Key, Epoch: wal.Epoch, Current: current}
+		}
+	}
+	record := WalRecord{
+		LockKey:    string(wal.Key),
+		Seq:        wal.Seq,
+		Op:         wal.Op,
+		GlobalId:   wal.GlobalId,
+		BranchId:   wal.BranchId,
+		Amount:     wal.Amount,
+		Epoch:      wal.Epoch,
+		CreateTime: time.Now(),
+	}
+	return tx.Table(f.WalTableName).Create(&record).Error
+}
+
+// SaveActiveKeys replaces the active keys
+func (f *SqlProvider) SaveActiveKeys(tx *gorm.DB, keys []model.LockerKey) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		err := tx.Table(f.ActiveKeyTableName).Where("1 = 1").Delete(&ActiveKeyRecord{}).Error
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		records := make([]ActiveKeyRecord, len(keys))
+		for i, key := range keys {
+			records[i] = ActiveKeyRecord{LockKey: string(key), Position: i}
+		}
+		return tx.Table(f.ActiveKeyTableName).CreateInBatches(records, compactBatchSize).Error
+	})
+}
+
+// LoadActiveKeys returns the active keys, the most recently used first
+func (f *SqlProvider) LoadActiveKeys(tx *gorm.DB) (keys []model.LockerKey, err error) {
+	var lockKeys []string
+	err = tx.Table(f.ActiveKeyTableName).Order("position").Pluck("lock_key", &lockKeys).Error
+	for _, k := range lockKeys {
+		keys = append(keys, model.LockerKey(k))
+	}
+	return
+}
+
+// FlushDirty does nothing. WalockStoreSqlDb.FlushDirty flushes through Flush.
+func (f *SqlProvider) FlushDirty(tx *gorm.DB) (err error) {
+	return
+}
+
+// Traverse walks the persisted accounts
+func (f *SqlProvider) Traverse(fun func(key model.LockerKey, value model.LockerValue) bool) {
+	var records []AccountRecord
+	err := f.DbRw.Table(f.AccountTableName).Order("lock_key").Find(&records).Error
+	if err != nil {
+		return
+	}
+	for i := range records {
+		if !fun(model.LockerKey(records[i].LockKey), toAccount(&records[i])) {
+			return
+		}
+	}
+}
+
+func (f *SqlProvider) Keys() (keys []model.LockerKey) {
+	var lockKeys []string
+	_ = f.DbRw.Table(f.AccountTableName).Order("lock_key").Pluck("lock_key", &lockKeys).Error
+	for _, k := range lockKeys {
+		keys = append(keys, model.LockerKey(k))
+	}
+	return
+}
+
+func (f *SqlProvider) Flush(tx *gorm.DB, value model.LockerValue) error {
+	account := value.(*Account)
+	record := AccountRecord{
+		LockKey:    string(account.Key),
+		Available:  account.Available,
+		Frozen:     account.Frozen,
+		Seq:        account.Seq,
+		UpdateTime: time.Now(),
+	}
+	return tx.Table(f.AccountTableName).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "lock_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"available", "frozen", "seq", "update_time"}),
+	}).Create(&record).Error
+}
@@ -0,0 +1,83 @@
+package balance
+
+import (
+	"fmt"
+	"github.com/latifrons/walock/model"
+)
+
+// Rules turns TCC bodies into WALs. It is shared by LevelDbProvider and SqlProvider.
+type Rules struct {
+	AllowOverdraft bool                                           // let Try freeze more than the available balance
+	MaxAmount      int64                                          // rejects larger Try and Must amounts. 0 for no limit
+	BodyAmount     func(body interface{}) (amount int64, ok bool) // optional. defaults to DefaultBodyAmount
+}
+
+func (r *Rules) InitDefault() {
+	if r.BodyAmount == nil {
+		r.BodyAmount = DefaultBodyAmount
+	}
+}
+
+// DefaultBodyAmount accepts int64 and int bodies
+func DefaultBodyAmount(body interface{}) (amount int64, ok bool) {
+	switch v := body.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return
+}
+
+func (r *Rules) amount(body interface{}) (amount int64, ok bool, code string, message string) {
+	amount, ok = r.BodyAmount(body)
+	if !ok || amount <= 0 || (r.MaxAmount != 0 && amount > r.MaxAmount) {
+		return 0, false, ErrInvalidAmount, fmt.Sprintf("invalid amount %v", body)
+	}
+	return
+}
+
+// Try freezes the amount of the body
+func (r *Rules) Try(tccContext *model.TccContext, account *Account, tryBody interface{}) (ok bool, code string, message string, wal *Wal) {
+	amount, ok, code, message := r.amount(tryBody)
+	if !ok {
+		return
+	}
+	if !r.AllowOverdraft && account.Available < amount {
+		return false, ErrInsufficientBalance, fmt.Sprintf("available %d < %d", account.Available, amount), nil
+	}
+	wal = NextWal(tccContext, account, OpTry, amount)
+	return
+}
+
+// Must credits the amount of the body
+func (r *Rules) Must(tccContext *model.TccContext, account *Account, mustBody interface{}) (ok bool, code string, message string, wal *Wal) {
+	amount, ok, code, message := r.amount(mustBody)
+	if !ok {
+		return
+	}
+	wal = NextWal(tccContext, account, OpMust, amount)
+	return
+}
+
+// Confirm deducts the amount frozen by the reservation
+func (r *Rules) Confirm(tccContext *model.TccContext, account *Account, reservation *Wal) *Wal {
+	return NextWal(tccContext, account, OpConfirm, reservation.Amount)
+}
+
+// Cancel unfreezes the amount frozen by the reservation
+func (r *Rules) Cancel(tccContext *model.TccContext, account *Account, reservation *Wal) *Wal {
+	return NextWal(tccContext, account, OpCancel, reservation.Amount)
+}
+
+// NextWal builds the WAL following the last one applied to the account
+func NextWal(tccContext *model.TccContext, account *Account, op string, amount int64) *Wal {
+	return &Wal{
+		Key:      account.Key,
+		Seq:      account.Seq + 1,
+		Op:       op,
+		GlobalId: tccContext.GlobalId,
+		BranchId: tccContext.BranchId,
+		Amount:   amount,
+	}
+}
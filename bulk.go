@@ -0,0 +1,156 @@
+package walock
+
+import (
+	"context"
+	"github.com/latifrons/walock/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sort"
+	"time"
+)
+
+// lockUnloaded locks the lockers of the keys in key order and keeps locked the ones without a value.
+// The store calls hold one key at a time, so this cannot deadlock with them.
+func lockUnloaded(ensureLocker func(key model.LockerKey) *model.Locker, keys []model.LockerKey) (unloaded []model.LockerKey, lockers []*model.Locker) {
+	sorted := append([]model.LockerKey(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			continue
+		}
+		lock := lockFresh(ensureLocker, key)
+		if lock.Value != nil {
+			lock.Mu.Unlock()
+			continue
+		}
+		unloaded = append(unloaded, key)
+		lockers = append(lockers, lock)
+	}
+	return
+}
+
+// install caches the value loaded into a locked locker. A panic of the business provider is returned as a PanicError.
+func install(lock *model.Locker, load func() (model.LockerValue, error)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+	value, err := load()
+	if err != nil {
+		return
+	}
+	lock.Value = value
+	return
+}
+
+// BulkLoad loads the values of the keys into the cache at once, fetching the ones without a local snapshot
+// through the LoadPersistedValues of a BatchLoaderLevelDb provider. Keys already cached are skipped, and the others
+// stay locked until loaded. Keys failing to load are logged and left for their next call.
+func (f *WalockStoreLevelDb) BulkLoad(ctx context.Context, tx model.KvStoreOperator, keys []model.LockerKey) (loaded int, err error) {
+	_, span := f.tracer().Start(ctx, "walock.bulk_load", trace.WithAttributes(attribute.Int("walock.keys", len(keys))))
+	defer func() { endSpan(span, err) }()
+	startTime := time.Now()
+
+	keys, lockers := lockUnloaded(f.ensureUserMiniLock, keys)
+	defer func() {
+		for _, lock := range lockers {
+			lock.Mu.Unlock()
+		}
+	}()
+
+	values := make(map[model.LockerKey]model.LockerValue, len(keys))
+	fromSnapshot := make(map[model.LockerKey]bool)
+	var rest []model.LockerKey
+	for _, key := range keys {
+		value, found := f.loadFromSnapshot(tx, key)
+		if found {
+			values[key] = value
+			fromSnapshot[key] = true
+		} else {
+			rest = append(rest, key)
+		}
+	}
+	if batch, ok := f.BusinessProvider.(BatchLoaderLevelDb); ok && len(rest) != 0 {
+		var persisted map[model.LockerKey]model.LockerValue
+		persisted, err = batch.LoadPersistedValues(rest)
+		if err != nil {
+			f.logger().Error().Err(err).Int("keys", len(rest)).Msg("failed to load from persist")
+			return
+		}
+		for key, value := range persisted {
+			values[key] = value
+		}
+	}
+
+	for i, key := range keys {
+		loadErr := install(lockers[i], func() (value model.LockerValue, err error) {
+			value, ok := values[key]
+			if !ok {
+				value, err = f.BusinessProvider.LoadPersistedValue(key)
+				if err != nil {
+					return
+				}
+			}
+			err = f.settle(tx, key, value, fromSnapshot[key])
+			return
+		})
+		if loadErr != nil {
+			f.logger().Warn().Err(loadErr).Str("key", string(key)).Msg("failed to bulk load")
+			continue
+		}
+		loaded++
+	}
+	f.logger().Info().Int("keys", len(keys)).Int("loaded", loaded).Dur("took", time.Since(startTime)).Msg("bulk loaded")
+	return
+}
+
+// BulkLoad loads the values of the keys into the cache at once, fetching them through the LoadPersistedValues
+// of a BatchLoaderSql provider. Keys already cached are skipped, and the others stay locked until loaded.
+// Keys failing to load are logged and left for their next call.
+func (f *WalockStoreSqlDb) BulkLoad(ctx context.Context, keys []model.LockerKey) (loaded int, err error) {
+	_, span := f.tracer().Start(ctx, "walock.bulk_load", trace.WithAttributes(attribute.Int("walock.keys", len(keys))))
+	defer func() { endSpan(span, err) }()
+	startTime := time.Now()
+
+	keys, lockers := lockUnloaded(f.ensureUserMiniLock, keys)
+	defer func() {
+		for _, lock := range lockers {
+			lock.Mu.Unlock()
+		}
+	}()
+	epoch := f.leaseEpoch()
+	for _, lock := range lockers {
+		lock.Epoch = epoch
+	}
+
+	var values map[model.LockerKey]model.LockerValue
+	if batch, ok := f.BusinessProvider.(BatchLoaderSql); ok && len(keys) != 0 {
+		values, err = batch.LoadPersistedValues(f.DbRw, keys)
+		if err != nil {
+			f.logger().Error().Err(err).Int("keys", len(keys)).Msg("failed to load from persist")
+			return
+		}
+	}
+
+	for i, key := range keys {
+		loadErr := install(lockers[i], func() (value model.LockerValue, err error) {
+			value, ok := values[key]
+			if !ok {
+				value, err = f.BusinessProvider.LoadPersistedValue(f.DbRw, key)
+				if err != nil {
+					return
+				}
+			}
+			err = f.settle(f.DbRw, key, value)
+			return
+		})
+		if loadErr != nil {
+			f.logger().Warn().Err(loadErr).Str("key", string(key)).Msg("failed to bulk load")
+			continue
+		}
+		loaded++
+	}
+	f.logger().Info().Int("keys", len(keys)).Int("loaded", loaded).Dur("took", time.Since(startTime)).Msg("bulk loaded")
+	return
+}
@@ -0,0 +1,85 @@
+package walock_test
+
+import (
+	"context"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"testing"
+)
+
+func TestBulkLoadWarmCache(t *testing.T) {
+	ctx := context.Background()
+	db := openSqlite(t)
+	fixture, err := walocktest.NewSqlFixture(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preloadKeys(t, fixture.Store, 3)
+	if err = fixture.Store.FlushDirty(); err != nil {
+		t.Fatal(err)
+	}
+
+	// user00 is cached ahead of its persisted version, user01 cached clean, user02 is not cached
+	restarted, err := walocktest.NewSqlFixture(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &loadCounter{}
+	restarted.Store.BusinessProvider = &countingSqlProvider{restarted.Provider, counter}
+	tccCode, _, _, err := restarted.Store.Must(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "user00", int64(5))
+	mustTcc(t, "Must", tccCode, err)
+	if _, err = restarted.Store.Get(ctx, "user01"); err != nil {
+		t.Fatal(err)
+	}
+	dirty, err := restarted.Store.Get(ctx, "user00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := restarted.Store.BulkLoad(ctx, []model.LockerKey{"user00", "user01", "user02"})
+	if err != nil || loaded != 1 {
+		t.Fatalf("BulkLoad = %d, %v", loaded, err)
+	}
+	for _, key := range []model.LockerKey{"user00", "user01", "user02"} {
+		if counter.count(key) != 1 {
+			t.Fatalf("%s loaded %d times", key, counter.count(key))
+		}
+	}
+	value, err := restarted.Store.Get(ctx, "user00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := value.(*balance.Account); value != dirty || a.DbVersion != 1 || a.Available != 105 || a.Seq != 2 {
+		t.Fatalf("dirty user00 replaced by %+v", a)
+	}
+}
+
+func TestBulkLoadPanic(t *testing.T) {
+	ctx := context.Background()
+	kv := &memkv.MemKv{}
+	preloadKeys(t, &walock.LevelDbTccStore{Store: newEngineStore(kv, false), Tx: kv}, 2)
+
+	// the load of user00 panics. user01 is loaded anyway
+	store := newEngineStore(kv, false)
+	provider := &panicLevelDbProvider{store.BusinessProvider.(*balance.LevelDbProvider), &panicLoad{value: "load failed"}}
+	provider.armed.Store(true)
+	store.BusinessProvider = provider
+	loaded, err := store.BulkLoad(ctx, kv, []model.LockerKey{"user01", "user00"})
+	if err != nil || loaded != 1 || provider.loads.Load() != 2 {
+		t.Fatalf("BulkLoad = %d, %v after %d loads", loaded, err, provider.loads.Load())
+	}
+
+	// user00 is unlocked and loaded on its next access
+	for _, key := range []model.LockerKey{"user00", "user01"} {
+		value, err := within(t, func() (model.LockerValue, error) { return store.Get(ctx, kv, key) })
+		if err != nil || value.(*balance.Account).Available != 100 {
+			t.Fatalf("%s = %v, %v", key, value, err)
+		}
+	}
+	if provider.loads.Load() != 3 {
+		t.Fatalf("%d loads", provider.loads.Load())
+	}
+}
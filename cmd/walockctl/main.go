@@ -0,0 +1,10 @@
+// walockctl inspects the LevelDB directory of a WalockStoreLevelDb. See package ctl for the commands.
+// verify is not available in this generic build since it needs the business provider;
+// embed ctl.Main with a ProviderFactory in your own binary to use it.
+package main
+
+import "github.com/latifrons/walock/ctl"
+
+func main() {
+	ctl.Main(nil)
+}
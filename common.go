@@ -1 +1,28 @@
 package walock
+
+import (
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/rs/zerolog"
+)
+
+// tccOutcome labels the result of a TCC call for metrics.
+// skipped is set by the barrier when the call was not executed.
+func tccOutcome(tccCode model.TccCode, err error, skipped string) string {
+	switch {
+	case err != nil:
+		return consts.TccOutcomeSystemError
+	case skipped != "":
+		return skipped
+	case tccCode == consts.TccCode_Success:
+		return consts.TccOutcomeSuccess
+	default:
+		return consts.TccOutcomeBusinessFailed
+	}
+}
+
+// callLogger adds the per-call fields to the store logger
+func callLogger(logger *zerolog.Logger, tccContext *model.TccContext, key model.LockerKey) *zerolog.Logger {
+	l := logger.With().Str("key", string(key)).Str("tcc", tccContext.String()).Logger()
+	return &l
+}
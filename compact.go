@@ -0,0 +1,126 @@
+package walock
+
+import (
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+// persistedVersions returns the persisted version of each cached key
+func persistedVersions(accounts *sync.Map) map[model.LockerKey]uint64 {
+	versions := make(map[model.LockerKey]uint64)
+	accounts.Range(func(key, value any) bool {
+		lock := value.(*model.Locker)
+		lock.Mu.Lock()
+		defer lock.Mu.Unlock()
+		if lock.Value != nil {
+			versions[model.LockerKey(key.(string))] = lock.Value.GetDbVersion()
+		}
+		return true
+	})
+	return versions
+}
+
+// openReservations returns the WAL keys pointed to by try barriers whose branch is neither confirmed nor cancelled
+func (f *WalockStoreLevelDb) openReservations(tx model.KvStoreOperator) (walKeys map[string]bool, err error) {
+	tries := make(map[string]string) // barrier key without the branch type -> WAL key
+	settled := make(map[string]bool)
+	scanErr := tx.Scan([]byte(f.BarrierName+"-"), func(key, value []byte) bool {
+		k := string(key)
+		i := strings.LastIndex(k, "-")
+		if i < 0 {
+			return true
+		}
+		switch k[i+1:] {
+		case consts.TccBranchTypeTry:
+			var walKey []byte
+			walKey, err = f.openBarrierValue(tx, k, value)
+			if err != nil {
+				return false
+			}
+			tries[k[:i]] = string(walKey)
+		case consts.TccBranchTypeConfirm, consts.TccBranchTypeCancel:
+			settled[k[:i]] = true
+		}
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return
+	}
+	walKeys = make(map[string]bool)
+	for branch, walKey := range tries {
+		if !settled[branch] {
+			walKeys[walKey] = true
+		}
+	}
+	return
+}
+
+// CompactWals deletes the WALs of the cached keys up to their persisted version, keeping the try WALs
+// of open reservations which Confirm and Cancel still read. Run it after FlushDirty. Keys that are not
+// cached are compacted once loaded.
+func (f *WalockStoreLevelDb) CompactWals(tx model.KvStoreOperator) (deleted int, err error) {
+	startTime := time.Now()
+	// versions first: a try WAL below them has its barrier written with it, so the barrier scan sees it
+	versions := persistedVersions(&f.accounts)
+	open, err := f.openReservations(tx)
+	if err != nil {
+		f.logger().Error().Err(err).Msg("failed to scan barriers")
+		return
+	}
+
+	for key, version := range versions {
+		b := &model.KvBatch{}
+		err = ScanWals(tx, key, 0, func(wal model.Wal) bool {
+			if wal.Seq > version {
+				return false
+			}
+			if !open[wal.Key] {
+				b.Delete([]byte(wal.Key))
+			}
+			return true
+		})
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to scan wals")
+			return
+		}
+		if b.Len() == 0 {
+			continue
+		}
+		err = tx.Write(b)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to delete wals")
+			return
+		}
+		deleted += b.Len()
+	}
+	f.logger().Info().Int("keys", len(versions)).Int("deleted", deleted).Dur("took", time.Since(startTime)).Msg("wals compacted")
+	return
+}
+
+// CompactWals lets a BusinessProvider implementing WalCompactorSql delete the WALs of the cached keys
+// up to their persisted version. It does nothing for other providers.
+func (f *WalockStoreSqlDb) CompactWals() (deleted int, err error) {
+	compactor, ok := f.BusinessProvider.(WalCompactorSql)
+	if !ok {
+		return
+	}
+	startTime := time.Now()
+	versions := persistedVersions(&f.accounts)
+	for key, version := range versions {
+		var n int
+		n, err = compactor.CompactWals(f.DbRw, key, version)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to compact wals")
+			return
+		}
+		deleted += n
+	}
+	f.logger().Info().Int("keys", len(versions)).Int("deleted", deleted).Dur("took", time.Since(startTime)).Msg("wals compacted")
+	return
+}
@@ -15,3 +15,49 @@ const (
 )
 
 const ErrReservationNotFound = "ErrReservationNotFound"
+
+const (
+	GlobalStatusTrying     = "trying"
+	GlobalStatusConfirming = "confirming"
+	GlobalStatusCancelling = "cancelling"
+	GlobalStatusConfirmed  = "confirmed"
+	GlobalStatusCancelled  = "cancelled"
+	// a participant rejected the second phase. needs attention before Coordinator.Retry
+	GlobalStatusConfirmFailed = "confirm_failed"
+	GlobalStatusCancelFailed  = "cancel_failed"
+)
+
+// DirtyKeyPrefix is prepended to the lock key in the KV store to mark a value dirty
+const DirtyKeyPrefix = "DIRTY-"
+
+// WalKeyPrefix is prepended to the lock key and the zero padded seq of a WAL in the KV store
+const WalKeyPrefix = "WAL-"
+
+// LegacyWalsMigratedKey marks a KV store whose legacy WALs were migrated by WalockStoreLevelDb.MigrateLegacyWals
+const LegacyWalsMigratedKey = "LEGACY-WALS-MIGRATED"
+
+// EncryptedBarriersKey marks a KV store in which WalockStoreLevelDb has written encrypted barrier values
+const EncryptedBarriersKey = "ENCRYPTED-BARRIERS"
+
+// SnapshotKeyPrefix is prepended to the lock key of a local value snapshot in the KV store
+const SnapshotKeyPrefix = "SNAP-"
+
+// ActiveKeysKey holds the recently used lock keys of a WalockStoreLevelDb in the KV store
+const ActiveKeysKey = "ACTIVE-KEYS"
+
+const (
+	TccOperationTry     = "try"
+	TccOperationConfirm = "confirm"
+	TccOperationCancel  = "cancel"
+	TccOperationMust    = "must"
+)
+
+const (
+	TccOutcomeSuccess        = "success"
+	TccOutcomeBusinessFailed = "business-failed"
+	TccOutcomeSystemError    = "system-error"
+	TccOutcomeDuplicate      = "duplicate"
+	TccOutcomeEmptyRollback  = "empty-rollback"
+	// a Try skipped by its barrier after the Cancel of its branch
+	TccOutcomeHangingRejected = "hanging-rejected"
+)
@@ -0,0 +1,251 @@
+package coordinator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"time"
+)
+
+// Coordinator runs global TCC transactions whose participants all live in this process.
+// The state of every global transaction is persisted in TransactionLog before each phase,
+// so that Resume can finish the ones interrupted by a crash:
+// trying/cancelling transactions are cancelled, confirming transactions are confirmed.
+type Coordinator struct {
+	Participants   map[string]walock.TccStore // injected by outside. branches refer to participants by name
+	TransactionLog TransactionLog             // injected by outside to persist global transactions
+	IdGenerator    func() string              // optional. generates global ids
+	Logger         *zerolog.Logger            // optional. defaults to the global zerolog logger
+
+	now func() time.Time
+}
+
+func (c *Coordinator) InitDefault() {
+	if c.IdGenerator == nil {
+		c.IdGenerator = defaultIdGenerator
+	}
+	if c.Logger == nil {
+		c.Logger = &log.Logger
+	}
+	c.now = time.Now
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (c *Coordinator) logger() *zerolog.Logger {
+	if c.Logger == nil {
+		return &log.Logger
+	}
+	return c.Logger
+}
+
+// timeNow returns the current time, also if InitDefault was not called
+func (c *Coordinator) timeNow() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+// newGlobalId generates a global id with IdGenerator, or the default generator if InitDefault was not called
+func (c *Coordinator) newGlobalId() string {
+	if c.IdGenerator == nil {
+		return defaultIdGenerator()
+	}
+	return c.IdGenerator()
+}
+
+func defaultIdGenerator() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + hex.EncodeToString(b)
+}
+
+// Execute tries all branches and then confirms all of them, or cancels all of them if any Try fails.
+// committed tells which way the transaction was decided. If err is returned after the decision,
+// the transaction is left pending and will be finished by Resume, or is failed with a *RejectedError
+// if a participant rejected the second phase.
+func (c *Coordinator) Execute(ctx context.Context, branches []Branch) (globalId string, committed bool, err error) {
+	for i := range branches {
+		if _, ok := c.Participants[branches[i].Participant]; !ok {
+			err = fmt.Errorf("unknown participant: %s", branches[i].Participant)
+			return
+		}
+		if branches[i].BranchId == "" {
+			branches[i].BranchId = fmt.Sprintf("%02d", i+1)
+		}
+	}
+
+	now := c.timeNow()
+	gt := &GlobalTransaction{
+		GlobalId:   c.newGlobalId(),
+		Status:     consts.GlobalStatusTrying,
+		Branches:   branches,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	globalId = gt.GlobalId
+
+	// persist before any Try so that a crash in the middle is cancelled by Resume
+	err = c.TransactionLog.Save(gt)
+	if err != nil {
+		c.logger().Error().Err(err).Str("gid", globalId).Msg("failed to save global transaction")
+		return
+	}
+
+	allTried := true
+	for _, branch := range branches {
+		tccContext := &model.TccContext{GlobalId: globalId, BranchId: branch.BranchId}
+		tccCode, code, message, tryErr := c.Participants[branch.Participant].Try(ctx, tccContext, branch.LockKey, branch.Body)
+		if tryErr != nil {
+			c.logger().Error().Err(tryErr).Str("tcc", tccContext.String()).Str("participant", branch.Participant).Msg("try failed")
+			allTried = false
+			break
+		}
+		if tccCode != consts.TccCode_Success {
+			c.logger().Debug().Str("tcc", tccContext.String()).Str("participant", branch.Participant).
+				Str("code", code).Str("message", message).Msg("try rejected")
+			allTried = false
+			break
+		}
+	}
+
+	committed = allTried
+	if allTried {
+		err = c.finish(ctx, gt, consts.GlobalStatusConfirming)
+	} else {
+		err = c.finish(ctx, gt, consts.GlobalStatusCancelling)
+	}
+	return
+}
+
+// Resume finishes all pending global transactions. Failed ones are left to Retry.
+// It should be called once at startup before Execute is used.
+func (c *Coordinator) Resume(ctx context.Context) (err error) {
+	gts, err := c.TransactionLog.ListPending()
+	if err != nil {
+		c.logger().Error().Err(err).Msg("failed to list pending global transactions")
+		return
+	}
+
+	for _, gt := range gts {
+		status := consts.GlobalStatusCancelling
+		if gt.Status == consts.GlobalStatusConfirming {
+			status = consts.GlobalStatusConfirming
+		}
+		c.logger().Info().Str("gid", gt.GlobalId).Str("status", gt.Status).Msg("resuming global transaction")
+
+		err = c.finish(ctx, gt, status)
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			// saved as failed. nothing left to resume
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// finish runs the second phase. status is either confirming or cancelling.
+func (c *Coordinator) finish(ctx context.Context, gt *GlobalTransaction, status string) (err error) {
+	if gt.Status != status {
+		gt.Status = status
+		gt.UpdateTime = c.timeNow()
+		err = c.TransactionLog.Save(gt)
+		if err != nil {
+			c.logger().Error().Err(err).Str("gid", gt.GlobalId).Msg("failed to save global transaction")
+			return
+		}
+	}
+
+	finalStatus := consts.GlobalStatusCancelled
+	failedStatus := consts.GlobalStatusCancelFailed
+	if status == consts.GlobalStatusConfirming {
+		finalStatus = consts.GlobalStatusConfirmed
+		failedStatus = consts.GlobalStatusConfirmFailed
+	}
+
+	var rejected []Branch
+	for i := range gt.Branches {
+		branch := &gt.Branches[i]
+		participant, ok := c.Participants[branch.Participant]
+		if !ok {
+			err = fmt.Errorf("unknown participant: %s", branch.Participant)
+			return
+		}
+
+		tccContext := &model.TccContext{GlobalId: gt.GlobalId, BranchId: branch.BranchId}
+		var tccCode model.TccCode
+		var code, message string
+		if status == consts.GlobalStatusConfirming {
+			tccCode, code, message, err = participant.Confirm(ctx, tccContext, branch.LockKey, nil)
+		} else {
+			tccCode, code, message, err = participant.Cancel(ctx, tccContext, branch.LockKey, nil)
+		}
+		if err != nil {
+			// keep it pending. barriers make the retry idempotent
+			c.logger().Error().Err(err).Str("tcc", tccContext.String()).Str("status", status).Msg("second phase failed")
+			return
+		}
+		branch.Code, branch.Message = "", ""
+		if tccCode != consts.TccCode_Success {
+			// business failures will not change on retry. the other branches still run their second phase
+			c.logger().Error().Str("tcc", tccContext.String()).Str("status", status).
+				Str("code", code).Str("message", message).Msg("second phase rejected")
+			branch.Code, branch.Message = code, message
+			rejected = append(rejected, *branch)
+		}
+	}
+
+	if len(rejected) != 0 {
+		finalStatus = failedStatus
+	}
+	gt.Status = finalStatus
+	gt.UpdateTime = c.timeNow()
+	err = c.TransactionLog.Save(gt)
+	if err != nil {
+		c.logger().Error().Err(err).Str("gid", gt.GlobalId).Msg("failed to save global transaction")
+		return
+	}
+	if len(rejected) != 0 {
+		err = &RejectedError{GlobalId: gt.GlobalId, Status: finalStatus, Branches: rejected}
+	}
+	return
+}
+
+// Retry runs the second phase of a failed global transaction again, once the cause of the rejection is fixed.
+// gt comes from TransactionLog.ListFailed.
+func (c *Coordinator) Retry(ctx context.Context, gt *GlobalTransaction) error {
+	switch gt.Status {
+	case consts.GlobalStatusConfirmFailed:
+		return c.finish(ctx, gt, consts.GlobalStatusConfirming)
+	case consts.GlobalStatusCancelFailed:
+		return c.finish(ctx, gt, consts.GlobalStatusCancelling)
+	default:
+		return fmt.Errorf("global transaction %s is not failed: %s", gt.GlobalId, gt.Status)
+	}
+}
+
+// RejectedError is returned when participants reject the second phase of a global transaction.
+// The transaction is saved as consts.GlobalStatusConfirmFailed or consts.GlobalStatusCancelFailed
+// with the rejections in its branches, listed by TransactionLog.ListFailed.
+type RejectedError struct {
+	GlobalId string
+	Status   string
+	Branches []Branch // the rejected branches
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("global transaction %s %s: %d branches rejected, first %s: %s %s",
+		e.GlobalId, e.Status, len(e.Branches), e.Branches[0].BranchId, e.Branches[0].Code, e.Branches[0].Message)
+}
@@ -0,0 +1,132 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"testing"
+)
+
+// participant accepts every call except the confirms of its rejected keys
+type participant struct {
+	rejectConfirm map[model.LockerKey]bool
+	confirmed     map[model.LockerKey]int
+}
+
+var _ walock.TccStore = (*participant)(nil)
+
+func (p *participant) Try(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (model.TccCode, string, string, error) {
+	return consts.TccCode_Success, "", "", nil
+}
+
+func (p *participant) Confirm(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (model.TccCode, string, string, error) {
+	if p.rejectConfirm[lockKey] {
+		return consts.TccCode_Failed, consts.ErrReservationNotFound, "no reservation", nil
+	}
+	p.confirmed[lockKey]++
+	return consts.TccCode_Success, "", "", nil
+}
+
+func (p *participant) Cancel(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (model.TccCode, string, string, error) {
+	return consts.TccCode_Success, "", "", nil
+}
+
+func (p *participant) Must(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (model.TccCode, string, string, error) {
+	return consts.TccCode_Success, "", "", nil
+}
+
+func TestRejectedSecondPhaseIsFailed(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	transactionLog := &TransactionLogLevelDb{Db: db}
+	transactionLog.InitDefault()
+
+	p := &participant{
+		rejectConfirm: map[model.LockerKey]bool{"b": true},
+		confirmed:     map[model.LockerKey]int{},
+	}
+	c := &Coordinator{Participants: map[string]walock.TccStore{"p": p}, TransactionLog: transactionLog}
+	c.InitDefault()
+
+	ctx := context.Background()
+	globalId, committed, err := c.Execute(ctx, []Branch{
+		{Participant: "p", LockKey: "a"},
+		{Participant: "p", LockKey: "b"},
+		{Participant: "p", LockKey: "c"},
+	})
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("Execute err = %v, want RejectedError", err)
+	}
+	if !committed {
+		t.Fatal("Execute not committed")
+	}
+	if rejected.GlobalId != globalId || rejected.Status != consts.GlobalStatusConfirmFailed ||
+		len(rejected.Branches) != 1 || rejected.Branches[0].LockKey != "b" || rejected.Branches[0].Code != consts.ErrReservationNotFound {
+		t.Fatalf("unexpected RejectedError: %+v", rejected)
+	}
+	if p.confirmed["a"] != 1 || p.confirmed["c"] != 1 {
+		t.Fatalf("other branches not confirmed: %v", p.confirmed)
+	}
+
+	pending, err := transactionLog.ListPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("%d pending, want 0", len(pending))
+	}
+	err = c.Resume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := transactionLog.ListFailed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].GlobalId != globalId || failed[0].Branches[1].Code != consts.ErrReservationNotFound {
+		t.Fatalf("unexpected failed transactions: %+v", failed)
+	}
+
+	p.rejectConfirm = nil
+	err = c.Retry(ctx, failed[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.confirmed["b"] != 1 {
+		t.Fatalf("b confirmed %d times, want 1", p.confirmed["b"])
+	}
+	failed, err = transactionLog.ListFailed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("%d failed after retry, want 0", len(failed))
+	}
+}
+
+func TestCoordinatorWithoutInitDefault(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &participant{
+		rejectConfirm: map[model.LockerKey]bool{"b": true},
+		confirmed:     map[model.LockerKey]int{},
+	}
+	c := &Coordinator{Participants: map[string]walock.TccStore{"p": p}, TransactionLog: &TransactionLogLevelDb{Db: db, KeyPrefix: "GT-"}}
+
+	globalId, _, err := c.Execute(context.Background(), []Branch{{Participant: "p", LockKey: "b"}})
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || globalId == "" {
+		t.Fatalf("Execute = %q, %v", globalId, err)
+	}
+}
@@ -0,0 +1,44 @@
+package coordinator
+
+import (
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"time"
+)
+
+// Branch is one participant call of a global transaction
+type Branch struct {
+	BranchId    string          // assigned by the coordinator if empty
+	Participant string          // name of the participant in Coordinator.Participants
+	LockKey     model.LockerKey //
+	Body        interface{}     `json:"-"`          // try body. not persisted: a resumed transaction never retries Try
+	Code        string          `json:",omitempty"` // set if the participant rejected the second phase
+	Message     string          `json:",omitempty"` // set if the participant rejected the second phase
+}
+
+type GlobalTransaction struct {
+	GlobalId   string
+	Status     string // consts.GlobalStatus*
+	Branches   []Branch
+	CreateTime time.Time
+	UpdateTime time.Time
+}
+
+func (g *GlobalTransaction) IsFinished() bool {
+	return g.Status == consts.GlobalStatusConfirmed || g.Status == consts.GlobalStatusCancelled
+}
+
+// IsFailed tells whether a participant rejected the second phase. Resume leaves such transactions to Retry.
+func (g *GlobalTransaction) IsFailed() bool {
+	return g.Status == consts.GlobalStatusConfirmFailed || g.Status == consts.GlobalStatusCancelFailed
+}
+
+// TransactionLog persists the state of global transactions so that the coordinator can resume them after a crash
+type TransactionLog interface {
+	// Save creates or overwrites the global transaction
+	Save(gt *GlobalTransaction) error
+	// ListPending returns all global transactions that are neither finished nor failed
+	ListPending() ([]*GlobalTransaction, error)
+	// ListFailed returns all global transactions whose second phase was rejected by a participant
+	ListFailed() ([]*GlobalTransaction, error)
+}
@@ -0,0 +1,87 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// TransactionLogLevelDb keeps pending and failed global transactions in LevelDB.
+// Finished transactions are deleted since there is nothing left to resume.
+type TransactionLogLevelDb struct {
+	Db          *leveldb.DB
+	KeyPrefix   string            // defaults to "GT-"
+	WriteOption *opt.WriteOptions // optional. defaults to synced writes: a lost decision breaks the transaction
+	Logger      *zerolog.Logger   // optional. defaults to the global zerolog logger
+}
+
+func (f *TransactionLogLevelDb) InitDefault() {
+	if f.KeyPrefix == "" {
+		f.KeyPrefix = "GT-"
+	}
+	if f.WriteOption == nil {
+		f.WriteOption = &opt.WriteOptions{Sync: true}
+	}
+	if f.Logger == nil {
+		f.Logger = &log.Logger
+	}
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (f *TransactionLogLevelDb) logger() *zerolog.Logger {
+	if f.Logger == nil {
+		return &log.Logger
+	}
+	return f.Logger
+}
+
+// writeOption returns WriteOption, or synced writes if InitDefault was not called
+func (f *TransactionLogLevelDb) writeOption() *opt.WriteOptions {
+	if f.WriteOption == nil {
+		return &opt.WriteOptions{Sync: true}
+	}
+	return f.WriteOption
+}
+
+func (f *TransactionLogLevelDb) Save(gt *GlobalTransaction) (err error) {
+	key := []byte(f.KeyPrefix + gt.GlobalId)
+	if gt.IsFinished() {
+		return f.Db.Delete(key, f.writeOption())
+	}
+
+	bytes, err := json.Marshal(gt)
+	if err != nil {
+		return
+	}
+	return f.Db.Put(key, bytes, f.writeOption())
+}
+
+func (f *TransactionLogLevelDb) ListPending() (gts []*GlobalTransaction, err error) {
+	return f.list(func(gt *GlobalTransaction) bool { return !gt.IsFailed() })
+}
+
+func (f *TransactionLogLevelDb) ListFailed() (gts []*GlobalTransaction, err error) {
+	return f.list(func(gt *GlobalTransaction) bool { return gt.IsFailed() })
+}
+
+func (f *TransactionLogLevelDb) list(match func(gt *GlobalTransaction) bool) (gts []*GlobalTransaction, err error) {
+	iter := f.Db.NewIterator(util.BytesPrefix([]byte(f.KeyPrefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		gt := &GlobalTransaction{}
+		err = json.Unmarshal(iter.Value(), gt)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(iter.Key())).Msg("failed to decode global transaction")
+			return
+		}
+		if match(gt) {
+			gts = append(gts, gt)
+		}
+	}
+	err = iter.Error()
+	return
+}
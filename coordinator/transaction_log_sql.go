@@ -0,0 +1,89 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"github.com/latifrons/walock/consts"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+type GlobalTransactionRecord struct {
+	GlobalId   string    `gorm:"size:100;primarykey"`
+	Status     string    `gorm:"size:20;index"`
+	Branches   string    `gorm:"type:text"` // json encoded []Branch
+	CreateTime time.Time `gorm:"index"`
+	UpdateTime time.Time
+}
+
+// TransactionLogSql keeps global transactions in a SQL table.
+// Finished transactions are kept for auditing.
+type TransactionLogSql struct {
+	DbRw        *gorm.DB
+	DbTableName string // optional. defaults to "walock_global_transaction"
+}
+
+func (f *TransactionLogSql) InitDefault() {
+	if f.DbTableName == "" {
+		f.DbTableName = "walock_global_transaction"
+	}
+}
+
+// AutoMigrate creates or updates the transaction table
+func (f *TransactionLogSql) AutoMigrate(tx *gorm.DB) error {
+	return tx.Table(f.DbTableName).AutoMigrate(&GlobalTransactionRecord{})
+}
+
+func (f *TransactionLogSql) Save(gt *GlobalTransaction) (err error) {
+	branches, err := json.Marshal(gt.Branches)
+	if err != nil {
+		return
+	}
+	v := GlobalTransactionRecord{
+		GlobalId:   gt.GlobalId,
+		Status:     gt.Status,
+		Branches:   string(branches),
+		CreateTime: gt.CreateTime,
+		UpdateTime: gt.UpdateTime,
+	}
+	return f.DbRw.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "global_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "branches", "update_time"}),
+	}).Table(f.DbTableName).Create(&v).Error
+}
+
+func (f *TransactionLogSql) ListPending() (gts []*GlobalTransaction, err error) {
+	return f.list(f.DbRw.Where("status NOT IN ?", []string{
+		consts.GlobalStatusConfirmed, consts.GlobalStatusCancelled,
+		consts.GlobalStatusConfirmFailed, consts.GlobalStatusCancelFailed,
+	}))
+}
+
+func (f *TransactionLogSql) ListFailed() (gts []*GlobalTransaction, err error) {
+	return f.list(f.DbRw.Where("status IN ?", []string{consts.GlobalStatusConfirmFailed, consts.GlobalStatusCancelFailed}))
+}
+
+func (f *TransactionLogSql) list(tx *gorm.DB) (gts []*GlobalTransaction, err error) {
+	var records []GlobalTransactionRecord
+	err = tx.Table(f.DbTableName).
+		Order("create_time").
+		Find(&records).Error
+	if err != nil {
+		return
+	}
+
+	for _, record := range records {
+		gt := &GlobalTransaction{
+			GlobalId:   record.GlobalId,
+			Status:     record.Status,
+			CreateTime: record.CreateTime,
+			UpdateTime: record.UpdateTime,
+		}
+		err = json.Unmarshal([]byte(record.Branches), &gt.Branches)
+		if err != nil {
+			return
+		}
+		gts = append(gts, gt)
+	}
+	return
+}
@@ -0,0 +1,63 @@
+package coordinator
+
+import (
+	"github.com/glebarez/sqlite"
+	"github.com/latifrons/walock/consts"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"testing"
+	"time"
+)
+
+func TestTransactionLogSql(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDb, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDb.Close()
+	// one connection keeps the in-memory database alive
+	sqlDb.SetMaxOpenConns(1)
+
+	transactionLog := &TransactionLogSql{DbRw: db}
+	transactionLog.InitDefault()
+	if err = transactionLog.AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	gts := []*GlobalTransaction{
+		{GlobalId: "g1", Status: consts.GlobalStatusConfirming, Branches: []Branch{{BranchId: "b1", Participant: "p", LockKey: "a"}}, CreateTime: now},
+		{GlobalId: "g2", Status: consts.GlobalStatusCancelled, CreateTime: now.Add(time.Second)},
+		{GlobalId: "g3", Status: consts.GlobalStatusTrying, CreateTime: now.Add(2 * time.Second)},
+	}
+	for _, gt := range gts {
+		if err = transactionLog.Save(gt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// saving again updates the status and the branches
+	gts[0].Status = consts.GlobalStatusConfirmFailed
+	gts[0].Branches[0].Code = "rejected"
+	if err = transactionLog.Save(gts[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := transactionLog.ListPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].GlobalId != "g3" {
+		t.Fatalf("pending %+v", pending)
+	}
+	failed, err := transactionLog.ListFailed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].GlobalId != "g1" || len(failed[0].Branches) != 1 || failed[0].Branches[0].Code != "rejected" {
+		t.Fatalf("failed %+v", failed)
+	}
+}
@@ -0,0 +1,293 @@
+package ctl
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/latifrons/walock/walcodec"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var errUsage = errors.New("invalid arguments")
+
+// Entry is a raw key/value pair. Value is hex encoded if it is not valid UTF-8.
+// The value of a WAL is the payload of its envelope.
+type Entry struct {
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	ValueHex bool      `json:"valueHex,omitempty"`
+	Envelope *Envelope `json:"envelope,omitempty"`
+}
+
+// Envelope is the envelope of a WAL. Error is set instead if it fails the checks.
+type Envelope struct {
+	Version    uint8     `json:"version,omitempty"`
+	Codec      string    `json:"codec,omitempty"`
+	Encrypted  bool      `json:"encrypted,omitempty"` // Value is the ciphertext
+	Time       time.Time `json:"time,omitempty"`
+	GlobalId   string    `json:"globalId,omitempty"`
+	BranchId   string    `json:"branchId,omitempty"`
+	BranchType string    `json:"branchType,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func newEntry(key, value []byte) Entry {
+	e := Entry{Key: string(key)}
+	if strings.HasPrefix(e.Key, consts.WalKeyPrefix) && walock.IsWalEnvelope(value) {
+		envelope, err := walock.DecodeWalEnvelope(e.Key, value)
+		if err != nil {
+			e.Envelope = &Envelope{Error: err.Error()}
+		} else {
+			e.Envelope = &Envelope{
+				Version:    envelope.Version,
+				Codec:      codecName(envelope.Codec),
+				Encrypted:  envelope.Encrypted,
+				Time:       envelope.Time,
+				GlobalId:   envelope.TccContext.GlobalId,
+				BranchId:   envelope.TccContext.BranchId,
+				BranchType: envelope.BranchType,
+			}
+			value = envelope.Payload
+		}
+	}
+	if utf8.Valid(value) {
+		e.Value = string(value)
+	} else {
+		e.Value = hex.EncodeToString(value)
+		e.ValueHex = true
+	}
+	return e
+}
+
+func codecName(id uint8) string {
+	if id == walcodec.CodecRaw {
+		return ""
+	}
+	codec, err := walcodec.ById(id)
+	if err != nil {
+		return fmt.Sprintf("unknown(%d)", id)
+	}
+	return codec.Name()
+}
+
+type Barrier struct {
+	Key        string `json:"key"`
+	BranchType string `json:"branchType"`
+	WalKey     string `json:"walKey,omitempty"` // only Try barriers point to a WAL
+}
+
+type TryWal struct {
+	BarrierKey string `json:"barrierKey"`
+	Wal        *Entry `json:"wal"` // nil if the WAL is missing
+}
+
+func scanPrefix(db *leveldb.DB, prefix []byte) (entries []Entry, err error) {
+	entries = make([]Entry, 0)
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		entries = append(entries, newEntry(iter.Key(), iter.Value()))
+	}
+	err = iter.Error()
+	return
+}
+
+func (c *ctl) runBarriers(args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("barriers", flag.ExitOnError)
+	barrierName := fs.String("barrier", "", "barrier name of the store")
+	_ = fs.Parse(args)
+	if *barrierName == "" || fs.NArg() != 1 {
+		return nil, errUsage
+	}
+
+	prefix := *barrierName + "-" + fs.Arg(0) + "-"
+	entries, err := scanPrefix(c.db, []byte(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := walock.BarriersEncrypted(c.tx)
+	if err != nil {
+		return nil, err
+	}
+	barriers := make([]Barrier, 0, len(entries))
+	for _, e := range entries {
+		b := Barrier{Key: e.Key}
+		if i := strings.LastIndex(e.Key, "-"); i >= 0 {
+			b.BranchType = e.Key[i+1:]
+		}
+		if b.BranchType == consts.TccBranchTypeTry && !e.ValueHex && !(encrypted && walock.IsEncryptedValue([]byte(e.Value))) {
+			b.WalKey = e.Value // unknown if the barrier is encrypted
+		}
+		barriers = append(barriers, b)
+	}
+	return barriers, nil
+}
+
+func (c *ctl) runTryWal(args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("trywal", flag.ExitOnError)
+	barrierName := fs.String("barrier", "", "barrier name of the store")
+	_ = fs.Parse(args)
+	if *barrierName == "" || fs.NArg() != 2 {
+		return nil, errUsage
+	}
+
+	v := tcc.BuildTccBarrierReceiver(*barrierName, fs.Arg(0), fs.Arg(1), consts.TccBranchTypeTry)
+	walKey, err := c.db.Get([]byte(v.Key), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, fmt.Errorf("try barrier not found: %s", v.Key)
+		}
+		return nil, err
+	}
+	encrypted, err := walock.BarriersEncrypted(c.tx)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted && walock.IsEncryptedValue(walKey) {
+		return nil, fmt.Errorf("try barrier is encrypted: %s", v.Key)
+	}
+
+	result := TryWal{BarrierKey: v.Key}
+	walBytes, err := c.db.Get(walKey, nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return result, nil
+		}
+		return nil, err
+	}
+	e := newEntry(walKey, walBytes)
+	result.Wal = &e
+	return result, nil
+}
+
+func (c *ctl) runWals(args []string) (interface{}, error) {
+	if len(args) != 1 || args[0] == "" {
+		return nil, errUsage
+	}
+	return scanPrefix(c.db, []byte(args[0]))
+}
+
+func (c *ctl) runDirty(args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("dirty", flag.ExitOnError)
+	prefix := fs.String("prefix", consts.DirtyKeyPrefix, "dirty marker key prefix")
+	_ = fs.Parse(args)
+
+	entries, err := scanPrefix(c.db, []byte(*prefix))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, strings.TrimPrefix(e.Key, *prefix))
+	}
+	return keys, nil
+}
+
+// Mismatch is a key whose persisted value differs from the value replayed from its WALs
+type Mismatch struct {
+	Key       string            `json:"key"`
+	Persisted model.LockerValue `json:"persisted"`
+	Replayed  model.LockerValue `json:"replayed,omitempty"`
+	Updated   bool              `json:"updated"`
+	Error     string            `json:"error,omitempty"`
+}
+
+func (c *ctl) runVerify(args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	withDirty := fs.Bool("dirty", false, "also verify all keys marked dirty")
+	_ = fs.Parse(args)
+	if c.newProvider == nil {
+		return nil, errors.New("verify needs a business provider, which the generic walockctl lacks. build your own binary with ctl.Main and a ProviderFactory")
+	}
+
+	keys := make([]model.LockerKey, 0, fs.NArg())
+	for _, k := range fs.Args() {
+		keys = append(keys, model.LockerKey(k))
+	}
+	if *withDirty {
+		dirtyKeys, err := walock.ListDirty(c.tx)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, dirtyKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, errUsage
+	}
+
+	provider, err := c.newProvider(c.tx)
+	if err != nil {
+		return nil, err
+	}
+	results, err := c.newStore(provider).VerifyWals(c.tx, keys, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := make([]Mismatch, 0, len(results))
+	for _, r := range results {
+		m := Mismatch{
+			Key:       string(r.Key),
+			Persisted: r.Persisted,
+			Replayed:  r.Replayed,
+			Updated:   r.Updated,
+		}
+		if r.Err != nil {
+			m.Error = r.Err.Error()
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, nil
+}
+
+func printJson(result interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+func printText(result interface{}) error {
+	switch r := result.(type) {
+	case []Entry:
+		for _, e := range r {
+			fmt.Printf("%s\t%s\n", e.Key, e.Value)
+		}
+	case []Barrier:
+		for _, b := range r {
+			fmt.Printf("%s\t%s\t%s\n", b.Key, b.BranchType, b.WalKey)
+		}
+	case TryWal:
+		if r.Wal == nil {
+			fmt.Printf("%s\t<wal missing>\n", r.BarrierKey)
+		} else {
+			fmt.Printf("%s\t%s\t%s\n", r.BarrierKey, r.Wal.Key, r.Wal.Value)
+		}
+	case []Mismatch:
+		for _, m := range r {
+			if m.Error != "" {
+				fmt.Printf("%s\terror: %s\n", m.Key, m.Error)
+			} else {
+				fmt.Printf("%s\tpersisted: %+v\treplayed: %+v\n", m.Key, m.Persisted, m.Replayed)
+			}
+		}
+	case []string:
+		for _, s := range r {
+			fmt.Println(s)
+		}
+	default:
+		return printJson(result)
+	}
+	return nil
+}
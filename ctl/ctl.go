@@ -0,0 +1,167 @@
+// Package ctl implements walockctl, which inspects the LevelDB directory of a WalockStoreLevelDb.
+// The database is opened read-only so it is safe to run against a copy taken during an incident.
+//
+// Usage:
+//
+//	walockctl -db DIR [-json] barriers -barrier NAME GLOBAL_ID
+//	walockctl -db DIR [-json] trywal -barrier NAME GLOBAL_ID BRANCH_ID
+//	walockctl -db DIR [-json] wals PREFIX
+//	walockctl -db DIR [-json] dirty [-prefix DIRTY-]
+//	walockctl -db DIR [-json] verify [-dirty] [KEY...]
+//
+// verify replays the WALs above the persisted version of each key and reports the keys whose replayed value differs
+// from the persisted one: keys with unflushed WALs, or WALs which do not apply. It needs the business provider of the
+// store, so it is only available in binaries built with Main and a ProviderFactory, not in cmd/walockctl.
+// If the store encrypts its WALs or encodes them with a codec other than JSON, also pass its KeyProvider and WalCodec
+// with WithKeyProvider and WithWalCodec.
+package ctl
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/kv/leveldbkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walcodec"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"os"
+	"sort"
+)
+
+// ProviderFactory builds the business provider used by the verify command.
+// tx is the read-only operator on the inspected database.
+type ProviderFactory func(tx model.KvStoreOperator) (walock.BusinessProviderLevelDb, error)
+
+type command struct {
+	usage string
+	run   func(c *ctl, args []string) (interface{}, error)
+}
+
+// Option configures the store built by the verify command
+type Option func(c *ctl)
+
+// WithKeyProvider decrypts the WALs, snapshots and barriers of a store encrypting them
+func WithKeyProvider(keyProvider walock.KeyProvider) Option {
+	return func(c *ctl) {
+		c.keyProvider = keyProvider
+	}
+}
+
+// WithWalCodec decodes the typed WALs and snapshots of a store whose codec is not JSON.
+// WALs in an envelope naming their codec are decoded with it anyway.
+func WithWalCodec(walCodec walcodec.WalCodec) Option {
+	return func(c *ctl) {
+		c.walCodec = walCodec
+	}
+}
+
+type ctl struct {
+	db          *leveldb.DB
+	tx          model.KvStoreOperator
+	newProvider ProviderFactory
+	keyProvider walock.KeyProvider
+	walCodec    walcodec.WalCodec
+}
+
+// newStore returns a store on the inspected database, configured as the one which wrote it
+func (c *ctl) newStore(provider walock.BusinessProviderLevelDb) *walock.WalockStoreLevelDb {
+	store := &walock.WalockStoreLevelDb{
+		BusinessProvider: provider,
+		KeyProvider:      c.keyProvider,
+		WalCodec:         c.walCodec,
+	}
+	store.InitDefault()
+	return store
+}
+
+func commands() map[string]command {
+	return map[string]command{
+		"barriers": {"barriers -barrier NAME GLOBAL_ID", (*ctl).runBarriers},
+		"trywal":   {"trywal -barrier NAME GLOBAL_ID BRANCH_ID", (*ctl).runTryWal},
+		"wals":     {"wals PREFIX", (*ctl).runWals},
+		"dirty":    {"dirty [-prefix DIRTY-]", (*ctl).runDirty},
+		"verify":   {"verify [-dirty] [KEY...]", (*ctl).runVerify},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: walockctl -db DIR [-json] COMMAND [ARGS]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	cmds := commands()
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+cmds[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "verify replays the WALs above the persisted version of each key onto it and lists the keys which change.")
+	fmt.Fprintln(os.Stderr, "it needs a binary built with ctl.Main and a ProviderFactory.")
+	flag.PrintDefaults()
+}
+
+// open opens the LevelDB directory read-only. It fails if the directory holds no database.
+func open(dbDir string, newProvider ProviderFactory, options ...Option) (c *ctl, err error) {
+	db, err := leveldb.OpenFile(dbDir, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return
+	}
+	c = &ctl{
+		db:          db,
+		tx:          &readOnlyOperator{leveldbkv.LevelDbKv{Db: db}},
+		newProvider: newProvider,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return
+}
+
+// Main runs walockctl with the process arguments and exits.
+// newProvider may be nil, in which case verify is unavailable.
+func Main(newProvider ProviderFactory, options ...Option) {
+	dbDir := flag.String("db", "", "LevelDB directory")
+	asJson := flag.Bool("json", false, "print JSON instead of text")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *dbDir == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands()[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	c, err := open(*dbDir, newProvider, options...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to open db:", err)
+		os.Exit(1)
+	}
+	defer c.db.Close()
+
+	result, err := cmd.run(c, flag.Args()[1:])
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, "usage: walockctl -db DIR [-json] "+cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *asJson {
+		err = printJson(result)
+	} else {
+		err = printText(result)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
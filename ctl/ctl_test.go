@@ -0,0 +1,176 @@
+package ctl
+
+import (
+	"context"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/leveldbkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newProvider(tx model.KvStoreOperator) (walock.BusinessProviderLevelDb, error) {
+	persister := &balance.KvPersister{Kv: tx}
+	persister.InitDefault()
+	provider := &balance.LevelDbProvider{Persister: persister}
+	provider.InitDefault()
+	return provider, nil
+}
+
+// newCtl returns a ctl on a database where alice holds 100 with 30 reserved by g1/b1, and bob 5
+func newCtl(t *testing.T) *ctl {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	kv := &leveldbkv.LevelDbKv{Db: db}
+
+	logger := zerolog.Nop()
+	provider, _ := newProvider(kv)
+	barrier := &tcc.TccBarrierLevelDb{Logger: &logger}
+	barrier.InitDefault()
+	store := &walock.WalockStoreLevelDb{
+		BusinessProvider:  provider,
+		TccBarrierLevelDb: barrier,
+		BarrierName:       "ctl",
+		Logger:            &logger,
+	}
+	store.InitDefault()
+	tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+	ctx := context.Background()
+	calls := []func() (model.TccCode, string, string, error){
+		func() (model.TccCode, string, string, error) {
+			return tccStore.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+		},
+		func() (model.TccCode, string, string, error) {
+			return tccStore.Try(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+		},
+		func() (model.TccCode, string, string, error) {
+			return tccStore.Must(ctx, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "bob", int64(5))
+		},
+	}
+	for _, call := range calls {
+		tccCode, _, message, err := call()
+		if err != nil || tccCode != consts.TccCode_Success {
+			t.Fatalf("%d %s: %v", tccCode, message, err)
+		}
+	}
+
+	return &ctl{db: db, tx: &readOnlyOperator{leveldbkv.LevelDbKv{Db: db}}, newProvider: newProvider}
+}
+
+func entryKeys(entries []Entry) []string {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+func TestCommands(t *testing.T) {
+	c := newCtl(t)
+	tryBarrier := tcc.BuildTccBarrierReceiver("ctl", "g1", "b1", consts.TccBranchTypeTry).Key
+	tests := []struct {
+		name  string
+		args  []string
+		err   string // a part of the expected error
+		check func(t *testing.T, result interface{})
+	}{
+		{name: "barriers", args: []string{"barriers", "-barrier", "ctl", "g1"}, check: func(t *testing.T, result interface{}) {
+			want := []Barrier{{Key: tryBarrier, BranchType: consts.TccBranchTypeTry, WalKey: walock.WalKey("alice", 2)}}
+			if !reflect.DeepEqual(result, want) {
+				t.Fatalf("got %+v", result)
+			}
+		}},
+		{name: "barriers of an unknown global id", args: []string{"barriers", "-barrier", "ctl", "g9"}, check: func(t *testing.T, result interface{}) {
+			if barriers := result.([]Barrier); len(barriers) != 0 {
+				t.Fatalf("got %+v", barriers)
+			}
+		}},
+		{name: "barriers without a name", args: []string{"barriers", "g1"}, err: errUsage.Error()},
+		{name: "trywal", args: []string{"trywal", "-barrier", "ctl", "g1", "b1"}, check: func(t *testing.T, result interface{}) {
+			tryWal := result.(TryWal)
+			if tryWal.BarrierKey != tryBarrier || tryWal.Wal == nil || tryWal.Wal.Key != walock.WalKey("alice", 2) ||
+				tryWal.Wal.Envelope == nil || tryWal.Wal.Envelope.GlobalId != "g1" || tryWal.Wal.Envelope.BranchType != consts.TccBranchTypeTry {
+				t.Fatalf("got %+v", tryWal)
+			}
+		}},
+		{name: "trywal of an unknown branch", args: []string{"trywal", "-barrier", "ctl", "g1", "b9"}, err: "try barrier not found"},
+		{name: "wals", args: []string{"wals", consts.WalKeyPrefix + "alice"}, check: func(t *testing.T, result interface{}) {
+			want := []string{walock.WalKey("alice", 1), walock.WalKey("alice", 2)}
+			if keys := entryKeys(result.([]Entry)); !reflect.DeepEqual(keys, want) {
+				t.Fatalf("got %v", keys)
+			}
+		}},
+		{name: "wals of all keys", args: []string{"wals", consts.WalKeyPrefix}, check: func(t *testing.T, result interface{}) {
+			want := []string{walock.WalKey("alice", 1), walock.WalKey("alice", 2), walock.WalKey("bob", 1)}
+			if keys := entryKeys(result.([]Entry)); !reflect.DeepEqual(keys, want) {
+				t.Fatalf("got %v", keys)
+			}
+		}},
+		{name: "wals without a prefix", args: []string{"wals"}, err: errUsage.Error()},
+		{name: "dirty", args: []string{"dirty"}, check: func(t *testing.T, result interface{}) {
+			if !reflect.DeepEqual(result, []string{"alice", "bob"}) {
+				t.Fatalf("got %v", result)
+			}
+		}},
+		{name: "dirty with another prefix", args: []string{"dirty", "-prefix", "NONE-"}, check: func(t *testing.T, result interface{}) {
+			if keys := result.([]string); len(keys) != 0 {
+				t.Fatalf("got %v", keys)
+			}
+		}},
+		{name: "verify", args: []string{"verify", "-dirty"}, check: func(t *testing.T, result interface{}) {
+			// nothing is flushed, so both keys replay their wals
+			mismatches := result.([]Mismatch)
+			if len(mismatches) != 2 || mismatches[0].Key != "alice" || !mismatches[0].Updated || mismatches[0].Error != "" {
+				t.Fatalf("got %+v", mismatches)
+			}
+			if a := mismatches[0].Replayed.(*balance.Account); a.Available != 70 || a.Frozen != 30 {
+				t.Fatalf("alice replayed to %+v", a)
+			}
+		}},
+		{name: "verify without keys", args: []string{"verify"}, err: errUsage.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := commands()[tt.args[0]].run(c, tt.args[1:])
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, result)
+		})
+	}
+}
+
+func TestVerifyWithoutProvider(t *testing.T) {
+	c := newCtl(t)
+	c.newProvider = nil
+	if _, err := c.runVerify([]string{"alice"}); err == nil {
+		t.Fatal("verify ran without a business provider")
+	}
+}
+
+func TestOpenMissingDb(t *testing.T) {
+	for _, dir := range []string{filepath.Join(t.TempDir(), "missing"), t.TempDir()} {
+		c, err := open(dir, nil)
+		if err == nil {
+			_ = c.db.Close()
+			t.Fatalf("opened %s", dir)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package ctl
+
+import (
+	"errors"
+	"github.com/latifrons/walock/kv/leveldbkv"
+	"github.com/latifrons/walock/model"
+)
+
+var errReadOnly = errors.New("walockctl opens the database read-only")
+
+// readOnlyOperator is the model.KvStoreOperator handed to business providers by walockctl
+type readOnlyOperator struct {
+	leveldbkv.LevelDbKv
+}
+
+func (o *readOnlyOperator) Write(batch *model.KvBatch) error {
+	return errReadOnly
+}
+
+func (o *readOnlyOperator) Put(key, value []byte) error {
+	return errReadOnly
+}
+
+func (o *readOnlyOperator) Delete(key []byte) error {
+	return errReadOnly
+}
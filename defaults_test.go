@@ -0,0 +1,127 @@
+package walock_test
+
+import (
+	"context"
+	"github.com/glebarez/sqlite"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"testing"
+)
+
+// runTcc credits alice, reserves part of it, confirms it and cancels a branch that never tried
+func runTcc(t *testing.T, store walock.TccStore) {
+	t.Helper()
+	ctx := context.Background()
+	calls := []struct {
+		name string
+		call func() (model.TccCode, string, string, error)
+	}{
+		{"must", func() (model.TccCode, string, string, error) {
+			return store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+		}},
+		{"try", func() (model.TccCode, string, string, error) {
+			return store.Try(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+		}},
+		{"confirm", func() (model.TccCode, string, string, error) {
+			return store.Confirm(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", nil)
+		}},
+		{"empty rollback", func() (model.TccCode, string, string, error) {
+			return store.Cancel(ctx, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "alice", nil)
+		}},
+	}
+	for _, c := range calls {
+		tccCode, code, message, err := c.call()
+		if err != nil || tccCode != consts.TccCode_Success {
+			t.Fatalf("%s = %d %s %s, %v", c.name, tccCode, code, message, err)
+		}
+	}
+}
+
+func TestLevelDbStoreWithoutInitDefault(t *testing.T) {
+	metrics, _ := model.NewMetrics("walock", nil)
+	kv := &memkv.MemKv{}
+	provider := &balance.LevelDbProvider{Persister: &balance.KvPersister{Kv: kv}}
+	provider.InitDefault()
+	store := &walock.WalockStoreLevelDb{
+		Metrics:           metrics,
+		BusinessProvider:  provider,
+		TccBarrierLevelDb: &tcc.TccBarrierLevelDb{},
+		BarrierName:       "defaults",
+	}
+
+	runTcc(t, &walock.LevelDbTccStore{Store: store, Tx: kv})
+	err := store.FlushDirty(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := store.Get(context.Background(), kv, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account := value.(*balance.Account); account.Available != 70 || account.Frozen != 0 {
+		t.Fatalf("alice has %d available, %d frozen", account.Available, account.Frozen)
+	}
+}
+
+// openSqlite returns an empty in-memory SQLite, closed with the test
+func openSqlite(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDb, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqlDb.Close() })
+	// one connection keeps the in-memory database alive
+	sqlDb.SetMaxOpenConns(1)
+	return db
+}
+
+func TestSqlStoreWithoutInitDefault(t *testing.T) {
+	db := openSqlite(t)
+	provider := &balance.SqlProvider{DbRw: db}
+	provider.InitDefault()
+	err := provider.AutoMigrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Table("tcc_barrier").AutoMigrate(&model.TccBarrierReceiver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := model.NewMetrics("walock", nil)
+	store := &walock.WalockStoreSqlDb{
+		DbRw:             db,
+		Metrics:          metrics,
+		BusinessProvider: provider,
+		BarrierName:      "defaults",
+		TccBarrier: &tcc.TccBarrierSql{
+			BarrierName:  "defaults",
+			DbTableName:  "tcc_barrier",
+			InsertIgnore: clause.OnConflict{DoNothing: true},
+		},
+	}
+
+	runTcc(t, store)
+	err = store.FlushDirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := store.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account := value.(*balance.Account); account.Available != 70 || account.Frozen != 0 {
+		t.Fatalf("alice has %d available, %d frozen", account.Available, account.Frozen)
+	}
+}
@@ -0,0 +1,31 @@
+package walock
+
+import (
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+)
+
+// Dirty markers live in the same KV store as the WALs, under consts.DirtyKeyPrefix + lock key.
+// A key is dirty while it has WALs that are not yet persisted by the business provider.
+
+func dirtyKey(key model.LockerKey) []byte {
+	return []byte(consts.DirtyKeyPrefix + string(key))
+}
+
+// MarkDirty marks or unmarks the lock key as dirty
+func MarkDirty(tx model.KvStoreOperator, key model.LockerKey, isDirty bool) error {
+	if isDirty {
+		return tx.Put(dirtyKey(key), []byte{})
+	}
+	return tx.Delete(dirtyKey(key))
+}
+
+// ListDirty returns all lock keys marked dirty
+func ListDirty(tx model.KvStoreOperator) (keys []model.LockerKey, err error) {
+	prefix := []byte(consts.DirtyKeyPrefix)
+	err = tx.Scan(prefix, func(key, value []byte) bool {
+		keys = append(keys, model.LockerKey(key[len(prefix):]))
+		return true
+	})
+	return
+}
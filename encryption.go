@@ -0,0 +1,161 @@
+package walock
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+)
+
+// KeyProvider supplies the AES keys encrypting the WALs of WalockStoreLevelDb.
+// Keys are 16, 24 or 32 bytes long. To rotate, switch the current key and keep serving the old ones by id
+// until no WAL encrypted with them is left.
+type KeyProvider interface {
+	CurrentKey() (keyId string, key []byte, err error)
+	Key(keyId string) (key []byte, err error)
+}
+
+// StaticKeyProvider serves keys from memory
+type StaticKeyProvider struct {
+	CurrentKeyId string
+	Keys         map[string][]byte
+}
+
+func (p *StaticKeyProvider) CurrentKey() (keyId string, key []byte, err error) {
+	key, err = p.Key(p.CurrentKeyId)
+	return p.CurrentKeyId, key, err
+}
+
+func (p *StaticKeyProvider) Key(keyId string) (key []byte, err error) {
+	key, ok := p.Keys[keyId]
+	if !ok {
+		err = fmt.Errorf("unknown encryption key %q", keyId)
+	}
+	return
+}
+
+// An encrypted value is framed as
+//
+//	magic "WE" | key id length uvarint | key id | nonce | AES-GCM ciphertext and tag
+//
+// The KV key the value is stored under is the additional data, so a value cannot be moved to another key.
+
+var encryptedMagic = [2]byte{'W', 'E'}
+
+var errNoKeyProvider = errors.New("value is encrypted but the store has no KeyProvider")
+
+// IsEncryptedValue tells whether b starts like a value encrypted by the store. It does not verify it.
+func IsEncryptedValue(b []byte) bool {
+	return len(b) >= 2 && b[0] == encryptedMagic[0] && b[1] == encryptedMagic[1]
+}
+
+func newGcm(key []byte) (gcm cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals plaintext stored under kvKey with the current key
+func (f *WalockStoreLevelDb) encrypt(kvKey string, plaintext []byte) (b []byte, err error) {
+	keyId, key, err := f.KeyProvider.CurrentKey()
+	if err != nil {
+		return
+	}
+	gcm, err := newGcm(key)
+	if err != nil {
+		return
+	}
+	b = make([]byte, 0, 2+binary.MaxVarintLen64+len(keyId)+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	b = append(b, encryptedMagic[:]...)
+	b = binary.AppendUvarint(b, uint64(len(keyId)))
+	b = append(b, keyId...)
+	nonce := b[len(b) : len(b)+gcm.NonceSize()]
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+	b = b[:len(b)+gcm.NonceSize()]
+	b = gcm.Seal(b, nonce, plaintext, []byte(kvKey))
+	return
+}
+
+// decrypt opens a value encrypted under kvKey. Failures are WalCorruptionError.
+func (f *WalockStoreLevelDb) decrypt(kvKey string, b []byte) (plaintext []byte, err error) {
+	corrupted := func(format string, a ...interface{}) ([]byte, error) {
+		return nil, &WalCorruptionError{Key: kvKey, Reason: fmt.Sprintf(format, a...)}
+	}
+	if f.KeyProvider == nil {
+		return nil, errNoKeyProvider
+	}
+	if !IsEncryptedValue(b) {
+		return corrupted("bad encryption magic")
+	}
+	rest := b[2:]
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || uint64(len(rest)-size) < n {
+		return corrupted("truncated key id")
+	}
+	keyId := string(rest[size : size+int(n)])
+	rest = rest[size+int(n):]
+
+	key, err := f.KeyProvider.Key(keyId)
+	if err != nil {
+		return
+	}
+	gcm, err := newGcm(key)
+	if err != nil {
+		return
+	}
+	if len(rest) < gcm.NonceSize()+gcm.Overhead() {
+		return corrupted("truncated ciphertext")
+	}
+	plaintext, err = gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], []byte(kvKey))
+	if err != nil {
+		return corrupted("decrypt with key %q: %v", keyId, err)
+	}
+	return
+}
+
+// BarriersEncrypted tells whether the KV store holds encrypted barrier values, from the consts.EncryptedBarriersKey marker.
+// Without it, no barrier value is encrypted, whatever its first bytes.
+func BarriersEncrypted(tx model.KvStoreOperator) (encrypted bool, err error) {
+	_, err = tx.Get([]byte(consts.EncryptedBarriersKey))
+	if errors.Is(err, model.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sealBarrierValue encrypts the value of a barrier if the store encrypts barriers, adding the
+// consts.EncryptedBarriersKey marker to the batch the first time
+func (f *WalockStoreLevelDb) sealBarrierValue(b *model.KvBatch, barrierKey string, value []byte) ([]byte, error) {
+	if f.KeyProvider == nil || !f.EncryptBarriers {
+		return value, nil
+	}
+	if !f.encryptedBarriers.Load() {
+		b.Put([]byte(consts.EncryptedBarriersKey), []byte{})
+	}
+	return f.encrypt(barrierKey, value)
+}
+
+// openBarrierValue decrypts the value of a barrier if the KV store has encrypted barriers and the value is one of them.
+// WAL keys, which plain barrier values are, never start like an encrypted value.
+func (f *WalockStoreLevelDb) openBarrierValue(tx model.KvStoreOperator, barrierKey string, value []byte) ([]byte, error) {
+	if !f.encryptedBarriers.Load() {
+		encrypted, err := BarriersEncrypted(tx)
+		if err != nil || !encrypted {
+			return value, err
+		}
+		f.encryptedBarriers.Store(true)
+	}
+	if !IsEncryptedValue(value) {
+		return value, nil
+	}
+	return f.decrypt(barrierKey, value)
+}
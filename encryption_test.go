@@ -0,0 +1,225 @@
+package walock_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"testing"
+)
+
+func newEncryptedStore(kv model.KvStoreOperator, keys *walock.StaticKeyProvider) *walock.WalockStoreLevelDb {
+	store := newEngineStore(kv, false)
+	store.KeyProvider = keys
+	store.EncryptBarriers = true
+	return store
+}
+
+func testKeys() *walock.StaticKeyProvider {
+	return &walock.StaticKeyProvider{
+		CurrentKeyId: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+}
+
+func mustTcc(t *testing.T, name string, tccCode model.TccCode, err error) {
+	t.Helper()
+	if err != nil || tccCode != consts.TccCode_Success {
+		t.Fatalf("%s = %d, %v", name, tccCode, err)
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	kv := &memkv.MemKv{}
+	store := &walock.LevelDbTccStore{Store: newEncryptedStore(kv, testKeys()), Tx: kv}
+	tccCode, _, _, err := store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	mustTcc(t, "Must", tccCode, err)
+	tccContext := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+	tccCode, _, _, err = store.Try(ctx, tccContext, "alice", int64(30))
+	mustTcc(t, "Try", tccCode, err)
+
+	walBytes, err := kv.Get([]byte(walock.WalKey("alice", 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := walock.DecodeWalEnvelope(walock.WalKey("alice", 2), walBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !envelope.Encrypted || !walock.IsEncryptedValue(envelope.Payload) || bytes.Contains(envelope.Payload, []byte("alice")) {
+		t.Fatalf("wal payload in clear: %q", envelope.Payload)
+	}
+	barrier := tcc.BuildTccBarrierReceiver("engine", tccContext.GlobalId, tccContext.BranchId, consts.TccBranchTypeTry)
+	barrierValue, err := kv.Get([]byte(barrier.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !walock.IsEncryptedValue(barrierValue) {
+		t.Fatalf("barrier in clear: %q", barrierValue)
+	}
+	if encrypted, err := walock.BarriersEncrypted(kv); err != nil || !encrypted {
+		t.Fatalf("BarriersEncrypted = %v, %v", encrypted, err)
+	}
+
+	// a restarted store decrypts the wals and the barrier of the reservation
+	restarted := &walock.LevelDbTccStore{Store: newEncryptedStore(kv, testKeys()), Tx: kv}
+	tccCode, _, _, err = restarted.Confirm(ctx, tccContext, "alice", nil)
+	mustTcc(t, "Confirm", tccCode, err)
+	if a := account(t, restarted.Store, kv, "alice"); a.Available != 70 || a.Frozen != 0 || a.Seq != 3 {
+		t.Fatalf("alice has %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	kv := &memkv.MemKv{}
+	keys := testKeys()
+	store := &walock.LevelDbTccStore{Store: newEncryptedStore(kv, keys), Tx: kv}
+	tccCode, _, _, err := store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	mustTcc(t, "Must", tccCode, err)
+	tccContext := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+	tccCode, _, _, err = store.Try(ctx, tccContext, "alice", int64(30))
+	mustTcc(t, "Try", tccCode, err)
+
+	// the wals and the barrier sealed with k1 still open once k2 is the current key
+	keys.CurrentKeyId = "k2"
+	restarted := &walock.LevelDbTccStore{Store: newEncryptedStore(kv, keys), Tx: kv}
+	tccCode, _, _, err = restarted.Cancel(ctx, tccContext, "alice", nil)
+	mustTcc(t, "Cancel", tccCode, err)
+	tccCode, _, _, err = restarted.Must(ctx, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "alice", int64(5))
+	mustTcc(t, "Must", tccCode, err)
+
+	restarted = &walock.LevelDbTccStore{Store: newEncryptedStore(kv, keys), Tx: kv}
+	if a := account(t, restarted.Store, kv, "alice"); a.Available != 105 || a.Frozen != 0 || a.Seq != 4 {
+		t.Fatalf("alice has %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+	}
+}
+
+func TestEncryptionFailures(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name   string
+		tamper func(t *testing.T, kv *memkv.MemKv, keys *walock.StaticKeyProvider)
+		check  func(t *testing.T, err error)
+	}{
+		{"tampered ciphertext", func(t *testing.T, kv *memkv.MemKv, keys *walock.StaticKeyProvider) {
+			key := walock.WalKey("alice", 2)
+			envelope := decodeWal(t, kv, key)
+			envelope.Payload[len(envelope.Payload)-1] ^= 1
+			putWal(t, kv, key, envelope)
+		}, wantCorruption},
+		{"wal moved to another key", func(t *testing.T, kv *memkv.MemKv, keys *walock.StaticKeyProvider) {
+			// the envelope is intact, but the key is the additional data of the ciphertext
+			b, err := kv.Get([]byte(walock.WalKey("alice", 1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = kv.Put([]byte(walock.WalKey("alice", 2)), b)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, wantCorruption},
+		{"missing key id", func(t *testing.T, kv *memkv.MemKv, keys *walock.StaticKeyProvider) {
+			delete(keys.Keys, "k1")
+		}, func(t *testing.T, err error) {
+			var corruption *walock.WalCorruptionError
+			if err == nil || errors.As(err, &corruption) {
+				t.Fatalf("Get without the key = %v, want an unknown key error", err)
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			kv := &memkv.MemKv{}
+			keys := testKeys()
+			store := &walock.LevelDbTccStore{Store: newEncryptedStore(kv, keys), Tx: kv}
+			tccCode, _, _, err := store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+			mustTcc(t, "Must", tccCode, err)
+			tccCode, _, _, err = store.Must(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(5))
+			mustTcc(t, "Must", tccCode, err)
+
+			c.tamper(t, kv, keys)
+			_, err = newEncryptedStore(kv, keys).Get(ctx, kv, "alice")
+			c.check(t, err)
+		})
+	}
+}
+
+func wantCorruption(t *testing.T, err error) {
+	t.Helper()
+	var corruption *walock.WalCorruptionError
+	if !errors.As(err, &corruption) || corruption.Key != walock.WalKey("alice", 2) {
+		t.Fatalf("Get = %v, want a WalCorruptionError on the second wal", err)
+	}
+}
+
+func decodeWal(t *testing.T, kv model.KvStoreOperator, key string) *model.WalEnvelope {
+	t.Helper()
+	b, err := kv.Get([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := walock.DecodeWalEnvelope(key, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+func putWal(t *testing.T, kv model.KvStoreOperator, key string, envelope *model.WalEnvelope) {
+	t.Helper()
+	b, err := walock.EncodeWalEnvelope(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Put([]byte(key), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a plain barrier value starting like an encrypted one is not decrypted in a store without encrypted barriers
+func TestPlainBarrierLikeEncrypted(t *testing.T) {
+	ctx := context.Background()
+	kv := &memkv.MemKv{}
+	store := &walock.LevelDbTccStore{Store: newEngineStore(kv, false), Tx: kv}
+	tccCode, _, _, err := store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	mustTcc(t, "Must", tccCode, err)
+	tccContext := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+	tccCode, _, _, err = store.Try(ctx, tccContext, "alice", int64(30))
+	mustTcc(t, "Try", tccCode, err)
+
+	walBytes, err := kv.Get([]byte(walock.WalKey("alice", 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Put([]byte("WE-legacy-wal"), walBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	barrier := tcc.BuildTccBarrierReceiver("engine", tccContext.GlobalId, tccContext.BranchId, consts.TccBranchTypeTry)
+	err = kv.Put([]byte(barrier.Key), []byte("WE-legacy-wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tccCode, _, _, err = store.Confirm(ctx, tccContext, "alice", nil)
+	mustTcc(t, "Confirm", tccCode, err)
+}
+
+func TestKeyProviderNeedsEnvelopeVersion3(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("InitDefault accepted a KeyProvider with wal envelope version 2")
+		}
+	}()
+	store := &walock.WalockStoreLevelDb{KeyProvider: testKeys(), WalEnvelopeVersion: walock.WalEnvelopeVersion2}
+	store.InitDefault()
+}
@@ -0,0 +1,318 @@
+package walock_test
+
+import (
+	"context"
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/leveldbkv"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/kv/pebblekv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"reflect"
+	"testing"
+)
+
+// engines open an empty KV store on each engine. compact moves what was written into table files,
+// whose iterators reuse their buffers during Scan, unlike memkv.
+// The store suite runs unchanged on each of them.
+var engines = []struct {
+	name string
+	open func(t *testing.T) (kv model.KvStoreOperator, compact func())
+}{
+	{"goleveldb", func(t *testing.T) (model.KvStoreOperator, func()) {
+		db, err := leveldb.Open(storage.NewMemStorage(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return &leveldbkv.LevelDbKv{Db: db}, func() {
+			if err := db.CompactRange(util.Range{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}},
+	{"memkv", func(t *testing.T) (model.KvStoreOperator, func()) {
+		return &memkv.MemKv{}, func() {}
+	}},
+	{"pebble", func(t *testing.T) (model.KvStoreOperator, func()) {
+		db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		kv := &pebblekv.PebbleKv{Db: db}
+		kv.InitDefault()
+		return kv, func() {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}},
+}
+
+// rawWalProvider hides the walock.WalFactory of the balance provider, which then decodes the WalBytes itself
+type rawWalProvider struct {
+	walock.BusinessProviderLevelDb
+}
+
+// newEngineStore returns a store keeping its accounts, WALs and barriers in kv, as a restarted process would
+func newEngineStore(kv model.KvStoreOperator, rawWals bool) *walock.WalockStoreLevelDb {
+	logger := zerolog.Nop()
+	persister := &balance.KvPersister{Kv: kv}
+	persister.InitDefault()
+	provider := &balance.LevelDbProvider{Persister: persister}
+	provider.InitDefault()
+	barrier := &tcc.TccBarrierLevelDb{Logger: &logger}
+	barrier.InitDefault()
+	store := &walock.WalockStoreLevelDb{
+		BusinessProvider:  provider,
+		TccBarrierLevelDb: barrier,
+		BarrierName:       "engine",
+		Logger:            &logger,
+	}
+	if rawWals {
+		store.BusinessProvider = &rawWalProvider{provider}
+	}
+	store.InitDefault()
+	return store
+}
+
+func account(t *testing.T, store *walock.WalockStoreLevelDb, kv model.KvStoreOperator, key model.LockerKey) *balance.Account {
+	t.Helper()
+	value, err := store.Get(context.Background(), kv, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value.(*balance.Account)
+}
+
+func TestReplayWalsAfterRestart(t *testing.T) {
+	for _, engine := range engines {
+		for _, rawWals := range []bool{false, true} {
+			name := engine.name + "/typed"
+			if rawWals {
+				name = engine.name + "/raw"
+			}
+			t.Run(name, func(t *testing.T) {
+				testReplayWalsAfterRestart(t, engine.open, rawWals)
+			})
+		}
+	}
+}
+
+func testReplayWalsAfterRestart(t *testing.T, open func(t *testing.T) (model.KvStoreOperator, func()), rawWals bool) {
+	kv, compact := open(t)
+	runTcc(t, &walock.LevelDbTccStore{Store: newEngineStore(kv, rawWals), Tx: kv})
+	compact()
+
+	// nothing was flushed: the restarted store replays every WAL of alice
+	wals := 0
+	err := walock.ScanWals(kv, "alice", 0, func(wal model.Wal) bool {
+		wals++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wals < 2 {
+		t.Fatalf("alice has %d wals, want at least 2", wals)
+	}
+	store := newEngineStore(kv, rawWals)
+	a := account(t, store, kv, "alice")
+	if a.Available != 70 || a.Frozen != 0 || a.Seq != uint64(wals) {
+		t.Fatalf("alice replayed to %d available, %d frozen at seq %d, want 70, 0 at seq %d", a.Available, a.Frozen, a.Seq, wals)
+	}
+}
+
+// engineSuite is the behaviour WalockStoreLevelDb and tcc.TccBarrierLevelDb expect from any KV engine
+var engineSuite = []struct {
+	name string
+	run  func(t *testing.T, kv model.KvStoreOperator, compact func())
+}{
+	{"kv", testKvOperator},
+	{"tcc", testTccOnEngine},
+	{"flush", testFlushOnEngine},
+	{"compact", testCompactOnEngine},
+	{"replay", func(t *testing.T, kv model.KvStoreOperator, compact func()) {
+		testReplayWalsAfterRestart(t, func(t *testing.T) (model.KvStoreOperator, func()) { return kv, compact }, false)
+	}},
+}
+
+func TestStoreOnEngines(t *testing.T) {
+	for _, engine := range engines {
+		for _, c := range engineSuite {
+			t.Run(engine.name+"/"+c.name, func(t *testing.T) {
+				kv, compact := engine.open(t)
+				c.run(t, kv, compact)
+			})
+		}
+	}
+}
+
+func testKvOperator(t *testing.T, kv model.KvStoreOperator, compact func()) {
+	_, err := kv.Get([]byte("a"))
+	if err != model.ErrNotFound {
+		t.Fatalf("Get missing err = %v, want ErrNotFound", err)
+	}
+	b := &model.KvBatch{}
+	b.Put([]byte("p-2"), []byte("two"))
+	b.Put([]byte("p-1"), []byte("one"))
+	b.Put([]byte("p-3"), []byte("three"))
+	b.Put([]byte("q-1"), []byte("other"))
+	b.Delete([]byte("p-3"))
+	err = kv.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Put([]byte("p-0"), []byte("zero"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Delete([]byte("p-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact()
+
+	value, err := kv.Get([]byte("p-1"))
+	if err != nil || string(value) != "one" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+	var scanned []string
+	err = kv.Scan([]byte("p-"), func(key, value []byte) bool {
+		scanned = append(scanned, string(key)+"="+string(value))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"p-1=one", "p-2=two"}; !reflect.DeepEqual(scanned, want) {
+		t.Fatalf("Scan = %v, want %v", scanned, want)
+	}
+	scanned = nil
+	err = kv.Scan([]byte("p-"), func(key, value []byte) bool {
+		scanned = append(scanned, string(key))
+		return false
+	})
+	if err != nil || len(scanned) != 1 {
+		t.Fatalf("Scan stopped after %v, %v", scanned, err)
+	}
+}
+
+func testTccOnEngine(t *testing.T, kv model.KvStoreOperator, compact func()) {
+	store := newEngineStore(kv, false)
+	ctx := context.Background()
+	calls := []struct {
+		name    string
+		call    func() (model.TccCode, string, string, error)
+		tccCode model.TccCode
+		code    string
+	}{
+		{"must", func() (model.TccCode, string, string, error) {
+			return store.Must(ctx, kv, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+		}, consts.TccCode_Success, ""},
+		{"try", func() (model.TccCode, string, string, error) {
+			return store.Try(ctx, kv, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+		}, consts.TccCode_Success, ""},
+		{"duplicate try", func() (model.TccCode, string, string, error) {
+			return store.Try(ctx, kv, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+		}, consts.TccCode_Success, ""},
+		{"insufficient try", func() (model.TccCode, string, string, error) {
+			return store.Try(ctx, kv, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "alice", int64(100))
+		}, consts.TccCode_Failed, balance.ErrInsufficientBalance},
+		{"try to cancel", func() (model.TccCode, string, string, error) {
+			return store.Try(ctx, kv, &model.TccContext{GlobalId: "g3", BranchId: "b1"}, "alice", int64(20))
+		}, consts.TccCode_Success, ""},
+		{"confirm", func() (model.TccCode, string, string, error) {
+			return store.Confirm(ctx, kv, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", nil)
+		}, consts.TccCode_Success, ""},
+		{"duplicate confirm", func() (model.TccCode, string, string, error) {
+			return store.Confirm(ctx, kv, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", nil)
+		}, consts.TccCode_Success, ""},
+		{"cancel", func() (model.TccCode, string, string, error) {
+			return store.Cancel(ctx, kv, &model.TccContext{GlobalId: "g3", BranchId: "b1"}, "alice", nil)
+		}, consts.TccCode_Success, ""},
+		{"empty rollback", func() (model.TccCode, string, string, error) {
+			return store.Cancel(ctx, kv, &model.TccContext{GlobalId: "g4", BranchId: "b1"}, "alice", nil)
+		}, consts.TccCode_Success, ""},
+	}
+	for _, c := range calls {
+		tccCode, code, message, err := c.call()
+		if err != nil || tccCode != c.tccCode || code != c.code {
+			t.Fatalf("%s = %d %s %s, %v, want %d %s", c.name, tccCode, code, message, err, c.tccCode, c.code)
+		}
+	}
+	a := account(t, store, kv, "alice")
+	if a.Available != 70 || a.Frozen != 0 {
+		t.Fatalf("alice has %d available, %d frozen", a.Available, a.Frozen)
+	}
+}
+
+func testFlushOnEngine(t *testing.T, kv model.KvStoreOperator, compact func()) {
+	store := newEngineStore(kv, false)
+	runTcc(t, &walock.LevelDbTccStore{Store: store, Tx: kv})
+	dirty, err := walock.ListDirty(kv)
+	if err != nil || len(dirty) != 1 || dirty[0] != "alice" {
+		t.Fatalf("ListDirty = %v, %v", dirty, err)
+	}
+	err = store.FlushDirty(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact()
+
+	persister := &balance.KvPersister{Kv: kv}
+	persister.InitDefault()
+	persisted, found, err := persister.Load("alice")
+	if err != nil || !found {
+		t.Fatalf("alice not persisted: %v", err)
+	}
+	a := account(t, store, kv, "alice")
+	if persisted.Available != 70 || persisted.Seq != a.Seq {
+		t.Fatalf("alice persisted with %d available at seq %d, cached at seq %d", persisted.Available, persisted.Seq, a.Seq)
+	}
+	dirty, err = walock.ListDirty(kv)
+	if err != nil || len(dirty) != 0 {
+		t.Fatalf("ListDirty after flush = %v, %v", dirty, err)
+	}
+}
+
+func testCompactOnEngine(t *testing.T, kv model.KvStoreOperator, compact func()) {
+	store := newEngineStore(kv, false)
+	ctx := context.Background()
+	tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+	_, _, _, err := tccStore.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tccCode, _, _, err := tccStore.Try(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+	if err != nil || tccCode != consts.TccCode_Success {
+		t.Fatalf("Try = %d, %v", tccCode, err)
+	}
+	err = store.FlushDirty(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact()
+
+	// the try WAL of the open reservation stays for Confirm
+	deleted, err := store.CompactWals(kv)
+	if err != nil || deleted != 1 {
+		t.Fatalf("CompactWals = %d, %v, want 1", deleted, err)
+	}
+	tccCode, _, _, err = tccStore.Confirm(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", nil)
+	if err != nil || tccCode != consts.TccCode_Success {
+		t.Fatalf("Confirm = %d, %v", tccCode, err)
+	}
+	if a := account(t, store, kv, "alice"); a.Available != 70 || a.Frozen != 0 {
+		t.Fatalf("alice has %d available, %d frozen", a.Available, a.Frozen)
+	}
+}
@@ -0,0 +1,96 @@
+package walock
+
+import (
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock/model"
+	"runtime/debug"
+	"time"
+)
+
+// PanicError is returned when the business provider panics while loading a value or generating a WAL.
+// The cached value of the key is dropped so that the next access rebuilds it.
+// Panics while applying a durable WAL are logged as PanicError but do not fail the call.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte
+}
+
+func newPanicError(r interface{}) *PanicError {
+	return &PanicError{
+		Value: r,
+		Stack: debug.Stack(),
+	}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in business provider: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it is an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// ErrLegacyWalsNotMigrated is returned instead of replaying the WALs of a LegacyWalMigrator provider
+// until WalockStoreLevelDb.MigrateLegacyWals has run on the KV store
+var ErrLegacyWalsNotMigrated = errors.New("walock: legacy wals not migrated. run MigrateLegacyWals")
+
+// WalChainError is returned when the WALs of a key do not continue its version one by one,
+// or when the business provider did not move the version to the seq of the last applied WAL.
+type WalChainError struct {
+	Key      model.LockerKey
+	Expected uint64
+	Found    uint64
+}
+
+func (e *WalChainError) Error() string {
+	return fmt.Sprintf("wal chain broken on %s: expected seq %d, found %d", e.Key, e.Expected, e.Found)
+}
+
+// OpenReservationsError is returned by WalockStoreLevelDb.Evict for keys with reservations neither confirmed nor cancelled.
+// Their barriers and try WALs are in the local KV store, so only this store can settle them.
+type OpenReservationsError struct {
+	Keys []model.LockerKey
+}
+
+func (e *OpenReservationsError) Error() string {
+	return fmt.Sprintf("%d keys have open reservations, first %s", len(e.Keys), e.Keys[0])
+}
+
+// LeaseHeldError is returned by SqlLease.Acquire while another replica holds the lease
+type LeaseHeldError struct {
+	Name       string
+	Holder     string
+	ExpireTime time.Time
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("lease %s is held by %s until %s", e.Name, e.Holder, e.ExpireTime.Format(time.RFC3339Nano))
+}
+
+// LeaseLostError fails a write of WalockStoreSqlDb whose values were loaded under an epoch of the lease
+// this replica does not hold anymore, or never held
+type LeaseLostError struct {
+	Name  string
+	Epoch uint64
+}
+
+func (e *LeaseLostError) Error() string {
+	return fmt.Sprintf("lease %s not held at epoch %d", e.Name, e.Epoch)
+}
+
+// StaleEpochError is returned by a business provider refusing a WAL written under an older lease epoch
+// than the WALs already recorded for the key
+type StaleEpochError struct {
+	Key     model.LockerKey
+	Epoch   uint64
+	Current uint64
+}
+
+func (e *StaleEpochError) Error() string {
+	return fmt.Sprintf("stale wal on %s: epoch %d, key is at epoch %d", e.Key, e.Epoch, e.Current)
+}
@@ -0,0 +1,116 @@
+package walock
+
+import (
+	"github.com/latifrons/walock/model"
+	"sort"
+	"sync"
+)
+
+// lockFresh locks the locker of the key, retrying with the new locker if it was evicted while waiting
+func lockFresh(ensureLocker func(key model.LockerKey) *model.Locker, key model.LockerKey) *model.Locker {
+	for {
+		lock := ensureLocker(key)
+		lock.Mu.Lock()
+		if !lock.Evicted {
+			return lock
+		}
+		lock.Mu.Unlock()
+	}
+}
+
+// evict drops the cached values of the keys matching match once flush has persisted them.
+// It stops at the first flush failure, leaving that key cached.
+func evict(accounts *sync.Map, match func(key model.LockerKey) bool, flush func(key model.LockerKey, value model.LockerValue) error) (evicted int, err error) {
+	accounts.Range(func(k, v any) bool {
+		key := model.LockerKey(k.(string))
+		if !match(key) {
+			return true
+		}
+		lock := v.(*model.Locker)
+		lock.Mu.Lock()
+		defer lock.Mu.Unlock()
+		if lock.Evicted {
+			return true
+		}
+		if lock.Value != nil && (lock.Value.IsDirty() || lock.Value.GetDbVersion() != lock.Value.GetVersion()) {
+			err = flush(key, lock.Value)
+			if err != nil {
+				return false
+			}
+		}
+		lock.Evicted = true
+		lock.Value = nil
+		accounts.CompareAndDelete(k, v)
+		evicted++
+		return true
+	})
+	return
+}
+
+// Evict flushes the cached values of the keys matching match and drops them from the cache, together with their
+// local snapshots, so that another owner can take the keys over. It stops at the first flush failure.
+// The WALs and barriers stay in the local store, so Evict refuses with an OpenReservationsError, evicting nothing,
+// while a matching key has an open reservation: it can only be settled here.
+func (f *WalockStoreLevelDb) Evict(tx model.KvStoreOperator, match func(key model.LockerKey) bool) (evicted int, err error) {
+	err = f.checkOpenReservations(tx, match)
+	if err != nil {
+		return
+	}
+	evicted, err = evict(&f.accounts, match, func(key model.LockerKey, value model.LockerValue) error {
+		return f.flushValue(tx, key, value)
+	})
+	if err != nil || !f.Snapshots {
+		return
+	}
+	// the next owner moves the persisted value past the snapshots
+	var keys [][]byte
+	err = tx.Scan([]byte(snapshotKey("")), func(k, v []byte) bool {
+		if match(model.LockerKey(k[len(snapshotKey("")):])) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return true
+	})
+	if err != nil || len(keys) == 0 {
+		return
+	}
+	b := &model.KvBatch{}
+	for _, k := range keys {
+		b.Delete(k)
+	}
+	err = tx.Write(b)
+	return
+}
+
+// Evict flushes the cached values of the keys matching match and drops them from the cache,
+// so that another owner can take the keys over. It stops at the first flush failure.
+func (f *WalockStoreSqlDb) Evict(match func(key model.LockerKey) bool) (evicted int, err error) {
+	return evict(&f.accounts, match, f.flushValue)
+}
+
+// Evict flushes and drops the cached values of the keys matching match
+func (s *LevelDbTccStore) Evict(match func(key model.LockerKey) bool) (evicted int, err error) {
+	return s.Store.Evict(s.Tx, match)
+}
+
+// checkOpenReservations returns an OpenReservationsError if a key matching match has an open reservation
+func (f *WalockStoreLevelDb) checkOpenReservations(tx model.KvStoreOperator, match func(key model.LockerKey) bool) (err error) {
+	open, err := f.openReservations(tx)
+	if err != nil {
+		return
+	}
+	var keys []model.LockerKey
+	seen := make(map[model.LockerKey]bool)
+	for walKey := range open {
+		key, _, parseErr := ParseWalKey(walKey)
+		if parseErr != nil || seen[key] || !match(key) {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return &OpenReservationsError{Keys: keys}
+}
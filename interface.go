@@ -1,6 +1,7 @@
 package walock
 
 import (
+	"context"
 	"github.com/latifrons/walock/model"
 	"gorm.io/gorm"
 )
@@ -19,6 +20,7 @@ import (
 
 // BusinessProviderSql is the interface for business logic provider.
 // dbContext is usually a *gorm.DB, but can be any type, like leveldb.DB, sql.DB, etc.
+// CatchupWals is only called if the provider is not a WalLoaderSql.
 type BusinessProviderSql interface {
 	LoadPersistedValue(tx *gorm.DB, key model.LockerKey) (v model.LockerValue, err error)
 	GenerateWalTry(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, tryBody interface{}) (ok bool, code string, message string, tryWali interface{}, err error)
@@ -35,15 +37,95 @@ type BusinessProviderSql interface {
 	Flush(tx *gorm.DB, value model.LockerValue) error
 }
 
+// WalFactory is implemented by a BusinessProviderLevelDb returning typed WALs in model.Wal.Value.
+// WalockStoreLevelDb decodes the stored WALs into NewWal before MustApplyWal, GenerateWalConfirm and GenerateWalCancel.
+type WalFactory interface {
+	NewWal() interface{} // a pointer to decode into
+}
+
+// LegacyWalMigrator is implemented by a BusinessProviderLevelDb upgraded from a release in which it chose the WAL keys
+// and caught up its WALs itself. WalockStoreLevelDb replays no WAL for it until MigrateLegacyWals has run once on the KV store.
+type LegacyWalMigrator interface {
+	// LegacyWalKeys returns the lock keys which still have WALs under the keys chosen by the provider
+	LegacyWalKeys(tx model.KvStoreOperator) ([]model.LockerKey, error)
+	// CatchupLegacyWals applies the legacy WALs of the key above the version of load, as CatchupWals used to
+	CatchupLegacyWals(tx model.KvStoreOperator, key model.LockerKey, load model.LockerValue) (updated bool, err error)
+	// DeleteLegacyWals deletes the legacy WALs of the key once the value they lead to is persisted
+	DeleteLegacyWals(tx model.KvStoreOperator, key model.LockerKey) error
+}
+
+// ValueFactory is implemented by a BusinessProviderLevelDb whose values WalockStoreLevelDb can snapshot locally
+type ValueFactory interface {
+	NewValue(key model.LockerKey) model.LockerValue // a pointer to decode a snapshot into
+}
+
+// BatchLoaderLevelDb is implemented by a BusinessProviderLevelDb loading many persisted values at once for
+// WalockStoreLevelDb.BulkLoad. It returns a value for each key, like LoadPersistedValue.
+type BatchLoaderLevelDb interface {
+	LoadPersistedValues(keys []model.LockerKey) (values map[model.LockerKey]model.LockerValue, err error)
+}
+
+// BatchLoaderSql is implemented by a BusinessProviderSql loading many persisted values in one query for
+// WalockStoreSqlDb.BulkLoad. It returns a value for each key, like LoadPersistedValue.
+type BatchLoaderSql interface {
+	LoadPersistedValues(tx *gorm.DB, keys []model.LockerKey) (values map[model.LockerKey]model.LockerValue, err error)
+}
+
+// WalCompactorSql is implemented by a BusinessProviderSql whose WALs WalockStoreSqlDb.CompactWals can delete.
+// CompactWals deletes the WALs of the key up to persistedVersion, except the ones LoadReservation still needs.
+type WalCompactorSql interface {
+	CompactWals(tx *gorm.DB, key model.LockerKey, persistedVersion uint64) (deleted int, err error)
+}
+
+// EpochWal is implemented by the WALs of a BusinessProviderSql recording the lease epoch they are written under.
+// With a Lease, WalockStoreSqlDb stamps them before FlushWal, so that the provider can refuse the WALs of a stale
+// holder with a StaleEpochError.
+type EpochWal interface {
+	SetEpoch(epoch uint64)
+}
+
+// SeqWal is implemented by the WALs of a BusinessProviderSql numbered by WalockStoreSqlDb. The store sets the seq
+// of each WAL to the next version of the value before FlushWal, and ApplyWal must move the version to it.
+type SeqWal interface {
+	SetSeq(seq uint64)
+	GetSeq() uint64
+}
+
+// WalLoaderSql is implemented by a BusinessProviderSql whose WALs are SeqWal. LoadWals returns the WALs of the key
+// whose seq is above after, in seq order. WalockStoreSqlDb then replays them itself, checking the chain,
+// instead of calling CatchupWals.
+type WalLoaderSql interface {
+	LoadWals(tx *gorm.DB, key model.LockerKey, after uint64) (walis []interface{}, err error)
+}
+
+// ActiveKeysSql is implemented by a BusinessProviderSql remembering the recently used keys of WalockStoreSqlDb.
+// SaveActiveKeys replaces the remembered keys, the most recently used first.
+type ActiveKeysSql interface {
+	SaveActiveKeys(tx *gorm.DB, keys []model.LockerKey) error
+	LoadActiveKeys(tx *gorm.DB) (keys []model.LockerKey, err error)
+}
+
+// SqlTccBarrier is the TCC barrier of WalockStoreSqlDb. persistentContext is the *gorm.DB of the running transaction.
+// skipped tells why the call should be skipped when callIt is false. tcc.TccBarrierSql is the MySQL implementation.
+type SqlTccBarrier interface {
+	BarrierMust(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error)
+	BarrierTry(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error)
+	BarrierConfirm(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error)
+	BarrierCancel(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error)
+}
+
+// BusinessProviderLevelDb is the business logic of WalockStoreLevelDb.
+// The GenerateWal* methods only fill WalBytes, or Value for the store to encode with its WalCodec: the store
+// numbers the WAL with the next version of the value and keeps it under WalKey. MustApplyWal must move the version
+// of the value to the Seq of the last WAL, so that the store can replay the WALs above the persisted version on load.
+// GenerateWalConfirm returns neither WalBytes nor Value if there is nothing to confirm.
 type BusinessProviderLevelDb interface {
 	LoadPersistedValue(key model.LockerKey) (v model.LockerValue, err error)
 	GenerateWalTry(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, tryBody interface{}) (ok bool, code string, message string, tryWali model.Wal, err error)
 	GenerateWalConfirm(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali model.Wal) (confirmWali model.Wal)
 	GenerateWalCancel(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali model.Wal) (revertWali model.Wal)
 	GenerateWalMust(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, mustBody interface{}) (ok bool, code string, message string, mustWali model.Wal, err error)
-	CatchupWals(tx model.LevelDbStoreOperator, key model.LockerKey, load model.LockerValue) (updated bool, err error)
 	MustApplyWal(load model.LockerValue, walis []model.Wal)
-	FlushWal(tx model.LevelDbStoreOperator, wali model.Wal) error
 	Traverse(func(key model.LockerKey, value model.LockerValue) bool)
 	Keys() []model.LockerKey
 	PersistValue(value model.LockerValue) error
@@ -80,3 +162,12 @@ type BusinessProviderLevelDb interface {
 //	MustWal(tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, mustBody interface{}) (ok bool, code string, message string, mustWali interface{}, err error)
 //	LoadReservation(tx *gorm.DB, tccContext *model.TccContext) (wal interface{}, ok bool, code string, message string, err error)
 //}
+
+// TccStore is the TCC surface shared by the walock stores.
+// *WalockStoreSqlDb implements it directly. Use LevelDbTccStore for WalockStoreLevelDb.
+type TccStore interface {
+	Try(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error)
+	Confirm(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error)
+	Cancel(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error)
+	Must(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error)
+}
@@ -0,0 +1,314 @@
+// Package lincheck stress tests the walock stores with concurrent TCC calls, duplicated and reordered like a
+// flaky network would deliver them, records the history and checks with porcupine that it is linearizable
+// against a sequential specification of an account behind the TCC barrier: idempotent retries, empty rollbacks,
+// hanging tries and balances. The final balances are read back into the history and checked too.
+//
+//	c := &lincheck.Checker{Seed: 1}
+//	c.InitDefault()
+//	result, err := c.RunLevelDb()
+package lincheck
+
+import (
+	"context"
+	"fmt"
+	"github.com/anishathalye/porcupine"
+	"github.com/glebarez/sqlite"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/leveldbkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type Checker struct {
+	Seed          int64
+	Clients       int           // concurrent callers. defaults to 16
+	Branches      int           // TCC branches, each delivered several times. defaults to 1000
+	Keys          int           // accounts. defaults to 4
+	Initial       int64         // credited by Must to each account first. defaults to 1000
+	Duplicates    float64       // chance that a call is delivered once more, repeatedly. defaults to 0.3
+	FlushInterval time.Duration // FlushDirty and CompactWals run concurrently at this interval. defaults to 1ms
+	Timeout       time.Duration // for the linearizability check. defaults to 1 minute
+	SqliteDsn     string        // defaults to a private in-memory database
+}
+
+type Result struct {
+	Calls int
+	Check porcupine.CheckResult // Ok, Illegal, or Unknown on timeout
+	Info  porcupine.LinearizationInfo
+
+	model porcupine.Model
+}
+
+// Visualize writes an HTML page of the history, showing where the linearization breaks when Check is Illegal
+func (r *Result) Visualize(path string) error {
+	return porcupine.VisualizePath(r.model, r.Info, path)
+}
+
+func (c *Checker) InitDefault() {
+	if c.Clients == 0 {
+		c.Clients = 16
+	}
+	if c.Branches == 0 {
+		c.Branches = 1000
+	}
+	if c.Keys == 0 {
+		c.Keys = 4
+	}
+	if c.Initial == 0 {
+		c.Initial = 1000
+	}
+	if c.Duplicates == 0 {
+		c.Duplicates = 0.3
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = time.Millisecond
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Minute
+	}
+	if c.SqliteDsn == "" {
+		c.SqliteDsn = "file::memory:"
+	}
+}
+
+// RunLevelDb checks WalockStoreLevelDb with a balance.LevelDbProvider on an in-memory goleveldb
+func (c *Checker) RunLevelDb() (result *Result, err error) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	logger := zerolog.Nop()
+	kv := &leveldbkv.LevelDbKv{Db: db}
+	persister := &balance.KvPersister{Kv: kv}
+	persister.InitDefault()
+	provider := &balance.LevelDbProvider{Persister: persister}
+	provider.InitDefault()
+	barrier := &tcc.TccBarrierLevelDb{Logger: &logger}
+	barrier.InitDefault()
+	store := &walock.WalockStoreLevelDb{
+		BusinessProvider:  provider,
+		TccBarrierLevelDb: barrier,
+		BarrierName:       "lincheck",
+		Logger:            &logger,
+	}
+	store.InitDefault()
+
+	return c.run(accountModel(false), &walock.LevelDbTccStore{Store: store, Tx: kv},
+		func(ctx context.Context, key model.LockerKey) (model.LockerValue, error) {
+			return store.Get(ctx, kv, key)
+		},
+		func() error {
+			err := store.FlushDirty(kv)
+			if err != nil {
+				return err
+			}
+			_, err = store.CompactWals(kv)
+			return err
+		})
+}
+
+// RunSqlite checks WalockStoreSqlDb with a balance.SqlProvider on SQLite
+func (c *Checker) RunSqlite() (result *Result, err error) {
+	db, err := gorm.Open(sqlite.Open(c.SqliteDsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return
+	}
+	sqlDb, err := db.DB()
+	if err != nil {
+		return
+	}
+	defer sqlDb.Close()
+	// SQLite has a single writer. one connection also keeps the in-memory database alive
+	sqlDb.SetMaxOpenConns(1)
+
+	zlogger := zerolog.Nop()
+	provider := &balance.SqlProvider{DbRw: db}
+	provider.InitDefault()
+	err = provider.AutoMigrate(db)
+	if err != nil {
+		return
+	}
+	barrier := &tcc.TccBarrierSql{
+		BarrierName:  "lincheck",
+		DbTableName:  "tcc_barrier",
+		Logger:       &zlogger,
+		InsertIgnore: clause.OnConflict{DoNothing: true},
+	}
+	barrier.InitDefault()
+	err = db.Table(barrier.DbTableName).AutoMigrate(&model.TccBarrierReceiver{})
+	if err != nil {
+		return
+	}
+	store := &walock.WalockStoreSqlDb{
+		DbRw:             db,
+		BusinessProvider: provider,
+		BarrierName:      barrier.BarrierName,
+		Logger:           &zlogger,
+		TccBarrier:       barrier,
+	}
+	store.InitDefault()
+
+	return c.run(accountModel(true), store, store.Get, func() error {
+		err := store.FlushDirty()
+		if err != nil {
+			return err
+		}
+		_, err = store.CompactWals()
+		return err
+	})
+}
+
+// workload returns the calls of all branches, shuffled. A TCC branch is a try followed by a confirm or a cancel,
+// but the shuffle lets the cancel overtake the try, giving empty rollbacks and hanging tries.
+func (c *Checker) workload(keys []model.LockerKey) (calls []input) {
+	rnd := rand.New(rand.NewSource(c.Seed))
+	deliver := func(in input) {
+		calls = append(calls, in)
+		for rnd.Float64() < c.Duplicates {
+			calls = append(calls, in)
+		}
+	}
+	for i := 0; i < c.Branches; i++ {
+		key := keys[rnd.Intn(len(keys))]
+		branch := fmt.Sprintf("g%d", i)
+		if rnd.Intn(4) == 0 {
+			deliver(input{Op: consts.TccOperationMust, Key: key, Branch: branch, Amount: 1 + rnd.Int63n(c.Initial/10)})
+			continue
+		}
+		amount := 1 + rnd.Int63n(c.Initial/5)
+		deliver(input{Op: consts.TccOperationTry, Key: key, Branch: branch, Amount: amount})
+		settle := consts.TccOperationConfirm
+		if rnd.Intn(2) == 0 {
+			settle = consts.TccOperationCancel
+		}
+		deliver(input{Op: settle, Key: key, Branch: branch, Amount: amount})
+	}
+	rnd.Shuffle(len(calls), func(i, j int) {
+		calls[i], calls[j] = calls[j], calls[i]
+	})
+	return
+}
+
+func (c *Checker) run(accountModel porcupine.Model, store walock.TccStore, get func(ctx context.Context, key model.LockerKey) (model.LockerValue, error), flush func() error) (result *Result, err error) {
+	ctx := context.Background()
+	keys := make([]model.LockerKey, c.Keys)
+	for i := range keys {
+		keys[i] = model.LockerKey(fmt.Sprintf("account-%d", i))
+	}
+
+	var mu sync.Mutex
+	var history []porcupine.Operation
+	start := time.Now()
+	record := func(clientId int, in input, do func() output) {
+		callTime := time.Since(start).Nanoseconds()
+		out := do()
+		returnTime := time.Since(start).Nanoseconds()
+		mu.Lock()
+		history = append(history, porcupine.Operation{ClientId: clientId, Input: in, Call: callTime, Output: out, Return: returnTime})
+		mu.Unlock()
+	}
+	getBalance := func(clientId int, key model.LockerKey) {
+		in := input{Op: opGet, Key: key}
+		record(clientId, in, func() (out output) {
+			v, err := get(ctx, key)
+			if err != nil {
+				out.Err = err.Error()
+				return
+			}
+			account := v.(*balance.Account)
+			out.Available = account.Available
+			out.Frozen = account.Frozen
+			return
+		})
+	}
+
+	// initial balances, recorded as well
+	for _, key := range keys {
+		in := input{Op: consts.TccOperationMust, Key: key, Branch: "initial-" + string(key), Amount: c.Initial}
+		record(0, in, func() output { return invoke(ctx, store, in) })
+	}
+
+	calls := c.workload(keys)
+	queue := make(chan input, len(calls))
+	for _, in := range calls {
+		queue <- in
+	}
+	close(queue)
+
+	done := make(chan struct{})
+	flushDone := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(c.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				flushDone <- nil
+				return
+			case <-ticker.C:
+				if err := flush(); err != nil {
+					flushDone <- err
+					return
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for clientId := 0; clientId < c.Clients; clientId++ {
+		wg.Add(1)
+		go func(clientId int) {
+			defer wg.Done()
+			for in := range queue {
+				in := in
+				record(clientId, in, func() output { return invoke(ctx, store, in) })
+			}
+		}(clientId)
+	}
+	wg.Wait()
+	close(done)
+	err = <-flushDone
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		getBalance(0, key)
+	}
+
+	result = &Result{Calls: len(history), model: accountModel}
+	result.Check, result.Info = porcupine.CheckOperationsVerbose(accountModel, history, c.Timeout)
+	return
+}
+
+func invoke(ctx context.Context, store walock.TccStore, in input) (out output) {
+	tccContext := &model.TccContext{GlobalId: in.Branch, BranchId: "b1"}
+	var err error
+	switch in.Op {
+	case consts.TccOperationTry:
+		out.TccCode, out.Code, _, err = store.Try(ctx, tccContext, in.Key, in.Amount)
+	case consts.TccOperationConfirm:
+		out.TccCode, out.Code, _, err = store.Confirm(ctx, tccContext, in.Key, nil)
+	case consts.TccOperationCancel:
+		out.TccCode, out.Code, _, err = store.Cancel(ctx, tccContext, in.Key, nil)
+	case consts.TccOperationMust:
+		out.TccCode, out.Code, _, err = store.Must(ctx, tccContext, in.Key, in.Amount)
+	}
+	if err != nil {
+		out.Err = err.Error()
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package lincheck
+
+import (
+	"fmt"
+	"github.com/anishathalye/porcupine"
+	"testing"
+)
+
+func checkLinearizable(t *testing.T, run func(c *Checker) (*Result, error)) {
+	for _, seed := range []int64{1, 2, 3} {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			c := &Checker{Seed: seed}
+			if testing.Short() {
+				c.Branches = 200
+			}
+			c.InitDefault()
+			result, err := run(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Check != porcupine.Ok {
+				path := t.TempDir() + "/history.html"
+				if err = result.Visualize(path); err != nil {
+					t.Log(err)
+				}
+				t.Fatalf("%d calls: %s, see %s", result.Calls, result.Check, path)
+			}
+		})
+	}
+}
+
+func TestLinearizableLevelDb(t *testing.T) {
+	checkLinearizable(t, (*Checker).RunLevelDb)
+}
+
+func TestLinearizableSqlite(t *testing.T) {
+	checkLinearizable(t, (*Checker).RunSqlite)
+}
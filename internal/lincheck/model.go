@@ -0,0 +1,193 @@
+package lincheck
+
+import (
+	"fmt"
+	"github.com/anishathalye/porcupine"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"reflect"
+)
+
+const opGet = "get"
+
+type input struct {
+	Op     string // consts.TccOperation* or opGet
+	Key    model.LockerKey
+	Branch string
+	Amount int64
+}
+
+type output struct {
+	TccCode   model.TccCode
+	Code      string
+	Err       string
+	Available int64 // opGet only
+	Frozen    int64 // opGet only
+}
+
+// state is the specification of one account behind the TCC barrier
+type state struct {
+	Available int64
+	Frozen    int64
+	Musts     map[string]bool
+	Tries     map[string]string // branch -> "" while frozen, then confirm or cancel
+	Emptied   map[string]bool   // an empty rollback left the try barrier behind
+}
+
+func (s *state) clone() *state {
+	c := &state{
+		Available: s.Available,
+		Frozen:    s.Frozen,
+		Musts:     make(map[string]bool, len(s.Musts)),
+		Tries:     make(map[string]string, len(s.Tries)),
+		Emptied:   make(map[string]bool, len(s.Emptied)),
+	}
+	for k, v := range s.Musts {
+		c.Musts[k] = v
+	}
+	for k, v := range s.Tries {
+		c.Tries[k] = v
+	}
+	for k, v := range s.Emptied {
+		c.Emptied[k] = v
+	}
+	return c
+}
+
+func success(out output) bool {
+	return out.Err == "" && out.TccCode == consts.TccCode_Success
+}
+
+func failed(out output, code string) bool {
+	return out.Err == "" && out.TccCode == consts.TccCode_Failed && out.Code == code
+}
+
+// step returns the state after in, or false if out is not what the specification allows.
+// barsTry tells whether an empty rollback leaves the try barrier behind, as the SQL barrier does: the hanging try
+// is then skipped as a duplicate and later cancels find no reservation. Otherwise the hanging try reserves.
+func step(barsTry bool, s *state, in input, out output) (bool, *state) {
+	switch in.Op {
+	case opGet:
+		return out.Err == "" && out.Available == s.Available && out.Frozen == s.Frozen, s
+
+	case consts.TccOperationMust:
+		if !success(out) {
+			return false, s
+		}
+		if s.Musts[in.Branch] {
+			return true, s
+		}
+		n := s.clone()
+		n.Musts[in.Branch] = true
+		n.Available += in.Amount
+		return true, n
+
+	case consts.TccOperationTry:
+		if _, tried := s.Tries[in.Branch]; tried || s.Emptied[in.Branch] {
+			return success(out), s
+		}
+		if s.Available < in.Amount {
+			return failed(out, balance.ErrInsufficientBalance), s
+		}
+		if !success(out) {
+			return false, s
+		}
+		n := s.clone()
+		n.Tries[in.Branch] = ""
+		n.Available -= in.Amount
+		n.Frozen += in.Amount
+		return true, n
+
+	case consts.TccOperationConfirm:
+		settled, tried := s.Tries[in.Branch]
+		if !tried {
+			return failed(out, consts.ErrReservationNotFound), s
+		}
+		if !success(out) {
+			return false, s
+		}
+		if settled != "" {
+			return settled == consts.TccOperationConfirm, s
+		}
+		n := s.clone()
+		n.Tries[in.Branch] = consts.TccOperationConfirm
+		n.Frozen -= in.Amount
+		return true, n
+
+	case consts.TccOperationCancel:
+		settled, tried := s.Tries[in.Branch]
+		if !tried {
+			if s.Emptied[in.Branch] {
+				return failed(out, consts.ErrReservationNotFound), s
+			}
+			if !success(out) {
+				return false, s
+			}
+			if !barsTry {
+				return true, s
+			}
+			n := s.clone()
+			n.Emptied[in.Branch] = true
+			return true, n
+		}
+		if !success(out) {
+			return false, s
+		}
+		if settled != "" {
+			return settled == consts.TccOperationCancel, s
+		}
+		n := s.clone()
+		n.Tries[in.Branch] = consts.TccOperationCancel
+		n.Frozen -= in.Amount
+		n.Available += in.Amount
+		return true, n
+	}
+	return false, s
+}
+
+// accountModel checks each account on its own: branches never span accounts
+func accountModel(barsTry bool) porcupine.Model {
+	return porcupine.Model{
+		Partition: func(history []porcupine.Operation) [][]porcupine.Operation {
+			byKey := make(map[model.LockerKey][]porcupine.Operation)
+			var keys []model.LockerKey
+			for _, op := range history {
+				key := op.Input.(input).Key
+				if _, ok := byKey[key]; !ok {
+					keys = append(keys, key)
+				}
+				byKey[key] = append(byKey[key], op)
+			}
+			partitions := make([][]porcupine.Operation, 0, len(keys))
+			for _, key := range keys {
+				partitions = append(partitions, byKey[key])
+			}
+			return partitions
+		},
+		Init: func() interface{} {
+			return &state{
+				Musts:   make(map[string]bool),
+				Tries:   make(map[string]string),
+				Emptied: make(map[string]bool),
+			}
+		},
+		Step: func(s, in, out interface{}) (bool, interface{}) {
+			return step(barsTry, s.(*state), in.(input), out.(output))
+		},
+		Equal: func(s1, s2 interface{}) bool {
+			return reflect.DeepEqual(s1, s2)
+		},
+		DescribeOperation: func(in, out interface{}) string {
+			i, o := in.(input), out.(output)
+			if i.Op == opGet {
+				return fmt.Sprintf("get %s -> %d/%d %s", i.Key, o.Available, o.Frozen, o.Err)
+			}
+			return fmt.Sprintf("%s %s %s %d -> %d %s %s", i.Op, i.Key, i.Branch, i.Amount, o.TccCode, o.Code, o.Err)
+		},
+		DescribeState: func(s interface{}) string {
+			st := s.(*state)
+			return fmt.Sprintf("available %d, frozen %d", st.Available, st.Frozen)
+		},
+	}
+}
@@ -0,0 +1,54 @@
+// Package leveldbkv implements model.KvStoreOperator on syndtr/goleveldb
+package leveldbkv
+
+import (
+	"errors"
+	"github.com/latifrons/walock/model"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type LevelDbKv struct {
+	Db           *leveldb.DB
+	WriteOptions *opt.WriteOptions // used for all writes. set Sync to fsync every WAL write
+}
+
+func (o *LevelDbKv) Get(key []byte) (value []byte, err error) {
+	value, err = o.Db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		err = model.ErrNotFound
+	}
+	return
+}
+
+func (o *LevelDbKv) Write(batch *model.KvBatch) error {
+	b := &leveldb.Batch{}
+	for _, op := range batch.Ops {
+		if op.Delete {
+			b.Delete(op.Key)
+		} else {
+			b.Put(op.Key, op.Value)
+		}
+	}
+	return o.Db.Write(b, o.WriteOptions)
+}
+
+func (o *LevelDbKv) Put(key, value []byte) error {
+	return o.Db.Put(key, value, o.WriteOptions)
+}
+
+func (o *LevelDbKv) Delete(key []byte) error {
+	return o.Db.Delete(key, o.WriteOptions)
+}
+
+func (o *LevelDbKv) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	iter := o.Db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
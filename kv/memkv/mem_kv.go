@@ -0,0 +1,82 @@
+// Package memkv implements model.KvStoreOperator in memory. Nothing survives the process.
+package memkv
+
+import (
+	"github.com/latifrons/walock/model"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemKv is ready to use as a zero value
+type MemKv struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func (o *MemKv) Get(key []byte) (value []byte, err error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	v, ok := o.data[string(key)]
+	if !ok {
+		err = model.ErrNotFound
+		return
+	}
+	value = append([]byte{}, v...)
+	return
+}
+
+func (o *MemKv) Write(batch *model.KvBatch) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, op := range batch.Ops {
+		o.apply(op)
+	}
+	return nil
+}
+
+func (o *MemKv) Put(key, value []byte) error {
+	return o.Write(&model.KvBatch{Ops: []model.KvOp{{Key: key, Value: value}}})
+}
+
+func (o *MemKv) Delete(key []byte) error {
+	return o.Write(&model.KvBatch{Ops: []model.KvOp{{Key: key, Delete: true}}})
+}
+
+// Scan iterates over a snapshot taken at the call, so fn may write to the store
+func (o *MemKv) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	o.mu.RLock()
+	keys := make([]string, 0)
+	for k := range o.data {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	values := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		values[k] = o.data[k]
+	}
+	o.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn([]byte(k), values[k]) {
+			break
+		}
+	}
+	return nil
+}
+
+// apply is called with mu held
+func (o *MemKv) apply(op model.KvOp) {
+	if o.data == nil {
+		o.data = make(map[string][]byte)
+	}
+	if op.Delete {
+		delete(o.data, string(op.Key))
+		return
+	}
+	o.data[string(op.Key)] = append([]byte{}, op.Value...)
+}
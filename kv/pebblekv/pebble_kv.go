@@ -0,0 +1,89 @@
+// Package pebblekv implements model.KvStoreOperator on cockroachdb/pebble
+package pebblekv
+
+import (
+	"errors"
+	"github.com/cockroachdb/pebble"
+	"github.com/latifrons/walock/model"
+)
+
+type PebbleKv struct {
+	Db           *pebble.DB
+	WriteOptions *pebble.WriteOptions // used for all writes. defaults to pebble.Sync
+}
+
+func (o *PebbleKv) InitDefault() {
+	if o.WriteOptions == nil {
+		o.WriteOptions = pebble.Sync
+	}
+}
+
+func (o *PebbleKv) Get(key []byte) (value []byte, err error) {
+	v, closer, err := o.Db.Get(key)
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			err = model.ErrNotFound
+		}
+		return
+	}
+	defer closer.Close()
+
+	// v is only valid until closer is closed
+	value = append([]byte{}, v...)
+	return
+}
+
+func (o *PebbleKv) Write(batch *model.KvBatch) (err error) {
+	b := o.Db.NewBatch()
+	defer b.Close()
+
+	for _, op := range batch.Ops {
+		if op.Delete {
+			err = b.Delete(op.Key, nil)
+		} else {
+			err = b.Set(op.Key, op.Value, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return b.Commit(o.WriteOptions)
+}
+
+func (o *PebbleKv) Put(key, value []byte) error {
+	return o.Db.Set(key, value, o.WriteOptions)
+}
+
+func (o *PebbleKv) Delete(key []byte) error {
+	return o.Db.Delete(key, o.WriteOptions)
+}
+
+func (o *PebbleKv) Scan(prefix []byte, fn func(key, value []byte) bool) (err error) {
+	iter, err := o.Db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// prefixUpperBound returns the smallest key greater than all keys with the prefix
+func prefixUpperBound(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil // no upper bound
+}
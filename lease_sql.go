@@ -0,0 +1,210 @@
+package walock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"sync"
+	"time"
+)
+
+// SqlLease is the ownership lease of a WalockStoreSqlDb, kept as a row of DbTableName.
+// Only the holder of the lease serves writes, and every takeover increments the epoch of the row.
+// Each write transaction of the store reads the row under a shared lock and fails unless it still holds the epoch
+// the values it writes were loaded under, so a replica that lost the lease cannot commit WALs on stale values.
+// Expiry is measured on the local clock of each replica: keep Ttl well above the clock skew.
+type SqlLease struct {
+	Name        string          // injected by outside. one lease per set of keys, usually the barrier name
+	DbTableName string          // optional. defaults to "walock_lease"
+	Holder      string          // optional. identifies this replica. defaults to the host name, pid and a random suffix
+	Ttl         time.Duration   // optional. defaults to 10 seconds
+	Logger      *zerolog.Logger // optional. defaults to the global zerolog logger
+
+	mu         sync.Mutex
+	epoch      uint64
+	validUntil time.Time
+}
+
+func (l *SqlLease) InitDefault() {
+	if l.DbTableName == "" {
+		l.DbTableName = "walock_lease"
+	}
+	if l.Holder == "" {
+		host, _ := os.Hostname()
+		b := make([]byte, 4)
+		_, _ = rand.Read(b)
+		l.Holder = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+	}
+	if l.Ttl == 0 {
+		l.Ttl = 10 * time.Second
+	}
+	if l.Logger == nil {
+		l.Logger = &log.Logger
+	}
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (l *SqlLease) logger() *zerolog.Logger {
+	if l.Logger == nil {
+		return &log.Logger
+	}
+	return l.Logger
+}
+
+// AutoMigrate creates or updates the lease table
+func (l *SqlLease) AutoMigrate(tx *gorm.DB) error {
+	return tx.Table(l.DbTableName).AutoMigrate(&model.LeaseRecord{})
+}
+
+// Epoch returns the epoch of the lease if this replica holds it, 0 otherwise
+func (l *SqlLease) Epoch() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Now().After(l.validUntil) {
+		return 0
+	}
+	return l.epoch
+}
+
+// Acquire takes the lease if it is free or expired, or renews it if this replica holds it.
+// It returns a *LeaseHeldError while another replica holds it.
+func (l *SqlLease) Acquire(db *gorm.DB) (epoch uint64, err error) {
+	startTime := time.Now()
+	held := l.Epoch()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var record model.LeaseRecord
+		err := tx.Table(l.DbTableName).Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", l.Name).Take(&record).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			record = model.LeaseRecord{Name: l.Name, Holder: l.Holder, Epoch: 1, ExpireTime: startTime.Add(l.Ttl)}
+			epoch = record.Epoch
+			return tx.Table(l.DbTableName).Create(&record).Error
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case held != 0 && record.Holder == l.Holder && record.Epoch == held:
+			epoch = held
+		case record.Holder == l.Holder || startTime.After(record.ExpireTime):
+			// a restarted holder takes over too: its former cache is gone
+			epoch = record.Epoch + 1
+		default:
+			return &LeaseHeldError{Name: l.Name, Holder: record.Holder, ExpireTime: record.ExpireTime}
+		}
+		return tx.Table(l.DbTableName).Where("name = ?", l.Name).Updates(map[string]interface{}{
+			"holder":      l.Holder,
+			"epoch":       epoch,
+			"expire_time": startTime.Add(l.Ttl),
+		}).Error
+	})
+	if err != nil {
+		epoch = 0
+		return
+	}
+	l.mu.Lock()
+	l.epoch = epoch
+	l.validUntil = startTime.Add(l.Ttl)
+	l.mu.Unlock()
+	if epoch != held {
+		l.logger().Info().Str("lease", l.Name).Str("holder", l.Holder).Uint64("epoch", epoch).Msg("lease acquired")
+	}
+	return
+}
+
+// Release gives the lease up so that another replica can take it over without waiting for the expiry
+func (l *SqlLease) Release(db *gorm.DB) error {
+	l.mu.Lock()
+	epoch := l.epoch
+	l.epoch = 0
+	l.validUntil = time.Time{}
+	l.mu.Unlock()
+	return db.Table(l.DbTableName).Where("name = ? AND holder = ? AND epoch = ?", l.Name, l.Holder, epoch).
+		Update("expire_time", time.Now()).Error
+}
+
+// Run acquires and renews the lease every third of Ttl until ctx is done, then releases it
+func (l *SqlLease) Run(ctx context.Context, db *gorm.DB) {
+	ticker := time.NewTicker(l.Ttl / 3)
+	defer ticker.Stop()
+	for {
+		_, err := l.Acquire(db)
+		if err != nil {
+			l.logger().Warn().Err(err).Str("lease", l.Name).Msg("failed to acquire lease")
+		}
+		select {
+		case <-ctx.Done():
+			err = l.Release(db)
+			if err != nil {
+				l.logger().Warn().Err(err).Str("lease", l.Name).Msg("failed to release lease")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Fence fails the transaction tx with a *LeaseLostError unless this replica still holds the lease at epoch.
+// The row stays share locked until tx ends, so a takeover waits for tx to commit.
+func (l *SqlLease) Fence(tx *gorm.DB, epoch uint64) error {
+	if epoch == 0 || epoch != l.Epoch() {
+		return &LeaseLostError{Name: l.Name, Epoch: epoch}
+	}
+	var record model.LeaseRecord
+	err := tx.Table(l.DbTableName).Clauses(clause.Locking{Strength: "SHARE"}).Where("name = ?", l.Name).Take(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &LeaseLostError{Name: l.Name, Epoch: epoch}
+	}
+	if err != nil {
+		return err
+	}
+	if record.Holder != l.Holder || record.Epoch != epoch {
+		return &LeaseLostError{Name: l.Name, Epoch: epoch}
+	}
+	return nil
+}
+
+// leaseEpoch returns the epoch of the lease held by the store, 0 without a lease
+func (f *WalockStoreSqlDb) leaseEpoch() uint64 {
+	if f.Lease == nil {
+		return 0
+	}
+	return f.Lease.Epoch()
+}
+
+// fence fails tx unless the store holds the lease at the epoch the value of the key was loaded under.
+// The caller holds the key lock.
+func (f *WalockStoreSqlDb) fence(tx *gorm.DB, key model.LockerKey) error {
+	if f.Lease == nil {
+		return nil
+	}
+	return f.Lease.Fence(tx, f.ensureUserMiniLock(key).Epoch)
+}
+
+// fenced runs fun in a transaction fenced for the key, or directly on tx without a lease
+func (f *WalockStoreSqlDb) fenced(tx *gorm.DB, key model.LockerKey, fun func(tx *gorm.DB) error) error {
+	if f.Lease == nil {
+		return fun(tx)
+	}
+	return tx.Transaction(func(tx *gorm.DB) error {
+		err := f.fence(tx, key)
+		if err != nil {
+			return err
+		}
+		return fun(tx)
+	})
+}
+
+// stampEpoch records in the WAL the epoch the value of the key was loaded under. The caller holds the key lock.
+func (f *WalockStoreSqlDb) stampEpoch(key model.LockerKey, wali interface{}) {
+	if w, ok := wali.(EpochWal); ok && f.Lease != nil {
+		w.SetEpoch(f.ensureUserMiniLock(key).Epoch)
+	}
+}
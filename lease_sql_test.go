@@ -0,0 +1,203 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// newLeasedReplica returns a SQL store on db serving under a lease of its own for holder
+func newLeasedReplica(t *testing.T, db *gorm.DB, holder string) (*walocktest.SqlFixture, *walock.SqlLease) {
+	t.Helper()
+	logger := zerolog.Nop()
+	lease := &walock.SqlLease{Name: "walocktest", Holder: holder, Ttl: time.Hour, Logger: &logger}
+	lease.InitDefault()
+	err := lease.AutoMigrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := walocktest.NewSqlFixture(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture.Store.Lease = lease
+	return fixture, lease
+}
+
+// expireLease makes the lease row expired, as the clock of another replica running ahead would see it
+func expireLease(t *testing.T, db *gorm.DB, lease *walock.SqlLease) {
+	t.Helper()
+	err := db.Table(lease.DbTableName).Where("name = ?", lease.Name).Update("expire_time", time.Now().Add(-time.Second)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countRows(t *testing.T, db *gorm.DB, table string) (count int64) {
+	t.Helper()
+	err := db.Table(table).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSqlLeaseTakeover(t *testing.T) {
+	db := openSqlite(t)
+	_, first := newLeasedReplica(t, db, "first")
+	_, second := newLeasedReplica(t, db, "second")
+	epoch, err := first.Acquire(db)
+	if err != nil || epoch != 1 {
+		t.Fatalf("Acquire = %d, %v", epoch, err)
+	}
+	if epoch, err = first.Acquire(db); err != nil || epoch != 1 {
+		t.Fatalf("renewal = %d, %v", epoch, err)
+	}
+	var held *walock.LeaseHeldError
+	if _, err = second.Acquire(db); !errors.As(err, &held) || held.Holder != "first" {
+		t.Fatalf("Acquire of a held lease = %v", err)
+	}
+
+	expireLease(t, db, first)
+	if epoch, err = second.Acquire(db); err != nil || epoch != 2 {
+		t.Fatalf("takeover after expiry = %d, %v", epoch, err)
+	}
+	if _, err = first.Acquire(db); !errors.As(err, &held) || held.Holder != "second" {
+		t.Fatalf("Acquire by the former holder = %v", err)
+	}
+}
+
+func TestSqlLeaseRelease(t *testing.T) {
+	db := openSqlite(t)
+	_, first := newLeasedReplica(t, db, "first")
+	_, second := newLeasedReplica(t, db, "second")
+	if _, err := first.Acquire(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Release(db); err != nil {
+		t.Fatal(err)
+	}
+	if epoch := first.Epoch(); epoch != 0 {
+		t.Fatalf("released lease at epoch %d", epoch)
+	}
+	// no wait for the Ttl of an hour
+	if epoch, err := second.Acquire(db); err != nil || epoch != 2 {
+		t.Fatalf("Acquire after a release = %d, %v", epoch, err)
+	}
+}
+
+func TestSqlLeaseStaleHolder(t *testing.T) {
+	ctx := context.Background()
+	db := openSqlite(t)
+	stale, staleLease := newLeasedReplica(t, db, "stale")
+	current, currentLease := newLeasedReplica(t, db, "current")
+	if _, err := staleLease.Acquire(db); err != nil {
+		t.Fatal(err)
+	}
+	tccCode, _, _, err := stale.Store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	mustTcc(t, "Must", tccCode, err)
+	reservation := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+	tccCode, _, _, err = stale.Store.Try(ctx, reservation, "alice", int64(30))
+	mustTcc(t, "Try", tccCode, err)
+
+	// the stale replica still believes it holds the lease when the current one takes it over and writes
+	expireLease(t, db, staleLease)
+	if _, err = currentLease.Acquire(db); err != nil {
+		t.Fatal(err)
+	}
+	tccCode, _, _, err = current.Store.Must(ctx, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "alice", int64(5))
+	mustTcc(t, "Must", tccCode, err)
+	if staleLease.Epoch() != 1 {
+		t.Fatal("stale replica lost its lease locally")
+	}
+	wals := countRows(t, db, stale.Provider.WalTableName)
+	barriers := countRows(t, db, "tcc_barrier")
+
+	// the fence stops the stale replica
+	var lost *walock.LeaseLostError
+	_, _, _, err = stale.Store.Try(ctx, &model.TccContext{GlobalId: "g3", BranchId: "b1"}, "alice", int64(10))
+	if !errors.As(err, &lost) {
+		t.Fatalf("Try of the stale replica = %v", err)
+	}
+	_, _, _, err = stale.Store.Confirm(ctx, reservation, "alice", nil)
+	if !errors.As(err, &lost) {
+		t.Fatalf("Confirm of the stale replica = %v", err)
+	}
+
+	// and past the fence, the provider refuses its WALs
+	calls := []struct {
+		name string
+		call func(tx *gorm.DB, value model.LockerValue) (model.TccCode, string, string, error)
+	}{
+		{"DoTry", func(tx *gorm.DB, value model.LockerValue) (model.TccCode, string, string, error) {
+			return stale.Store.DoTry(ctx, tx, &model.TccContext{GlobalId: "g3", BranchId: "b1"}, "alice", value, int64(10))
+		}},
+		{"DoConfirm", func(tx *gorm.DB, value model.LockerValue) (model.TccCode, string, string, error) {
+			return stale.Store.DoConfirm(ctx, tx, reservation, "alice", value, nil)
+		}},
+	}
+	for _, c := range calls {
+		value, err := stale.Store.LoadAndLock(ctx, db, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			_, _, _, err := c.call(tx, value)
+			return err
+		})
+		stale.Store.Unlock("alice")
+		var staleEpoch *walock.StaleEpochError
+		if !errors.As(err, &staleEpoch) || staleEpoch.Epoch != 1 || staleEpoch.Current != 2 {
+			t.Fatalf("%s of the stale replica = %v", c.name, err)
+		}
+	}
+
+	if n := countRows(t, db, stale.Provider.WalTableName); n != wals {
+		t.Fatalf("stale replica wrote %d wals", n-wals)
+	}
+	if n := countRows(t, db, "tcc_barrier"); n != barriers {
+		t.Fatalf("stale replica wrote %d barriers", n-barriers)
+	}
+	value, err := current.Store.Get(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := value.(*balance.Account); a.Available != 75 || a.Frozen != 30 || a.Seq != 3 {
+		t.Fatalf("alice has %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+	}
+}
+
+func TestSqlFlushWalRefusesStaleEpoch(t *testing.T) {
+	db := openSqlite(t)
+	fixture, err := walocktest.NewSqlFixture(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := fixture.Provider
+	err = provider.FlushWal(db, &balance.Wal{Key: "alice", Seq: 1, Op: balance.OpMust, GlobalId: "g0", BranchId: "b1", Amount: 100, Epoch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = provider.FlushWal(db, &balance.Wal{Key: "alice", Seq: 2, Op: balance.OpMust, GlobalId: "g1", BranchId: "b1", Amount: 5, Epoch: 1})
+	var staleEpoch *walock.StaleEpochError
+	if !errors.As(err, &staleEpoch) || staleEpoch.Key != "alice" || staleEpoch.Epoch != 1 || staleEpoch.Current != 2 {
+		t.Fatalf("FlushWal of an old epoch = %v", err)
+	}
+	if n := countRows(t, db, provider.WalTableName); n != 1 {
+		t.Fatalf("%d wals after the refused one", n)
+	}
+	// the same or a newer epoch is accepted
+	for _, epoch := range []uint64{2, 3} {
+		err = provider.FlushWal(db, &balance.Wal{Key: "alice", Seq: epoch, Op: balance.OpMust, GlobalId: "g1", BranchId: "b1", Amount: 5, Epoch: epoch})
+		if err != nil {
+			t.Fatalf("FlushWal at epoch %d = %v", epoch, err)
+		}
+	}
+}
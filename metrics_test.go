@@ -0,0 +1,87 @@
+package walock_test
+
+import (
+	"context"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+func TestTccOutcomeMetrics(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) (walock.TccStore, *model.Metrics)
+	}{
+		{"leveldb", func(t *testing.T) (walock.TccStore, *model.Metrics) {
+			kv := &memkv.MemKv{}
+			store := newEngineStore(kv, false)
+			return &walock.LevelDbTccStore{Store: store, Tx: kv}, store.Metrics
+		}},
+		{"sql", func(t *testing.T) (walock.TccStore, *model.Metrics) {
+			f, err := walocktest.NewSqlFixture(openSqlite(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f.Store, f.Store.Metrics
+		}},
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			store, metrics := s.open(t)
+			ctx := context.Background()
+			g1 := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+			calls := []struct {
+				name string
+				call func() (model.TccCode, string, string, error)
+			}{
+				{"must", func() (model.TccCode, string, string, error) {
+					return store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+				}},
+				{"try", func() (model.TccCode, string, string, error) { return store.Try(ctx, g1, "alice", int64(30)) }},
+				{"duplicate try", func() (model.TccCode, string, string, error) { return store.Try(ctx, g1, "alice", int64(30)) }},
+				{"cancel", func() (model.TccCode, string, string, error) { return store.Cancel(ctx, g1, "alice", nil) }},
+				{"duplicate cancel", func() (model.TccCode, string, string, error) { return store.Cancel(ctx, g1, "alice", nil) }},
+				{"hanging try", func() (model.TccCode, string, string, error) { return store.Try(ctx, g1, "alice", int64(30)) }},
+				{"empty rollback", func() (model.TccCode, string, string, error) {
+					return store.Cancel(ctx, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "alice", nil)
+				}},
+				{"insufficient try", func() (model.TccCode, string, string, error) {
+					return store.Try(ctx, &model.TccContext{GlobalId: "g3", BranchId: "b1"}, "alice", int64(1000))
+				}},
+			}
+			for _, c := range calls {
+				_, _, _, err := c.call()
+				if err != nil {
+					t.Fatalf("%s: %v", c.name, err)
+				}
+			}
+
+			want := []struct {
+				operation string
+				outcome   string
+				count     float64
+			}{
+				{consts.TccOperationMust, consts.TccOutcomeSuccess, 1},
+				{consts.TccOperationTry, consts.TccOutcomeSuccess, 1},
+				{consts.TccOperationTry, consts.TccOutcomeDuplicate, 1},
+				{consts.TccOperationTry, consts.TccOutcomeHangingRejected, 1},
+				{consts.TccOperationTry, consts.TccOutcomeBusinessFailed, 1},
+				{consts.TccOperationCancel, consts.TccOutcomeSuccess, 1},
+				{consts.TccOperationCancel, consts.TccOutcomeDuplicate, 1},
+				{consts.TccOperationCancel, consts.TccOutcomeEmptyRollback, 1},
+			}
+			for _, w := range want {
+				if got := testutil.ToFloat64(metrics.TccOutcome.WithLabelValues(w.operation, w.outcome)); got != w.count {
+					t.Errorf("%s %s = %v, want %v", w.operation, w.outcome, got, w.count)
+				}
+			}
+			if got := testutil.CollectAndCount(metrics.TccOutcome); got != len(want) {
+				t.Errorf("%d outcome series, want %d", got, len(want))
+			}
+		})
+	}
+}
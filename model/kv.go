@@ -0,0 +1,48 @@
+package model
+
+import "errors"
+
+// ErrNotFound is returned by KvStoreOperator.Get if the key does not exist
+var ErrNotFound = errors.New("walock: key not found")
+
+type KvOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// KvBatch is a list of writes applied atomically by KvStoreOperator.Write
+type KvBatch struct {
+	Ops []KvOp
+}
+
+func (b *KvBatch) Put(key, value []byte) {
+	b.Ops = append(b.Ops, KvOp{Key: key, Value: value})
+}
+
+func (b *KvBatch) Delete(key []byte) {
+	b.Ops = append(b.Ops, KvOp{Key: key, Delete: true})
+}
+
+func (b *KvBatch) Len() int {
+	return len(b.Ops)
+}
+
+// KvStoreOperator is the storage engine behind WalockStoreLevelDb and tcc.TccBarrierLevelDb.
+// Durability (e.g. fsync on write) is a property of the implementation.
+type KvStoreOperator interface {
+	// Get returns ErrNotFound if the key does not exist
+	Get(key []byte) (value []byte, err error)
+	// Write applies all ops of the batch atomically
+	Write(batch *KvBatch) error
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Scan calls fn for each key with the prefix in ascending order until fn returns false.
+	// key and value are only valid during the call.
+	Scan(prefix []byte, fn func(key, value []byte) bool) error
+}
+
+// LevelDbStoreOperator is the former name of KvStoreOperator.
+//
+// Deprecated: use KvStoreOperator.
+type LevelDbStoreOperator = KvStoreOperator
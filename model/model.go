@@ -3,9 +3,8 @@ package model
 import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,11 +13,80 @@ type Metrics struct {
 	MetricsLockWaitTime prometheus.Histogram
 	MetricsMapCount     prometheus.Gauge
 	LockHoldTime        *prometheus.HistogramVec
+	TccOutcome          *prometheus.CounterVec // labels: operation, outcome
+	WalWriteTime        prometheus.Histogram
+	FlushTime           prometheus.Histogram
+}
+
+// NewMetrics creates all metrics of a store prefixed by name.
+// They are registered to registerer unless it is nil.
+func NewMetrics(name string, registerer prometheus.Registerer) (m *Metrics, err error) {
+	m = &Metrics{
+		MetricsName: name,
+		MetricsLockWaitTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: name + "_lock_wait_seconds",
+			Help: "Time spent waiting for the key lock",
+		}),
+		MetricsMapCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: name + "_locker_count",
+			Help: "Number of keys cached in memory",
+		}),
+		LockHoldTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: name + "_lock_hold_seconds",
+			Help: "Time the key lock is held by an operation",
+		}, []string{"operation"}),
+		TccOutcome: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: name + "_tcc_total",
+			Help: "TCC calls by operation and outcome",
+		}, []string{"operation", "outcome"}),
+		WalWriteTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: name + "_wal_write_seconds",
+			Help: "Time spent writing WALs and barriers",
+		}),
+		FlushTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: name + "_flush_seconds",
+			Help: "Time spent persisting one dirty value",
+		}),
+	}
+	if registerer == nil {
+		return
+	}
+
+	for _, c := range []prometheus.Collector{m.MetricsLockWaitTime, m.MetricsMapCount, m.LockHoldTime, m.TccOutcome, m.WalWriteTime, m.FlushTime} {
+		err = registerer.Register(c)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *Metrics) ObserveTccOutcome(operation string, outcome string) {
+	if m.TccOutcome != nil {
+		m.TccOutcome.WithLabelValues(operation, outcome).Inc()
+	}
+}
+
+func (m *Metrics) ObserveWalWrite(startTime time.Time) {
+	if m.WalWriteTime != nil {
+		m.WalWriteTime.Observe(time.Since(startTime).Seconds())
+	}
+}
+
+func (m *Metrics) ObserveFlush(startTime time.Time) {
+	if m.FlushTime != nil {
+		m.FlushTime.Observe(time.Since(startTime).Seconds())
+	}
 }
 
 type Locker struct {
-	Value LockerValue
-	Mu    sync.Mutex
+	Value  LockerValue
+	Mu     sync.Mutex
+	UsedAt atomic.Int64 // unix nano of the last LoadAndLock
+	Epoch  uint64       // lease epoch Value was loaded under. guarded by Mu
+
+	// Evicted is set under Mu once the locker has left the cache. Whoever locks it next must retry with a new one.
+	Evicted bool
 }
 
 type LockerValue interface {
@@ -46,22 +114,34 @@ type TccBarrierReceiver struct {
 	Time time.Time `gorm:"index"`
 }
 
+// LeaseRecord is the row of a walock.SqlLease
+type LeaseRecord struct {
+	Name       string `gorm:"size:100;primarykey"`
+	Holder     string `gorm:"size:200"`
+	Epoch      uint64
+	ExpireTime time.Time
+}
+
 type WalBytes []byte
 
 type Wal struct {
 	Key      string
+	Seq      uint64 // assigned by the store with Key. the version of the value once applied
 	WalBytes WalBytes
+	Value    interface{} // typed WAL. encoded into WalBytes by the store if WalBytes is nil
 }
 
 func (w *Wal) String() string {
-	return fmt.Sprintf("WAL K: %s, V: %s", w.Key, string(w.WalBytes))
+	return fmt.Sprintf("WAL K: %s, S: %d, V: %s", w.Key, w.Seq, string(w.WalBytes))
 }
 
-type LevelDbStoreOperator interface {
-	Get(key []byte, ro *opt.ReadOptions) (value []byte, err error)
-	Write(batch *leveldb.Batch, wo *opt.WriteOptions) error
-	Put(key, value []byte, wo *opt.WriteOptions) error
-	Delete(key []byte, wo *opt.WriteOptions) error
-	MarkDirty(key []byte, isDirty bool, wo *opt.WriteOptions) (err error)
-	ListDirty() (keys [][]byte, err error)
+// WalEnvelope wraps the WalBytes of a business provider with what WalockStoreLevelDb knows about the WAL
+type WalEnvelope struct {
+	Version    uint8
+	Codec      uint8 // walcodec id of the payload. 0 if raw or in version 1
+	Encrypted  bool  // Payload is encrypted by the store
+	Time       time.Time
+	TccContext TccContext
+	BranchType string // consts.TccBranchType*
+	Payload    WalBytes
 }
@@ -0,0 +1,151 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"gorm.io/gorm"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type panicValue struct {
+	Reason string
+}
+
+// panicValues are the non-error values a business provider may panic with
+var panicValues = []struct {
+	name  string
+	value interface{}
+}{
+	{"string", "load failed"},
+	{"struct", panicValue{Reason: "load failed"}},
+}
+
+// panicLoad panics with value in the next load, once
+type panicLoad struct {
+	value interface{}
+	armed atomic.Bool
+	loads atomic.Int32
+}
+
+func (p *panicLoad) load() {
+	p.loads.Add(1)
+	if p.armed.CompareAndSwap(true, false) {
+		panic(p.value)
+	}
+}
+
+type panicLevelDbProvider struct {
+	*balance.LevelDbProvider
+	*panicLoad
+}
+
+func (p *panicLevelDbProvider) LoadPersistedValue(key model.LockerKey) (model.LockerValue, error) {
+	p.load()
+	return p.LevelDbProvider.LoadPersistedValue(key)
+}
+
+type panicSqlProvider struct {
+	*balance.SqlProvider
+	*panicLoad
+}
+
+func (p *panicSqlProvider) LoadPersistedValue(tx *gorm.DB, key model.LockerKey) (model.LockerValue, error) {
+	p.load()
+	return p.SqlProvider.LoadPersistedValue(tx, key)
+}
+
+// checkPanicError fails unless err is a PanicError carrying value and nothing to unwrap
+func checkPanicError(t *testing.T, err error, value interface{}) {
+	t.Helper()
+	var panicErr *walock.PanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != value || errors.Unwrap(err) != nil ||
+		!strings.Contains(err.Error(), "load failed") {
+		t.Fatalf("load panicking with %#v = %v", value, err)
+	}
+}
+
+// within fails if get does not return in time, as when the key lock is still held
+func within(t *testing.T, get func() (model.LockerValue, error)) (value model.LockerValue, err error) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		value, err = get()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("key still locked after the panic")
+	}
+	return
+}
+
+func TestPanicValueLevelDb(t *testing.T) {
+	ctx := context.Background()
+	for _, pv := range panicValues {
+		t.Run(pv.name, func(t *testing.T) {
+			kv := &memkv.MemKv{}
+			store := newEngineStore(kv, false)
+			tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+			tccCode, _, _, err := tccStore.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+			mustTcc(t, "Must", tccCode, err)
+
+			// a restarted store panics on the first load
+			restarted := newEngineStore(kv, false)
+			provider := &panicLevelDbProvider{restarted.BusinessProvider.(*balance.LevelDbProvider), &panicLoad{value: pv.value}}
+			provider.armed.Store(true)
+			restarted.BusinessProvider = provider
+			_, err = within(t, func() (model.LockerValue, error) { return restarted.Get(ctx, kv, "alice") })
+			checkPanicError(t, err, pv.value)
+
+			value, err := within(t, func() (model.LockerValue, error) { return restarted.Get(ctx, kv, "alice") })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a := value.(*balance.Account); a.Available != 100 || a.Seq != 1 || provider.loads.Load() != 2 {
+				t.Fatalf("alice has %d available at seq %d after %d loads", a.Available, a.Seq, provider.loads.Load())
+			}
+		})
+	}
+}
+
+func TestPanicValueSql(t *testing.T) {
+	ctx := context.Background()
+	for _, pv := range panicValues {
+		t.Run(pv.name, func(t *testing.T) {
+			db := openSqlite(t)
+			fixture, err := walocktest.NewSqlFixture(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tccCode, _, _, err := fixture.Store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+			mustTcc(t, "Must", tccCode, err)
+
+			restarted, err := walocktest.NewSqlFixture(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider := &panicSqlProvider{restarted.Provider, &panicLoad{value: pv.value}}
+			provider.armed.Store(true)
+			restarted.Store.BusinessProvider = provider
+			_, err = within(t, func() (model.LockerValue, error) { return restarted.Store.Get(ctx, "alice") })
+			checkPanicError(t, err, pv.value)
+
+			value, err := within(t, func() (model.LockerValue, error) { return restarted.Store.Get(ctx, "alice") })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a := value.(*balance.Account); a.Available != 100 || a.Seq != 1 || provider.loads.Load() != 2 {
+				t.Fatalf("alice has %d available at seq %d after %d loads", a.Available, a.Seq, provider.loads.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package walock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// preloadBatchSize is the number of keys Preload bulk loads at once when the business provider loads in batches
+const preloadBatchSize = 100
+
+// preload calls load on batches of the keys, at most concurrency at a time. A batch failing to load is logged and skipped.
+// It stops early when ctx is done.
+func preload(ctx context.Context, logger *zerolog.Logger, keys []model.LockerKey, batchSize int, concurrency int, load func(keys []model.LockerKey) (loaded int, err error)) (loaded int, err error) {
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	startTime := time.Now()
+	var count atomic.Int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for start := 0; start < len(keys); start += batchSize {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(batch []model.LockerKey) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			n, loadErr := load(batch)
+			count.Add(int64(n))
+			if loadErr != nil {
+				logger.Warn().Err(loadErr).Int("keys", len(batch)).Str("first", string(batch[0])).Msg("failed to preload")
+			}
+		}(keys[start:min(start+batchSize, len(keys))])
+	}
+	wg.Wait()
+	loaded = int(count.Load())
+	err = ctx.Err()
+	logger.Info().Int("keys", len(keys)).Int("loaded", loaded).Dur("took", time.Since(startTime)).Msg("preloaded")
+	return
+}
+
+// recentKeys returns up to limit cached keys, the most recently used first
+func recentKeys(accounts *sync.Map, limit int) []model.LockerKey {
+	type used struct {
+		key model.LockerKey
+		at  int64
+	}
+	var all []used
+	accounts.Range(func(key, value any) bool {
+		all = append(all, used{key: model.LockerKey(key.(string)), at: value.(*model.Locker).UsedAt.Load()})
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].at > all[j].at })
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	keys := make([]model.LockerKey, len(all))
+	for i, u := range all {
+		keys[i] = u.key
+	}
+	return keys
+}
+
+// Preload loads the values of the keys into the cache, at most concurrency at a time, so that their first calls
+// do not pay for the load. concurrency defaults to GOMAXPROCS. Keys failing to load are logged and skipped.
+// With a BatchLoaderLevelDb provider, the keys are bulk loaded by preloadBatchSize.
+// Run it in a goroutine to warm up in the background.
+func (f *WalockStoreLevelDb) Preload(ctx context.Context, tx model.KvStoreOperator, keys []model.LockerKey, concurrency int) (loaded int, err error) {
+	if _, ok := f.BusinessProvider.(BatchLoaderLevelDb); ok {
+		return preload(ctx, f.logger(), keys, preloadBatchSize, concurrency, func(keys []model.LockerKey) (int, error) {
+			return f.BulkLoad(ctx, tx, keys)
+		})
+	}
+	return preload(ctx, f.logger(), keys, 1, concurrency, func(keys []model.LockerKey) (int, error) {
+		_, err := f.LoadAndLock(ctx, tx, keys[0])
+		if err != nil {
+			return 0, err
+		}
+		f.Unlock(keys[0])
+		return 1, nil
+	})
+}
+
+// saveActiveKeys remembers the ActiveKeys most recently used keys
+func (f *WalockStoreLevelDb) saveActiveKeys(tx model.KvStoreOperator) (err error) {
+	b, err := json.Marshal(recentKeys(&f.accounts, f.ActiveKeys))
+	if err != nil {
+		return
+	}
+	return tx.Put([]byte(consts.ActiveKeysKey), b)
+}
+
+// PreloadActive preloads the keys recently used before the last FlushDirty, usually by the previous run of the node.
+// It needs ActiveKeys.
+func (f *WalockStoreLevelDb) PreloadActive(ctx context.Context, tx model.KvStoreOperator, concurrency int) (loaded int, err error) {
+	b, err := tx.Get([]byte(consts.ActiveKeysKey))
+	if errors.Is(err, model.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+	var keys []model.LockerKey
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return
+	}
+	return f.Preload(ctx, tx, keys, concurrency)
+}
+
+// Preload loads the values of the keys into the cache, at most concurrency at a time, so that their first calls
+// do not pay for the load. concurrency defaults to GOMAXPROCS. Keys failing to load are logged and skipped.
+// With a BatchLoaderSql provider, the keys are bulk loaded by preloadBatchSize.
+// Run it in a goroutine to warm up in the background.
+func (f *WalockStoreSqlDb) Preload(ctx context.Context, keys []model.LockerKey, concurrency int) (loaded int, err error) {
+	if _, ok := f.BusinessProvider.(BatchLoaderSql); ok {
+		return preload(ctx, f.logger(), keys, preloadBatchSize, concurrency, func(keys []model.LockerKey) (int, error) {
+			return f.BulkLoad(ctx, keys)
+		})
+	}
+	return preload(ctx, f.logger(), keys, 1, concurrency, func(keys []model.LockerKey) (int, error) {
+		_, err := f.LoadAndLock(ctx, f.DbRw, keys[0])
+		if err != nil {
+			return 0, err
+		}
+		f.Unlock(keys[0])
+		return 1, nil
+	})
+}
+
+// saveActiveKeys lets a BusinessProvider implementing ActiveKeysSql remember the ActiveKeys most recently used keys
+func (f *WalockStoreSqlDb) saveActiveKeys(tx *gorm.DB) error {
+	keeper, ok := f.BusinessProvider.(ActiveKeysSql)
+	if !ok {
+		return nil
+	}
+	return keeper.SaveActiveKeys(tx, recentKeys(&f.accounts, f.ActiveKeys))
+}
+
+// PreloadActive preloads the keys recently used before the last FlushDirty, usually by the previous run of the node.
+// It needs ActiveKeys and a BusinessProvider implementing ActiveKeysSql.
+func (f *WalockStoreSqlDb) PreloadActive(ctx context.Context, concurrency int) (loaded int, err error) {
+	keeper, ok := f.BusinessProvider.(ActiveKeysSql)
+	if !ok {
+		return
+	}
+	keys, err := keeper.LoadActiveKeys(f.DbRw)
+	if err != nil {
+		return
+	}
+	return f.Preload(ctx, keys, concurrency)
+}
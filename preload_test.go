@@ -0,0 +1,209 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"gorm.io/gorm"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loadCounter counts the keys loaded from the persisted values and runs hook in each load
+type loadCounter struct {
+	mu       sync.Mutex
+	loads    map[model.LockerKey]int
+	inFlight int
+	maxIn    int
+	hook     func(n int) // n is the number of loads so far
+}
+
+func (c *loadCounter) load(keys ...model.LockerKey) {
+	c.mu.Lock()
+	if c.loads == nil {
+		c.loads = map[model.LockerKey]int{}
+	}
+	for _, key := range keys {
+		c.loads[key]++
+	}
+	n := 0
+	for _, count := range c.loads {
+		n += count
+	}
+	c.inFlight++
+	c.maxIn = max(c.maxIn, c.inFlight)
+	hook := c.hook
+	c.mu.Unlock()
+
+	if hook != nil {
+		hook(n)
+	}
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+}
+
+func (c *loadCounter) count(key model.LockerKey) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loads[key]
+}
+
+type countingLevelDbProvider struct {
+	*balance.LevelDbProvider
+	*loadCounter
+}
+
+func (p *countingLevelDbProvider) LoadPersistedValue(key model.LockerKey) (model.LockerValue, error) {
+	p.load(key)
+	return p.LevelDbProvider.LoadPersistedValue(key)
+}
+
+type countingSqlProvider struct {
+	*balance.SqlProvider
+	*loadCounter
+}
+
+func (p *countingSqlProvider) LoadPersistedValue(tx *gorm.DB, key model.LockerKey) (model.LockerValue, error) {
+	p.load(key)
+	return p.SqlProvider.LoadPersistedValue(tx, key)
+}
+
+func (p *countingSqlProvider) LoadPersistedValues(tx *gorm.DB, keys []model.LockerKey) (map[model.LockerKey]model.LockerValue, error) {
+	p.load(keys...)
+	return p.SqlProvider.LoadPersistedValues(tx, keys)
+}
+
+// preloadKeys funds n accounts through the store
+func preloadKeys(t *testing.T, store walock.TccStore, n int) []model.LockerKey {
+	t.Helper()
+	keys := make([]model.LockerKey, n)
+	for i := range keys {
+		keys[i] = model.LockerKey(fmt.Sprintf("user%02d", i))
+		tccCode, _, _, err := store.Must(context.Background(), &model.TccContext{GlobalId: "g" + string(keys[i]), BranchId: "b1"}, keys[i], int64(100))
+		mustTcc(t, "Must", tccCode, err)
+	}
+	return keys
+}
+
+// countingLevelDbStore returns a store with a cold cache on kv
+func countingLevelDbStore(kv model.KvStoreOperator, counter *loadCounter) *walock.WalockStoreLevelDb {
+	store := newEngineStore(kv, false)
+	store.BusinessProvider = &countingLevelDbProvider{store.BusinessProvider.(*balance.LevelDbProvider), counter}
+	return store
+}
+
+func TestPreloadConcurrency(t *testing.T) {
+	ctx := context.Background()
+	kv := &memkv.MemKv{}
+	store := newEngineStore(kv, false)
+	keys := preloadKeys(t, &walock.LevelDbTccStore{Store: store, Tx: kv}, 32)
+
+	counter := &loadCounter{hook: func(int) { time.Sleep(5 * time.Millisecond) }}
+	restarted := countingLevelDbStore(kv, counter)
+	loaded, err := restarted.Preload(ctx, kv, keys, 4)
+	if err != nil || loaded != len(keys) {
+		t.Fatalf("Preload = %d, %v", loaded, err)
+	}
+	if counter.maxIn < 2 || counter.maxIn > 4 {
+		t.Fatalf("%d loads at once with a concurrency of 4", counter.maxIn)
+	}
+
+	// the values are cached
+	for _, key := range keys {
+		if a := account(t, restarted, kv, key); a.Available != 100 || counter.count(key) != 1 {
+			t.Fatalf("%s has %d available after %d loads", key, a.Available, counter.count(key))
+		}
+	}
+}
+
+func TestPreloadCancel(t *testing.T) {
+	kv := &memkv.MemKv{}
+	store := newEngineStore(kv, false)
+	keys := preloadKeys(t, &walock.LevelDbTccStore{Store: store, Tx: kv}, 10)
+
+	// the third load cancels the preload. the loads in flight complete, no other starts
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	counter := &loadCounter{hook: func(n int) {
+		if n == 3 {
+			cancel()
+		}
+	}}
+	restarted := countingLevelDbStore(kv, counter)
+	loaded, err := restarted.Preload(ctx, kv, keys, 1)
+	if !errors.Is(err, context.Canceled) || loaded != 3 {
+		t.Fatalf("cancelled Preload = %d, %v", loaded, err)
+	}
+	for i, key := range keys {
+		if want := min(1, max(0, 3-i)); counter.count(key) != want {
+			t.Fatalf("%s loaded %d times", key, counter.count(key))
+		}
+	}
+}
+
+func TestPreloadActiveLevelDb(t *testing.T) {
+	ctx := context.Background()
+	kv := &memkv.MemKv{}
+	store := newEngineStore(kv, false)
+	store.ActiveKeys = 2
+	keys := preloadKeys(t, &walock.LevelDbTccStore{Store: store, Tx: kv}, 3)
+	if err := store.FlushDirty(kv); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restarted store preloads the two keys used last
+	counter := &loadCounter{}
+	restarted := countingLevelDbStore(kv, counter)
+	loaded, err := restarted.PreloadActive(ctx, kv, 2)
+	if err != nil || loaded != 2 {
+		t.Fatalf("PreloadActive = %d, %v", loaded, err)
+	}
+	for i, key := range keys {
+		if want := min(1, i); counter.count(key) != want {
+			t.Fatalf("%s loaded %d times", key, counter.count(key))
+		}
+	}
+}
+
+func TestPreloadActiveSql(t *testing.T) {
+	ctx := context.Background()
+	db := openSqlite(t)
+	fixture, err := walocktest.NewSqlFixture(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture.Store.ActiveKeys = 2
+	keys := preloadKeys(t, fixture.Store, 3)
+	if err = fixture.Store.FlushDirty(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := walocktest.NewSqlFixture(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &loadCounter{}
+	restarted.Store.BusinessProvider = &countingSqlProvider{restarted.Provider, counter}
+	loaded, err := restarted.Store.PreloadActive(ctx, 2)
+	if err != nil || loaded != 2 {
+		t.Fatalf("PreloadActive = %d, %v", loaded, err)
+	}
+	for i, key := range keys {
+		if want := min(1, i); counter.count(key) != want {
+			t.Fatalf("%s loaded %d times", key, counter.count(key))
+		}
+	}
+	for _, key := range keys {
+		value, err := restarted.Store.Get(ctx, key)
+		if err != nil || value.(*balance.Account).Available != 100 || counter.count(key) != 1 {
+			t.Fatalf("%s = %v, %v after %d loads", key, value, err, counter.count(key))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock/model"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Ring maps lock keys to shards by consistent hashing: each shard owns VirtualNodes points of a 64 bit ring
+// and a key belongs to the shard of the first point at or after its hash. Adding or removing a shard only moves
+// the keys of its points. Every instance must build the ring from the same shards.
+type Ring struct {
+	Shards       []string // injected by outside. the order does not matter
+	VirtualNodes int      // optional. points of each shard. defaults to 128
+
+	points []uint64
+	owners []string
+}
+
+func (r *Ring) InitDefault() {
+	if r.VirtualNodes == 0 {
+		r.VirtualNodes = 128
+	}
+	r.points = make([]uint64, 0, len(r.Shards)*r.VirtualNodes)
+	owner := make(map[uint64]string, len(r.Shards)*r.VirtualNodes)
+	for _, shard := range r.Shards {
+		for i := 0; i < r.VirtualNodes; i++ {
+			point := hash(shard + "#" + strconv.Itoa(i))
+			// on a collision the smaller shard name wins, whatever the order of Shards
+			existing, ok := owner[point]
+			if !ok {
+				r.points = append(r.points, point)
+			} else if existing < shard {
+				continue
+			}
+			owner[point] = shard
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	r.owners = make([]string, len(r.points))
+	for i, point := range r.points {
+		r.owners[i] = owner[point]
+	}
+}
+
+// Shard returns the shard of the key. It panics on an empty ring. See Lookup.
+func (r *Ring) Shard(key model.LockerKey) string {
+	shard, err := r.Lookup(key)
+	if err != nil {
+		panic(err)
+	}
+	return shard
+}
+
+// Lookup returns the shard of the key, or ErrEmptyRing if the ring has no shard or was not initialized
+func (r *Ring) Lookup(key model.LockerKey) (shard string, err error) {
+	if len(r.points) == 0 {
+		err = ErrEmptyRing
+		return
+	}
+	h := hash(string(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	shard = r.owners[i]
+	return
+}
+
+// Has tells whether the shard is on the ring
+func (r *Ring) Has(shard string) bool {
+	for _, s := range r.Shards {
+		if s == shard {
+			return true
+		}
+	}
+	return false
+}
+
+// hash is FNV-1a followed by the splitmix64 finalizer, which spreads the close hashes of similar names
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ErrEmptyRing is returned for a key looked up on a ring without shards
+var ErrEmptyRing = errors.New("shard: empty ring")
+
+// NotOwnerError is returned for a key whose shard is not owned by this instance
+type NotOwnerError struct {
+	Key   model.LockerKey
+	Shard string
+}
+
+func (e *NotOwnerError) Error() string {
+	return fmt.Sprintf("shard %s of key %s is not owned here", e.Shard, e.Key)
+}
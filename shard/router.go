@@ -0,0 +1,196 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store is an in-process walock store owning the keys of one or more shards.
+// *walock.WalockStoreSqlDb and *walock.LevelDbTccStore implement it.
+type Store interface {
+	walock.TccStore
+	// Evict flushes the cached values of the keys matching match and drops them from the cache
+	Evict(match func(key model.LockerKey) bool) (evicted int, err error)
+}
+
+// owned is a shard owned by this instance. Calls hold gate for reading so that Release can wait for them.
+// A draining shard stays in Router.shards until its release succeeds, so that it cannot be acquired meanwhile.
+type owned struct {
+	store    Store
+	gate     sync.RWMutex
+	draining bool // guarded by Router.mu
+	released bool // guarded by gate
+}
+
+// Router routes the calls on a key to the store owning its shard, and fails them with a NotOwnerError
+// if this instance does not own the shard. Which instance owns which shard is decided outside, which then
+// hands shards over with Release on the old owner followed by Acquire on the new one.
+// Router implements walock.TccStore.
+type Router struct {
+	Ring   *Ring           // injected by outside. must be initialized
+	Logger *zerolog.Logger // optional. defaults to the global zerolog logger
+
+	mu     sync.RWMutex
+	shards map[string]*owned
+}
+
+func (r *Router) InitDefault() {
+	if r.Logger == nil {
+		r.Logger = &log.Logger
+	}
+	r.shards = make(map[string]*owned)
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (r *Router) logger() *zerolog.Logger {
+	if r.Logger == nil {
+		return &log.Logger
+	}
+	return r.Logger
+}
+
+// Acquire makes this instance serve the shard with the store.
+// The store must not hold values of the shard cached from an earlier ownership: they are evicted by Release.
+func (r *Router) Acquire(shard string, store Store) error {
+	if !r.Ring.Has(shard) {
+		return fmt.Errorf("unknown shard: %s", shard)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if o, ok := r.shards[shard]; ok {
+		if o.draining {
+			return fmt.Errorf("shard being released: %s", shard)
+		}
+		return fmt.Errorf("shard already owned: %s", shard)
+	}
+	if r.shards == nil {
+		r.shards = make(map[string]*owned)
+	}
+	r.shards[shard] = &owned{store: store}
+	r.logger().Info().Str("shard", shard).Msg("shard acquired")
+	return nil
+}
+
+// Release stops serving the shard once its running calls are done, then flushes and evicts its keys
+// so that the next owner loads them from the persisted values. Calls arriving meanwhile wait for the outcome.
+// If the eviction fails, the shard stays owned and serves them, and must not be handed over. A LevelDb store
+// fails it with a walock.OpenReservationsError until the reservations of the shard are confirmed or cancelled.
+func (r *Router) Release(shard string) (evicted int, err error) {
+	startTime := time.Now()
+	_, err = r.Ring.Lookup("")
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	o, ok := r.shards[shard]
+	draining := ok && o.draining
+	if ok {
+		o.draining = true
+	}
+	r.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("shard not owned: %s", shard)
+	}
+	if draining {
+		return 0, fmt.Errorf("shard being released: %s", shard)
+	}
+
+	o.gate.Lock()
+	defer o.gate.Unlock()
+	evicted, err = o.store.Evict(func(key model.LockerKey) bool {
+		return r.Ring.Shard(key) == shard
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		o.draining = false
+		r.logger().Error().Err(err).Str("shard", shard).Int("evicted", evicted).Msg("failed to evict shard. kept")
+		return
+	}
+	o.released = true
+	delete(r.shards, shard)
+	r.logger().Info().Str("shard", shard).Int("evicted", evicted).Dur("took", time.Since(startTime)).Msg("shard released")
+	return
+}
+
+// Owned returns the shards served by this instance in name order
+func (r *Router) Owned() (shards []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for shard := range r.shards {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	return
+}
+
+// Owns tells whether the shard of the key is served by this instance
+func (r *Router) Owns(key model.LockerKey) bool {
+	shard, err := r.Ring.Lookup(key)
+	if err != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.shards[shard]
+	return ok
+}
+
+// route calls fun with the store of the key while holding its shard
+func (r *Router) route(key model.LockerKey, fun func(store Store) error) error {
+	shard, err := r.Ring.Lookup(key)
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	o, ok := r.shards[shard]
+	r.mu.RUnlock()
+	if !ok {
+		return &NotOwnerError{Key: key, Shard: shard}
+	}
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	if o.released {
+		return &NotOwnerError{Key: key, Shard: shard}
+	}
+	return fun(o.store)
+}
+
+func (r *Router) Try(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	err = r.route(lockKey, func(store Store) (err error) {
+		tccCode, code, message, err = store.Try(ctx, tccContext, lockKey, tryBody)
+		return
+	})
+	return
+}
+
+func (r *Router) Confirm(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	err = r.route(lockKey, func(store Store) (err error) {
+		tccCode, code, message, err = store.Confirm(ctx, tccContext, lockKey, confirmBody)
+		return
+	})
+	return
+}
+
+func (r *Router) Cancel(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	err = r.route(lockKey, func(store Store) (err error) {
+		tccCode, code, message, err = store.Cancel(ctx, tccContext, lockKey, cancelBody)
+		return
+	})
+	return
+}
+
+func (r *Router) Must(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	err = r.route(lockKey, func(store Store) (err error) {
+		tccCode, code, message, err = store.Must(ctx, tccContext, lockKey, mustBody)
+		return
+	})
+	return
+}
@@ -0,0 +1,324 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts the calls it serves. Evict blocks until proceed is closed and fails with evictErr.
+type countingStore struct {
+	mu       sync.Mutex
+	served   int
+	evicted  bool
+	late     int // calls served after a successful eviction
+	evictErr error
+	evicting chan struct{}
+	proceed  chan struct{}
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{evicting: make(chan struct{}, 1), proceed: make(chan struct{})}
+}
+
+func (s *countingStore) serve() (model.TccCode, string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.served++
+	if s.evicted {
+		s.late++
+	}
+	return consts.TccCode_Success, "", "", nil
+}
+
+func (s *countingStore) Served() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.served
+}
+
+func (s *countingStore) Try(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (model.TccCode, string, string, error) {
+	return s.serve()
+}
+
+func (s *countingStore) Confirm(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (model.TccCode, string, string, error) {
+	return s.serve()
+}
+
+func (s *countingStore) Cancel(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (model.TccCode, string, string, error) {
+	return s.serve()
+}
+
+func (s *countingStore) Must(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (model.TccCode, string, string, error) {
+	return s.serve()
+}
+
+func (s *countingStore) Evict(match func(key model.LockerKey) bool) (int, error) {
+	s.evicting <- struct{}{}
+	<-s.proceed
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.evictErr != nil {
+		return 0, s.evictErr
+	}
+	s.evicted = true
+	return 1, nil
+}
+
+func waitServed(t *testing.T, store *countingStore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for store.Served() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("served %d calls, want %d", store.Served(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// keyOf returns a key of the shard
+func keyOf(ring *Ring, shard string) (key model.LockerKey) {
+	for i := 0; ring.Shard(key) != shard; i++ {
+		key = model.LockerKey(fmt.Sprintf("key-%d", i))
+	}
+	return
+}
+
+func newRouter(ring *Ring) *Router {
+	logger := zerolog.Nop()
+	router := &Router{Ring: ring, Logger: &logger}
+	router.InitDefault()
+	return router
+}
+
+func TestRouterHandover(t *testing.T) {
+	ring := &Ring{Shards: []string{"s1", "s2"}}
+	ring.InitDefault()
+	key := keyOf(ring, "s1")
+	oldOwner := newRouter(ring)
+	newOwner := newRouter(ring)
+	oldStore := newCountingStore()
+	newStore := newCountingStore()
+	if err := oldOwner.Acquire("s1", oldStore); err != nil {
+		t.Fatal(err)
+	}
+
+	// clients go to the new owner when the old one says it does not own the key anymore
+	var handingOver atomic.Bool
+	var succeeded, notOwnerBeforeHandover atomic.Int64
+	errs := make(chan error, 100)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var stopOnce sync.Once
+	stopClients := func() {
+		stopOnce.Do(func() { close(stop) })
+		wg.Wait()
+	}
+	t.Cleanup(stopClients)
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tccContext := &model.TccContext{GlobalId: fmt.Sprintf("g%d", i), BranchId: "b1"}
+				_, _, _, err := oldOwner.Must(context.Background(), tccContext, key, int64(1))
+				var notOwner *NotOwnerError
+				if errors.As(err, &notOwner) {
+					if !handingOver.Load() {
+						notOwnerBeforeHandover.Add(1)
+					}
+					_, _, _, err = newOwner.Must(context.Background(), tccContext, key, int64(1))
+					if errors.As(err, &notOwner) {
+						continue // not acquired yet
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				succeeded.Add(1)
+			}
+		}()
+	}
+	waitServed(t, oldStore, 100)
+
+	// a failed release keeps the shard, which cannot be acquired or released while draining
+	oldStore.evictErr = errors.New("flush failed")
+	released := make(chan error, 1)
+	go func() {
+		_, err := oldOwner.Release("s1")
+		released <- err
+	}()
+	<-oldStore.evicting
+	if err := oldOwner.Acquire("s1", newStore); err == nil {
+		t.Fatal("acquired a draining shard")
+	}
+	if _, err := oldOwner.Release("s1"); err == nil {
+		t.Fatal("released a draining shard twice")
+	}
+	oldStore.proceed <- struct{}{}
+	if err := <-released; err == nil {
+		t.Fatal("release succeeded with a failing eviction")
+	}
+	if owned := oldOwner.Owned(); len(owned) != 1 || owned[0] != "s1" {
+		t.Fatalf("owned %v after a failed release", owned)
+	}
+	waitServed(t, oldStore, oldStore.Served()+100)
+
+	// the handover
+	oldStore.evictErr = nil
+	handingOver.Store(true)
+	go func() {
+		_, err := oldOwner.Release("s1")
+		released <- err
+	}()
+	<-oldStore.evicting
+	close(oldStore.proceed)
+	if err := <-released; err != nil {
+		t.Fatal(err)
+	}
+	if err := newOwner.Acquire("s1", newStore); err != nil {
+		t.Fatal(err)
+	}
+	waitServed(t, newStore, 100)
+	stopClients()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := notOwnerBeforeHandover.Load(); n != 0 {
+		t.Errorf("%d calls refused before the handover", n)
+	}
+	if oldStore.late != 0 {
+		t.Errorf("old store served %d calls after its eviction", oldStore.late)
+	}
+	if total := int64(oldStore.Served() + newStore.Served()); total != succeeded.Load() {
+		t.Errorf("stores served %d calls, clients saw %d succeed", total, succeeded.Load())
+	}
+	if err := oldOwner.Acquire("s1", oldStore); err != nil {
+		t.Errorf("cannot acquire the shard back after the release: %v", err)
+	}
+}
+
+// newLevelDbNode returns a LevelDb store keeping its WALs and barriers in a KV store of its own
+// and flushing the accounts to db, shared by all nodes
+func newLevelDbNode(db model.KvStoreOperator) *walock.LevelDbTccStore {
+	logger := zerolog.Nop()
+	persister := &balance.KvPersister{Kv: db}
+	persister.InitDefault()
+	provider := &balance.LevelDbProvider{Persister: persister}
+	provider.InitDefault()
+	store := &walock.WalockStoreLevelDb{
+		BusinessProvider:  provider,
+		TccBarrierLevelDb: &tcc.TccBarrierLevelDb{},
+		BarrierName:       "shard",
+		Logger:            &logger,
+	}
+	store.InitDefault()
+	return &walock.LevelDbTccStore{Store: store, Tx: &memkv.MemKv{}}
+}
+
+func TestReleaseWithOpenReservation(t *testing.T) {
+	ctx := context.Background()
+	phases := []struct {
+		name      string
+		call      func(router *Router, tccContext *model.TccContext, key model.LockerKey) (model.TccCode, string, string, error)
+		available int64
+	}{
+		{"confirm", func(router *Router, tccContext *model.TccContext, key model.LockerKey) (model.TccCode, string, string, error) {
+			return router.Confirm(ctx, tccContext, key, nil)
+		}, 70},
+		{"cancel", func(router *Router, tccContext *model.TccContext, key model.LockerKey) (model.TccCode, string, string, error) {
+			return router.Cancel(ctx, tccContext, key, nil)
+		}, 100},
+	}
+	for _, phase := range phases {
+		t.Run(phase.name, func(t *testing.T) {
+			ring := &Ring{Shards: []string{"s1", "s2"}}
+			ring.InitDefault()
+			key := keyOf(ring, "s1")
+			db := &memkv.MemKv{}
+			oldOwner, newOwner := newRouter(ring), newRouter(ring)
+			oldStore, newStore := newLevelDbNode(db), newLevelDbNode(db)
+			if err := oldOwner.Acquire("s1", oldStore); err != nil {
+				t.Fatal(err)
+			}
+			_, _, _, err := oldOwner.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, key, int64(100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tccContext := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+			tccCode, _, _, err := oldOwner.Try(ctx, tccContext, key, int64(30))
+			if err != nil || tccCode != consts.TccCode_Success {
+				t.Fatalf("Try = %d, %v", tccCode, err)
+			}
+
+			// the reservation lives in the local KV store of the old owner, which keeps the shard
+			_, err = oldOwner.Release("s1")
+			var open *walock.OpenReservationsError
+			if !errors.As(err, &open) || !reflect.DeepEqual(open.Keys, []model.LockerKey{key}) {
+				t.Fatalf("Release with an open reservation = %v", err)
+			}
+			if !oldOwner.Owns(key) {
+				t.Fatal("shard dropped by a refused release")
+			}
+			tccCode, _, _, err = phase.call(oldOwner, tccContext, key)
+			if err != nil || tccCode != consts.TccCode_Success {
+				t.Fatalf("%s = %d, %v", phase.name, tccCode, err)
+			}
+
+			// settled, the shard moves with the flushed account
+			if _, err = oldOwner.Release("s1"); err != nil {
+				t.Fatal(err)
+			}
+			if err = newOwner.Acquire("s1", newStore); err != nil {
+				t.Fatal(err)
+			}
+			tccCode, _, _, err = newOwner.Must(ctx, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, key, int64(1))
+			if err != nil || tccCode != consts.TccCode_Success {
+				t.Fatalf("Must on the new owner = %d, %v", tccCode, err)
+			}
+			value, err := newStore.Store.Get(ctx, newStore.Tx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a := value.(*balance.Account); a.Available != phase.available+1 || a.Frozen != 0 {
+				t.Fatalf("%s has %d available, %d frozen on the new owner", key, a.Available, a.Frozen)
+			}
+		})
+	}
+}
+
+func TestRouterOnEmptyRing(t *testing.T) {
+	ring := &Ring{}
+	ring.InitDefault()
+	router := newRouter(ring)
+	_, _, _, err := router.Must(context.Background(), &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(1))
+	if !errors.Is(err, ErrEmptyRing) {
+		t.Fatalf("Must on an empty ring = %v", err)
+	}
+	if router.Owns("alice") {
+		t.Fatal("owns a key of an empty ring")
+	}
+	if _, err = router.Release("s1"); !errors.Is(err, ErrEmptyRing) {
+		t.Fatalf("Release on an empty ring = %v", err)
+	}
+}
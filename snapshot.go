@@ -0,0 +1,122 @@
+package walock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walcodec"
+	"hash/crc32"
+)
+
+// A snapshot of a value is kept under consts.SnapshotKeyPrefix + lock key, framed as
+//
+//	magic "WS" | 1 | CRC32C uint32 | codec uint8 | flags uint8 | payload
+//
+// The flags are the ones of the WAL envelope. A snapshot is written once the business provider has persisted the value,
+// so it is never ahead of it, and WALs are only compacted up to the persisted version: the snapshot plus its tail WALs
+// rebuild the value, unless the snapshot could not be written, in which case the WAL chain breaks and the store falls back
+// to the business provider.
+
+const snapshotVersion uint8 = 1
+
+var snapshotMagic = [2]byte{'W', 'S'}
+
+func snapshotKey(key model.LockerKey) string {
+	return consts.SnapshotKeyPrefix + string(key)
+}
+
+// saveSnapshot writes the snapshot of value if the store keeps snapshots
+func (f *WalockStoreLevelDb) saveSnapshot(tx model.KvStoreOperator, key model.LockerKey, value model.LockerValue) (err error) {
+	if !f.Snapshots {
+		return
+	}
+	payload, err := f.walCodec().Marshal(value)
+	if err != nil {
+		return
+	}
+	var flags uint8
+	if f.KeyProvider != nil {
+		flags |= walEnvelopeEncrypted
+		payload, err = f.encrypt(snapshotKey(key), payload)
+		if err != nil {
+			return
+		}
+	}
+	b := make([]byte, walEnvelopeHeaderSize, walEnvelopeHeaderSize+2+len(payload))
+	b[0], b[1] = snapshotMagic[0], snapshotMagic[1]
+	b[2] = snapshotVersion
+	b = append(b, f.walCodec().Id(), flags)
+	b = append(b, payload...)
+	binary.BigEndian.PutUint32(b[3:walEnvelopeHeaderSize], crc32.Checksum(b[walEnvelopeHeaderSize:], castagnoli))
+	return tx.Put([]byte(snapshotKey(key)), b)
+}
+
+// loadSnapshot returns found false if the store keeps no snapshot of the key
+func (f *WalockStoreLevelDb) loadSnapshot(tx model.KvStoreOperator, key model.LockerKey) (value model.LockerValue, found bool, err error) {
+	factory, ok := f.BusinessProvider.(ValueFactory)
+	if !f.Snapshots || !ok {
+		return
+	}
+	b, err := tx.Get([]byte(snapshotKey(key)))
+	if errors.Is(err, model.ErrNotFound) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	corrupted := func(format string, a ...interface{}) error {
+		return &WalCorruptionError{Key: snapshotKey(key), Reason: fmt.Sprintf(format, a...)}
+	}
+	if len(b) < walEnvelopeHeaderSize+2 || b[0] != snapshotMagic[0] || b[1] != snapshotMagic[1] {
+		err = corrupted("not a snapshot")
+		return
+	}
+	if b[2] != snapshotVersion {
+		err = corrupted("unknown snapshot version %d", b[2])
+		return
+	}
+	if crc32.Checksum(b[walEnvelopeHeaderSize:], castagnoli) != binary.BigEndian.Uint32(b[3:walEnvelopeHeaderSize]) {
+		err = corrupted("checksum mismatch")
+		return
+	}
+	codec, err := walcodec.ById(b[walEnvelopeHeaderSize])
+	if err != nil {
+		err = corrupted("%v", err)
+		return
+	}
+	payload := b[walEnvelopeHeaderSize+2:]
+	if b[walEnvelopeHeaderSize+1]&walEnvelopeEncrypted != 0 {
+		payload, err = f.decrypt(snapshotKey(key), payload)
+		if err != nil {
+			return
+		}
+	}
+	value = factory.NewValue(key)
+	err = codec.Unmarshal(payload, value)
+	if err != nil {
+		err = corrupted("%s codec: %v", codec.Name(), err)
+		return
+	}
+	// the business provider persisted at least this version
+	value.SetDbVersion(value.GetVersion())
+	found = true
+	return
+}
+
+// loadFromSnapshot loads the snapshot of the key and replays its tail WALs.
+// found is false if there is no usable snapshot and the value must be loaded from the business provider.
+func (f *WalockStoreLevelDb) loadFromSnapshot(tx model.KvStoreOperator, key model.LockerKey) (value model.LockerValue, found bool) {
+	value, found, err := f.loadSnapshot(tx, key)
+	if err == nil && found {
+		_, err = f.catchupWals(tx, key, value)
+	}
+	if err != nil {
+		f.logger().Warn().Err(err).Str("key", string(key)).Msg("snapshot unusable. loading from the business provider")
+		return nil, false
+	}
+	return
+}
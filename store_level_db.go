@@ -1,16 +1,19 @@
 package walock
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/latifrons/walock/consts"
 	"github.com/latifrons/walock/model"
 	"github.com/latifrons/walock/tcc"
+	"github.com/latifrons/walock/walcodec"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"runtime/debug"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sync"
+	"sync/atomic"
 )
 
 import (
@@ -38,40 +41,104 @@ import (
 // 当需要WAL重放时，将会从本周期和上一个周期的数据库中分别进行重放。
 
 type WalockStoreLevelDb struct {
-	Metrics           *model.Metrics          // injected by outside to provide metrics inside
-	BusinessProvider  BusinessProviderLevelDb // injected by outside to provide business logic
-	TccBarrierLevelDb *tcc.TccBarrierLevelDb  // injected by outside to provide tcc barrier
-	BarrierName       string
-	WriteOption       *opt.WriteOptions
-
-	accounts sync.Map // string:*model.Locker
+	Metrics            *model.Metrics          // injected by outside to provide metrics inside
+	BusinessProvider   BusinessProviderLevelDb // injected by outside to provide business logic
+	TccBarrierLevelDb  *tcc.TccBarrierLevelDb  // injected by outside to provide tcc barrier
+	BarrierName        string
+	Logger             *zerolog.Logger   // optional. defaults to the global zerolog logger
+	Tracer             trace.Tracer      // optional. defaults to the global OpenTelemetry tracer
+	AcceptLegacyWals   bool              // optional. reads WALs written before the envelope as is
+	WalCodec           walcodec.WalCodec // optional. encodes typed WALs and snapshots. defaults to JSON, which version 1 envelopes always use
+	WalEnvelopeVersion uint8             // optional. defaults to the latest. set to WalEnvelopeVersion1 while older releases still read the WALs
+	KeyProvider        KeyProvider       // optional. encrypts WAL payloads with AES-GCM when set. needs WalEnvelopeVersion3
+	EncryptBarriers    bool              // optional. with KeyProvider, also encrypts the try barriers, which hold WAL keys
+	Snapshots          bool              // optional. keeps a local snapshot of each flushed value, loaded before the business provider. needs a ValueFactory provider
+	ActiveKeys         int               // optional. remembers up to this many recently used keys at each FlushDirty for PreloadActive. 0 disables
+
+	accounts          sync.Map    // string:*model.Locker
+	legacyWalsDone    atomic.Bool // the legacy WALs of a LegacyWalMigrator provider are migrated
+	encryptedBarriers atomic.Bool // the KV store holds the consts.EncryptedBarriersKey marker
 }
 
 func (f *WalockStoreLevelDb) InitDefault() {
+	if f.Metrics == nil {
+		f.Metrics, _ = model.NewMetrics("walock", nil)
+	}
+	if f.Tracer == nil {
+		f.Tracer = defaultTracer()
+	}
+	if f.Logger == nil {
+		f.Logger = &log.Logger
+	}
+	if f.WalCodec == nil {
+		f.WalCodec = walcodec.Json{}
+	}
+	if f.KeyProvider != nil && f.WalEnvelopeVersion != 0 && f.WalEnvelopeVersion < WalEnvelopeVersion3 {
+		panic(fmt.Errorf("walock: wal envelope version %d cannot hold encrypted payloads. KeyProvider needs version %d", f.WalEnvelopeVersion, WalEnvelopeVersion3))
+	}
+	if f.TccBarrierLevelDb != nil && f.TccBarrierLevelDb.Logger == nil {
+		f.TccBarrierLevelDb.Logger = f.Logger
+	}
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (f *WalockStoreLevelDb) logger() *zerolog.Logger {
+	if f.Logger == nil {
+		return &log.Logger
+	}
+	return f.Logger
+}
+
+// tracer returns Tracer, or the global OpenTelemetry tracer if InitDefault was not called
+func (f *WalockStoreLevelDb) tracer() trace.Tracer {
+	if f.Tracer == nil {
+		return defaultTracer()
+	}
+	return f.Tracer
+}
+
+// walCodec returns WalCodec, or JSON if InitDefault was not called
+func (f *WalockStoreLevelDb) walCodec() walcodec.WalCodec {
+	if f.WalCodec == nil {
+		return walcodec.Json{}
+	}
+	return f.WalCodec
 }
 
 // ensureUserMiniLock retrieves an existing account or creates a new one
 func (f *WalockStoreLevelDb) ensureUserMiniLock(key model.LockerKey) *model.Locker {
 	account, loaded := f.accounts.LoadOrStore(string(key), &model.Locker{})
 	if !loaded {
-		log.Debug().Str("userId", string(key)).Msg("new account lock created")
+		f.logger().Debug().Str("userId", string(key)).Msg("new account lock created")
 	}
 
 	return account.(*model.Locker)
 }
 
-func (f *WalockStoreLevelDb) ensure(tx model.LevelDbStoreOperator, key model.LockerKey) (value model.LockerValue, err error) {
-	value, err = f.BusinessProvider.LoadPersistedValue(key)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to load from persist")
-		return
+func (f *WalockStoreLevelDb) ensure(tx model.KvStoreOperator, key model.LockerKey) (value model.LockerValue, err error) {
+	value, fromSnapshot := f.loadFromSnapshot(tx, key)
+	if !fromSnapshot {
+		value, err = f.BusinessProvider.LoadPersistedValue(key)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to load from persist")
+			return
+		}
 	}
-	var updated bool
-	// replay wals
-	updated, err = f.BusinessProvider.CatchupWals(tx, key, value)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to catchup wals")
-		return
+	err = f.settle(tx, key, value, fromSnapshot)
+	return
+}
+
+// settle replays the WALs above a value loaded from the business provider and persists it if they moved it.
+// A value loaded from the local snapshot comes with its WALs replayed.
+func (f *WalockStoreLevelDb) settle(tx model.KvStoreOperator, key model.LockerKey, value model.LockerValue, fromSnapshot bool) (err error) {
+	updated := fromSnapshot && value.GetVersion() != value.GetDbVersion()
+	if !fromSnapshot {
+		// replay wals
+		updated, err = f.catchupWals(tx, key, value)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to catchup wals")
+			return
+		}
 	}
 
 	if updated {
@@ -79,11 +146,17 @@ func (f *WalockStoreLevelDb) ensure(tx model.LevelDbStoreOperator, key model.Loc
 		if err != nil {
 			return
 		}
+		value.SetDbVersion(value.GetVersion())
+		err = f.saveSnapshot(tx, key, value)
+		if err != nil {
+			f.logger().Warn().Err(err).Str("key", string(key)).Msg("failed to save snapshot")
+			err = nil
+		}
 	}
 	value.SetDirty(false)
-	err = tx.MarkDirty([]byte(key), false, f.WriteOption)
+	err = MarkDirty(tx, key, false)
 	if err != nil {
-		log.Error().Err(err).Str("key", string(key)).Msg("failed to clear dirty")
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to clear dirty")
 		return
 	}
 
@@ -91,11 +164,13 @@ func (f *WalockStoreLevelDb) ensure(tx model.LevelDbStoreOperator, key model.Loc
 
 }
 
-func (f *WalockStoreLevelDb) LoadAndLock(tx model.LevelDbStoreOperator, key model.LockerKey) (lockValue model.LockerValue, err error) {
+func (f *WalockStoreLevelDb) LoadAndLock(ctx context.Context, tx model.KvStoreOperator, key model.LockerKey) (lockValue model.LockerValue, err error) {
+	_, lockSpan := f.tracer().Start(ctx, "walock.lock", trace.WithAttributes(attribute.String("walock.lock_key", string(key))))
 	startTime := time.Now()
-	lock := f.ensureUserMiniLock(key)
-	lock.Mu.Lock()
+	lock := lockFresh(f.ensureUserMiniLock, key)
 	lockedTime := time.Now()
+	lock.UsedAt.Store(lockedTime.UnixNano())
+	lockSpan.End()
 
 	if f.Metrics.MetricsLockWaitTime != nil {
 		f.Metrics.MetricsLockWaitTime.Observe(lockedTime.Sub(startTime).Seconds())
@@ -103,9 +178,10 @@ func (f *WalockStoreLevelDb) LoadAndLock(tx model.LevelDbStoreOperator, key mode
 
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("stacktrace from panic: \n" + string(debug.Stack()))
-			log.Error().Any("v", r).Msg("recovered from panic")
-			err = r.(error)
+			panicErr := newPanicError(r)
+			f.logger().Error().Any("v", r).Str("key", string(key)).Str("stack", string(panicErr.Stack)).Msg("recovered from panic")
+			err = panicErr
+			lock.Value = nil // reload on next access
 			lock.Mu.Unlock()
 		} else if err != nil {
 			lock.Mu.Unlock()
@@ -114,13 +190,15 @@ func (f *WalockStoreLevelDb) LoadAndLock(tx model.LevelDbStoreOperator, key mode
 
 	if lock.Value == nil {
 		// load from database
+		_, loadSpan := f.tracer().Start(ctx, "walock.load")
 		var newValue model.LockerValue
 		newValue, err = f.ensure(tx, key)
+		endSpan(loadSpan, err)
 		if err != nil {
 			return
 		}
 		lock.Value = newValue
-		log.Debug().Str("key", string(key)).Msg("loaded value from persist store")
+		f.logger().Debug().Str("key", string(key)).Msg("loaded value from persist store")
 	}
 	lockValue = lock.Value
 	return
@@ -136,15 +214,18 @@ func (f *WalockStoreLevelDb) Traverse(fun func(key model.LockerKey, value model.
 
 	f.accounts.Range(func(key, value any) bool {
 		total += 1
-		lock := f.ensureUserMiniLock(model.LockerKey(key.(string)))
+		lock := value.(*model.Locker)
 		lock.Mu.Lock()
 
 		defer func() {
 			lock.Mu.Unlock()
 		}()
 
+		if lock.Evicted {
+			return true
+		}
 		if lock.Value == nil {
-			log.Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
+			f.logger().Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
 			return true
 		}
 
@@ -161,9 +242,46 @@ func (f *WalockStoreLevelDb) Keys() (keys []model.LockerKey) {
 	return keys
 }
 
-func (f *WalockStoreLevelDb) Get(tx model.LevelDbStoreOperator, key model.LockerKey) (value model.LockerValue, err error) {
+// applyWal applies durable WALs to the cached value. The caller holds the key lock.
+// The WALs are already written, so a failure here must not fail the call: if the business provider panics,
+// the cached value is dropped and the next access rebuilds it from the persisted value and the WALs.
+func (f *WalockStoreLevelDb) applyWal(key model.LockerKey, value model.LockerValue, wals []model.Wal) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := newPanicError(r)
+			f.logger().Error().Any("v", r).Str("key", string(key)).Str("stack", string(panicErr.Stack)).Msg("failed to apply wal. cached value dropped")
+			f.ensureUserMiniLock(key).Value = nil
+			err = panicErr
+		}
+	}()
+
+	value.SetDirty(true)
+	f.BusinessProvider.MustApplyWal(value, wals)
+	if last := wals[len(wals)-1].Seq; value.GetVersion() != last {
+		err = &WalChainError{Key: key, Expected: last, Found: value.GetVersion()}
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("version not moved to the wal seq. cached value dropped")
+		f.ensureUserMiniLock(key).Value = nil
+	}
+	return
+}
+
+// generateWal calls a GenerateWal* method of the business provider. The caller holds the key lock.
+// GenerateWalConfirm and GenerateWalCancel have no error to return, so a panic fails the call as a PanicError
+// before anything is written. The cached value is kept: the provider only reads it.
+func (f *WalockStoreLevelDb) generateWal(key model.LockerKey, generate func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := newPanicError(r)
+			f.logger().Error().Any("v", r).Str("key", string(key)).Str("stack", string(panicErr.Stack)).Msg("failed to generate wal")
+			err = panicErr
+		}
+	}()
+	return generate()
+}
+
+func (f *WalockStoreLevelDb) Get(ctx context.Context, tx model.KvStoreOperator, key model.LockerKey) (value model.LockerValue, err error) {
 
-	valuePointer, err := f.LoadAndLock(tx, key)
+	valuePointer, err := f.LoadAndLock(ctx, tx, key)
 	if err != nil {
 		return
 	}
@@ -178,8 +296,18 @@ func (f *WalockStoreLevelDb) Get(tx model.LevelDbStoreOperator, key model.Locker
 	return
 }
 
-func (f *WalockStoreLevelDb) Must(tx model.LevelDbStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	value, err := f.LoadAndLock(tx, lockKey)
+func (f *WalockStoreLevelDb) Must(ctx context.Context, tx model.KvStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Must", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationMust, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
+
+	value, err := f.LoadAndLock(ctx, tx, lockKey)
 	if err != nil {
 		return
 	}
@@ -194,8 +322,10 @@ func (f *WalockStoreLevelDb) Must(tx model.LevelDbStoreOperator, tccContext *mod
 
 	// check TCC
 	{
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.TccBarrierLevelDb.CheckBarrierMust(tx, []byte(v.Key))
+		callIt, skipped, err = f.TccBarrierLevelDb.CheckBarrierMust(tx, []byte(v.Key))
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return
 		}
@@ -209,8 +339,13 @@ func (f *WalockStoreLevelDb) Must(tx model.LevelDbStoreOperator, tccContext *mod
 	// generate wal
 	var mustWal model.Wal
 	{
+		_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
 		var ok bool
-		ok, code, message, mustWal, err = f.BusinessProvider.GenerateWalMust(tccContext, lockKey, value, mustBody)
+		err = f.generateWal(lockKey, func() (err error) {
+			ok, code, message, mustWal, err = f.BusinessProvider.GenerateWalMust(tccContext, lockKey, value, mustBody)
+			return
+		})
+		endSpan(generateSpan, err)
 		if err != nil {
 			return
 		}
@@ -218,41 +353,68 @@ func (f *WalockStoreLevelDb) Must(tx model.LevelDbStoreOperator, tccContext *mod
 			tccCode = consts.TccCode_Failed
 			return
 		}
+		nextWal(lockKey, value, &mustWal)
+		err = f.encodeWal(&mustWal)
+		if err != nil {
+			return
+		}
 	}
 
 	// write tcc and mustWal in one transaction
 	{
-		b := &leveldb.Batch{}
-		b.Put([]byte(v.Key), []byte{})               // tcc barrier -> WAL key
-		b.Put([]byte(mustWal.Key), mustWal.WalBytes) // WAL key
+		_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+		var walBytes []byte
+		walBytes, err = f.sealWal(mustWal, tccContext, consts.TccBranchTypeMust)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to seal wal")
+			endSpan(writeSpan, err)
+			return
+		}
+		b := &model.KvBatch{}
+		b.Put([]byte(v.Key), []byte{})       // tcc barrier -> WAL key
+		b.Put([]byte(mustWal.Key), walBytes) // WAL key, in its envelope
 		//fmt.Println("PUT Must", mustWal.String())
 
 		if !value.IsDirty() {
-			err = tx.MarkDirty([]byte(lockKey), true, f.WriteOption)
+			err = MarkDirty(tx, lockKey, true)
 			if err != nil {
-				log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write dirty")
+				logger.Error().Err(err).Msg("failed to write dirty")
+				endSpan(writeSpan, err)
 				return
 			}
 		}
 
 		// write wal first
-		err = tx.Write(b, f.WriteOption)
+		writeStartTime := time.Now()
+		err = tx.Write(b)
+		f.Metrics.ObserveWalWrite(writeStartTime)
+		endSpan(writeSpan, err)
 		if err != nil {
-			log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write wal")
+			logger.Error().Err(err).Msg("failed to write wal")
 			return
 		}
 	}
 
-	// update memory. this must success, or we will have a dirty wal
-	value.SetDirty(true)
-	f.BusinessProvider.MustApplyWal(value, []model.Wal{mustWal})
+	// update memory. on failure the value is rebuilt from the durable wal on next access
+	_, applySpan := f.tracer().Start(ctx, "walock.apply")
+	endSpan(applySpan, f.applyWal(lockKey, value, []model.Wal{mustWal}))
 	tccCode = consts.TccCode_Success
 	return
 
 }
 
-func (f *WalockStoreLevelDb) Try(tx model.LevelDbStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	value, err := f.LoadAndLock(tx, lockKey)
+func (f *WalockStoreLevelDb) Try(ctx context.Context, tx model.KvStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Try", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationTry, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
+
+	value, err := f.LoadAndLock(ctx, tx, lockKey)
 	if err != nil {
 		return
 	}
@@ -264,11 +426,14 @@ func (f *WalockStoreLevelDb) Try(tx model.LevelDbStoreOperator, tccContext *mode
 	}()
 
 	v := tcc.BuildTccBarrierReceiver(f.BarrierName, tccContext.GlobalId, tccContext.BranchId, consts.TccBranchTypeTry)
+	vCancel := tcc.BuildTccBarrierReceiver(f.BarrierName, tccContext.GlobalId, tccContext.BranchId, consts.TccBranchTypeCancel)
 
 	// check TCC
 	{
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.TccBarrierLevelDb.CheckBarrierTry(tx, []byte(v.Key))
+		callIt, skipped, err = f.TccBarrierLevelDb.CheckBarrierTry(tx, []byte(v.Key), []byte(vCancel.Key))
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return
 		}
@@ -285,7 +450,7 @@ func (f *WalockStoreLevelDb) Try(tx model.LevelDbStoreOperator, tccContext *mode
 	//+-------------+-----------------------+-----------------------+
 	//| tcc barrier | B-GlobalId-BranchId-T | B-GlobalId-BranchId-X |
 	//+-------------+-----------------------+-----------------------+
-	//| wal Key     | DUM-001#BTC-100       | DUM-001#BTC-101       |
+	//| wal Key     | WAL-DUM-001#BTC#..100 | WAL-DUM-001#BTC#..101 |
 	//+-------------+-----------------------+-----------------------+
 
 	// Caller Use Tcc Barrier to revert
@@ -295,8 +460,13 @@ func (f *WalockStoreLevelDb) Try(tx model.LevelDbStoreOperator, tccContext *mode
 	// generate wal
 	var tryWal model.Wal
 	{
+		_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
 		var ok bool
-		ok, code, message, tryWal, err = f.BusinessProvider.GenerateWalTry(tccContext, lockKey, value, tryBody)
+		err = f.generateWal(lockKey, func() (err error) {
+			ok, code, message, tryWal, err = f.BusinessProvider.GenerateWalTry(tccContext, lockKey, value, tryBody)
+			return
+		})
+		endSpan(generateSpan, err)
 		if err != nil {
 			return
 		}
@@ -304,42 +474,77 @@ func (f *WalockStoreLevelDb) Try(tx model.LevelDbStoreOperator, tccContext *mode
 			tccCode = consts.TccCode_Failed
 			return
 		}
+		nextWal(lockKey, value, &tryWal)
+		err = f.encodeWal(&tryWal)
+		if err != nil {
+			return
+		}
 	}
 
 	// write tcc and mustWali in one transaction
 	{
-		b := &leveldb.Batch{}
-		b.Put([]byte(v.Key), []byte(tryWal.Key))   // tcc barrier -> WAL key
-		b.Put([]byte(tryWal.Key), tryWal.WalBytes) // WAL key
+		_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+		var walBytes []byte
+		walBytes, err = f.sealWal(tryWal, tccContext, consts.TccBranchTypeTry)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to seal wal")
+			endSpan(writeSpan, err)
+			return
+		}
+		b := &model.KvBatch{}
+		var barrierValue []byte
+		barrierValue, err = f.sealBarrierValue(b, v.Key, []byte(tryWal.Key))
+		if err != nil {
+			endSpan(writeSpan, err)
+			return
+		}
+		b.Put([]byte(v.Key), barrierValue)  // tcc barrier -> WAL key
+		b.Put([]byte(tryWal.Key), walBytes) // WAL key, in its envelope
 		//fmt.Println("PUT Try", tryWal.String())
 
 		if !value.IsDirty() {
-			err = tx.MarkDirty([]byte(lockKey), true, f.WriteOption)
+			err = MarkDirty(tx, lockKey, true)
 			if err != nil {
-				log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write dirty")
+				logger.Error().Err(err).Msg("failed to write dirty")
+				endSpan(writeSpan, err)
 				return
 			}
 		}
 
 		// write wal first
-		err = tx.Write(b, f.WriteOption)
+		writeStartTime := time.Now()
+		err = tx.Write(b)
+		f.Metrics.ObserveWalWrite(writeStartTime)
+		endSpan(writeSpan, err)
 		if err != nil {
-			log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write wal")
+			logger.Error().Err(err).Msg("failed to write wal")
 			return
 		}
+		if f.KeyProvider != nil && f.EncryptBarriers {
+			f.encryptedBarriers.Store(true)
+		}
 	}
 
-	// update memory. this must success, or we will have a dirty wal
-	value.SetDirty(true)
-	f.BusinessProvider.MustApplyWal(value, []model.Wal{tryWal})
+	// update memory. on failure the value is rebuilt from the durable wal on next access
+	_, applySpan := f.tracer().Start(ctx, "walock.apply")
+	endSpan(applySpan, f.applyWal(lockKey, value, []model.Wal{tryWal}))
 	tccCode = consts.TccCode_Success
 
 	return
 }
 
-func (f *WalockStoreLevelDb) Confirm(tx model.LevelDbStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+func (f *WalockStoreLevelDb) Confirm(ctx context.Context, tx model.KvStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Confirm", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationConfirm, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
 
-	value, err := f.LoadAndLock(tx, lockKey)
+	value, err := f.LoadAndLock(ctx, tx, lockKey)
 	if err != nil {
 		return
 	}
@@ -355,8 +560,10 @@ func (f *WalockStoreLevelDb) Confirm(tx model.LevelDbStoreOperator, tccContext *
 
 	// check TCC
 	{
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.TccBarrierLevelDb.CheckBarrierConfirm(tx, []byte(v.Key))
+		callIt, skipped, err = f.TccBarrierLevelDb.CheckBarrierConfirm(tx, []byte(v.Key))
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return
 		}
@@ -384,40 +591,75 @@ func (f *WalockStoreLevelDb) Confirm(tx model.LevelDbStoreOperator, tccContext *
 	// generate wal
 	var confirmWal model.Wal
 	{
-		confirmWal = f.BusinessProvider.GenerateWalConfirm(tccContext, lockKey, value, reservationWal)
+		_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
+		err = f.generateWal(lockKey, func() error {
+			confirmWal = f.BusinessProvider.GenerateWalConfirm(tccContext, lockKey, value, reservationWal)
+			return nil
+		})
+		endSpan(generateSpan, err)
+		if err != nil {
+			return
+		}
 	}
-	// write tcc and mustWal in one transaction
-	if confirmWal.Key != "" {
-		b := &leveldb.Batch{}
+	// write tcc and mustWal in one transaction. no WalBytes nor Value means nothing to confirm
+	if confirmWal.WalBytes != nil || confirmWal.Value != nil {
+		nextWal(lockKey, value, &confirmWal)
+		err = f.encodeWal(&confirmWal)
+		if err != nil {
+			return
+		}
+		_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+		var walBytes []byte
+		walBytes, err = f.sealWal(confirmWal, tccContext, consts.TccBranchTypeConfirm)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to seal wal")
+			endSpan(writeSpan, err)
+			return
+		}
+		b := &model.KvBatch{}
 		b.Put([]byte(v.Key), []byte{})
-		b.Put([]byte(confirmWal.Key), confirmWal.WalBytes)
+		b.Put([]byte(confirmWal.Key), walBytes) // WAL key, in its envelope
 		//fmt.Println("PUT Confirm", confirmWal.String())
 
 		if !value.IsDirty() {
-			err = tx.MarkDirty([]byte(lockKey), true, f.WriteOption)
+			err = MarkDirty(tx, lockKey, true)
 			if err != nil {
-				log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write dirty")
+				logger.Error().Err(err).Msg("failed to write dirty")
+				endSpan(writeSpan, err)
 				return
 			}
 		}
 
 		// write wal first
-		err = tx.Write(b, f.WriteOption)
+		writeStartTime := time.Now()
+		err = tx.Write(b)
+		f.Metrics.ObserveWalWrite(writeStartTime)
+		endSpan(writeSpan, err)
 		if err != nil {
-			log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write wal")
+			logger.Error().Err(err).Msg("failed to write wal")
 			return
 		}
-		// update memory. this must success, or we will have a dirty wal
-		value.SetDirty(true)
-		f.BusinessProvider.MustApplyWal(value, []model.Wal{confirmWal})
+		// update memory. on failure the value is rebuilt from the durable wal on next access
+		_, applySpan := f.tracer().Start(ctx, "walock.apply")
+		endSpan(applySpan, f.applyWal(lockKey, value, []model.Wal{confirmWal}))
 	}
 
 	tccCode = consts.TccCode_Success
 	return
 }
 
-func (f *WalockStoreLevelDb) Cancel(tx model.LevelDbStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	value, err := f.LoadAndLock(tx, lockKey)
+func (f *WalockStoreLevelDb) Cancel(ctx context.Context, tx model.KvStoreOperator, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Cancel", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationCancel, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
+
+	value, err := f.LoadAndLock(ctx, tx, lockKey)
 	if err != nil {
 		return
 	}
@@ -433,8 +675,10 @@ func (f *WalockStoreLevelDb) Cancel(tx model.LevelDbStoreOperator, tccContext *m
 
 	// check TCC
 	{
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.TccBarrierLevelDb.CheckBarrierCancel(tx, []byte(vTry.Key), []byte(vCancel.Key))
+		callIt, skipped, err = f.TccBarrierLevelDb.CheckBarrierCancel(tx, []byte(vTry.Key), []byte(vCancel.Key))
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return
 		}
@@ -460,40 +704,65 @@ func (f *WalockStoreLevelDb) Cancel(tx model.LevelDbStoreOperator, tccContext *m
 	// generate wal
 	var cancelWal model.Wal
 	{
-		cancelWal = f.BusinessProvider.GenerateWalCancel(tccContext, lockKey, value, reservationWal)
+		_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
+		err = f.generateWal(lockKey, func() error {
+			cancelWal = f.BusinessProvider.GenerateWalCancel(tccContext, lockKey, value, reservationWal)
+			return nil
+		})
+		endSpan(generateSpan, err)
+		if err != nil {
+			return
+		}
+		nextWal(lockKey, value, &cancelWal)
+		err = f.encodeWal(&cancelWal)
+		if err != nil {
+			return
+		}
 	}
 	// write tcc and mustWal in one transaction
 	{
-		b := &leveldb.Batch{}
-		b.Put([]byte(vCancel.Key), []byte{})             // tcc barrier -> WAL key
-		b.Put([]byte(cancelWal.Key), cancelWal.WalBytes) // WAL key
+		_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+		var walBytes []byte
+		walBytes, err = f.sealWal(cancelWal, tccContext, consts.TccBranchTypeCancel)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to seal wal")
+			endSpan(writeSpan, err)
+			return
+		}
+		b := &model.KvBatch{}
+		b.Put([]byte(vCancel.Key), []byte{})   // tcc barrier -> WAL key
+		b.Put([]byte(cancelWal.Key), walBytes) // WAL key, in its envelope
 		//fmt.Println("PUT Cancel", cancelWal.String())
 
 		if !value.IsDirty() {
-			err = tx.MarkDirty([]byte(lockKey), true, f.WriteOption)
+			err = MarkDirty(tx, lockKey, true)
 			if err != nil {
-				log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write dirty")
+				logger.Error().Err(err).Msg("failed to write dirty")
+				endSpan(writeSpan, err)
 				return
 			}
 		}
 
 		// write wal first
-		err = tx.Write(b, f.WriteOption)
+		writeStartTime := time.Now()
+		err = tx.Write(b)
+		f.Metrics.ObserveWalWrite(writeStartTime)
+		endSpan(writeSpan, err)
 		if err != nil {
-			log.Error().Err(err).Str("tcc", tccContext.String()).Msg("failed to write wal")
+			logger.Error().Err(err).Msg("failed to write wal")
 			return
 		}
 	}
-	value.SetDirty(true)
-	f.BusinessProvider.MustApplyWal(value, []model.Wal{cancelWal})
+	_, applySpan := f.tracer().Start(ctx, "walock.apply")
+	endSpan(applySpan, f.applyWal(lockKey, value, []model.Wal{cancelWal}))
 	tccCode = consts.TccCode_Success
 
 	return
 }
 
-func (f *WalockStoreLevelDb) Update(tx model.LevelDbStoreOperator, lockKey model.LockerKey, updatedValue model.LockerValue,
+func (f *WalockStoreLevelDb) Update(ctx context.Context, tx model.KvStoreOperator, lockKey model.LockerKey, updatedValue model.LockerValue,
 	updater func(baseV, updateV model.LockerValue) (updated bool)) (err error) {
-	baseValue, err := f.LoadAndLock(tx, lockKey)
+	baseValue, err := f.LoadAndLock(ctx, tx, lockKey)
 	if err != nil {
 		return
 	}
@@ -509,45 +778,47 @@ func (f *WalockStoreLevelDb) Update(tx model.LevelDbStoreOperator, lockKey model
 	return
 }
 
-func (f *WalockStoreLevelDb) FlushDirty(tx model.LevelDbStoreOperator) (err error) {
+func (f *WalockStoreLevelDb) FlushDirty(tx model.KvStoreOperator) (err error) {
 	refreshCount := 0
 
 	total := 0
 
 	f.accounts.Range(func(key, value interface{}) bool {
 		total += 1
-		lock := f.ensureUserMiniLock(model.LockerKey(key.(string)))
+		lock := value.(*model.Locker)
 		lock.Mu.Lock()
 
 		defer func() {
 			lock.Mu.Unlock()
 		}()
 
+		if lock.Evicted {
+			return true
+		}
 		if lock.Value == nil {
-			log.Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
+			f.logger().Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
 			return true
 		}
 
 		if lock.Value.IsDirty() || lock.Value.GetDbVersion() != lock.Value.GetVersion() {
-			err = f.BusinessProvider.PersistValue(lock.Value)
+			err = f.flushValue(tx, model.LockerKey(key.(string)), lock.Value)
 			if err != nil {
-				log.Error().Err(err).Msg("failed to flush back")
 				return false
 			}
-			lock.Value.SetDbVersion(lock.Value.GetVersion())
-
-			lock.Value.SetDirty(false)
-			err = tx.MarkDirty([]byte(key.(string)), false, f.WriteOption)
-			if err != nil {
-				log.Error().Err(err).Str("key", key.(string)).Msg("failed to clear dirty")
-			}
-
 			refreshCount++
 		}
 
 		return true
 	})
-	log.Info().Int("mapSize", total).Int("refreshCount", refreshCount).Msg("flushing back")
+	f.logger().Info().Int("mapSize", total).Int("refreshCount", refreshCount).Msg("flushing back")
+
+	if f.ActiveKeys > 0 {
+		// losing the list only costs a colder start
+		activeErr := f.saveActiveKeys(tx)
+		if activeErr != nil {
+			f.logger().Warn().Err(activeErr).Msg("failed to save active keys")
+		}
+	}
 
 	if f.Metrics.MetricsMapCount != nil {
 		f.Metrics.MetricsMapCount.Set(float64(total))
@@ -556,59 +827,94 @@ func (f *WalockStoreLevelDb) FlushDirty(tx model.LevelDbStoreOperator) (err erro
 	return
 }
 
-func (f *WalockStoreLevelDb) LoadReservation(tx model.LevelDbStoreOperator, tryBarrierKey string) (wal model.Wal, ok bool, code string, message string, err error) {
-	walId, err := tx.Get([]byte(tryBarrierKey), nil)
+// flushValue persists a cached value through the business provider. The caller holds the key lock.
+func (f *WalockStoreLevelDb) flushValue(tx model.KvStoreOperator, key model.LockerKey, value model.LockerValue) (err error) {
+	flushStartTime := time.Now()
+	err = f.BusinessProvider.PersistValue(value)
+	f.Metrics.ObserveFlush(flushStartTime)
+	if err != nil {
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to flush back")
+		return
+	}
+	value.SetDbVersion(value.GetVersion())
+	// a missing snapshot only costs a load from the business provider
+	snapshotErr := f.saveSnapshot(tx, key, value)
+	if snapshotErr != nil {
+		f.logger().Warn().Err(snapshotErr).Str("key", string(key)).Msg("failed to save snapshot")
+	}
+
+	value.SetDirty(false)
+	err = MarkDirty(tx, key, false)
+	if err != nil {
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to clear dirty")
+	}
+	return
+}
+
+func (f *WalockStoreLevelDb) LoadReservation(tx model.KvStoreOperator, tryBarrierKey string) (wal model.Wal, ok bool, code string, message string, err error) {
+	walId, err := tx.Get([]byte(tryBarrierKey))
 	if err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
+		if errors.Is(err, model.ErrNotFound) {
 			err = nil
 			ok = false
 			code = consts.ErrReservationNotFound
 			message = "reservation not found from barrier: " + tryBarrierKey
 			return
 		}
-		log.Error().Err(err).Msg("failed to load reservation")
+		f.logger().Error().Err(err).Msg("failed to load reservation")
+		return
+	}
+	walId, err = f.openBarrierValue(tx, tryBarrierKey, walId)
+	if err != nil {
+		f.logger().Error().Err(err).Msg("failed to load reservation")
 		return
 	}
 
-	walBytes, err := tx.Get(walId, nil)
+	walBytes, err := tx.Get(walId)
 	if err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
+		if errors.Is(err, model.ErrNotFound) {
 			err = nil
 			ok = false
 			code = consts.ErrReservationNotFound
 			message = "reservation not found from wal: " + string(walId)
 			return
 		}
-		log.Error().Err(err).Msg("failed to load reservation")
+		f.logger().Error().Err(err).Msg("failed to load reservation")
 		return
 	}
 	wal = model.Wal{
 		Key:      string(walId),
 		WalBytes: walBytes,
 	}
+	_, wal.Seq, _ = ParseWalKey(wal.Key)
+	err = f.openWal(&wal)
+	if err != nil {
+		f.logger().Error().Err(err).Msg("failed to load reservation")
+		return
+	}
 
 	ok = true
 	return
 }
 
-func (f *WalockStoreLevelDb) ClearDirtyRecords(tx model.LevelDbStoreOperator) (err error) {
+func (f *WalockStoreLevelDb) ClearDirtyRecords(ctx context.Context, tx model.KvStoreOperator) (err error) {
 	// clear dirty by access the record once so that wal will be replayed
-	var dirtyKeys [][]byte
-	dirtyKeys, err = tx.ListDirty()
+	var dirtyKeys []model.LockerKey
+	dirtyKeys, err = ListDirty(tx)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to list dirty keys")
+		f.logger().Error().Err(err).Msg("failed to list dirty keys")
 		return
 	}
 
 	for _, key := range dirtyKeys {
-		log.Info().Str("key", string(key)).Msg("clearing dirty key")
+		f.logger().Info().Str("key", string(key)).Msg("clearing dirty key")
 		var v model.LockerValue
-		v, err = f.Get(tx, model.LockerKey(key))
+		v, err = f.Get(ctx, tx, key)
 		if err != nil {
-			log.Error().Err(err).Str("key", string(key)).Msg("failed to clear dirty key")
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to clear dirty key")
 			return err
 		} else {
-			log.Info().Str("key", string(key)).Uint64("version", v.GetVersion()).Uint64("dbVersion", v.GetDbVersion()).Msg("cleared dirty key")
+			f.logger().Info().Str("key", string(key)).Uint64("version", v.GetVersion()).Uint64("dbVersion", v.GetDbVersion()).Msg("cleared dirty key")
 		}
 	}
 	return
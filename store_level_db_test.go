@@ -0,0 +1,75 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"testing"
+)
+
+func TestCorruptedReservation(t *testing.T) {
+	ctx := context.Background()
+	phases := []struct {
+		name       string
+		branchType string
+		call       func(store *walock.LevelDbTccStore, tccContext *model.TccContext) (model.TccCode, string, string, error)
+	}{
+		{"confirm", consts.TccBranchTypeConfirm, func(store *walock.LevelDbTccStore, tccContext *model.TccContext) (model.TccCode, string, string, error) {
+			return store.Confirm(ctx, tccContext, "alice", nil)
+		}},
+		{"cancel", consts.TccBranchTypeCancel, func(store *walock.LevelDbTccStore, tccContext *model.TccContext) (model.TccCode, string, string, error) {
+			return store.Cancel(ctx, tccContext, "alice", nil)
+		}},
+	}
+	for _, phase := range phases {
+		t.Run(phase.name, func(t *testing.T) {
+			kv := &memkv.MemKv{}
+			// the raw provider decodes the reservation itself, in GenerateWalConfirm and GenerateWalCancel
+			store := newEngineStore(kv, true)
+			tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+			_, _, _, err := tccStore.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tccContext := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+			tccCode, _, _, err := tccStore.Try(ctx, tccContext, "alice", int64(30))
+			if err != nil || tccCode != consts.TccCode_Success {
+				t.Fatalf("Try = %d, %v", tccCode, err)
+			}
+			corrupted, err := walock.EncodeWalEnvelope(&model.WalEnvelope{TccContext: *tccContext, BranchType: consts.TccBranchTypeTry, Payload: []byte("{corrupted")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = kv.Put([]byte(walock.WalKey("alice", 2)), corrupted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = phase.call(tccStore, tccContext)
+			var panicErr *walock.PanicError
+			if !errors.As(err, &panicErr) {
+				t.Fatalf("%s of a corrupted reservation = %v, want a PanicError", phase.name, err)
+			}
+			barrier := tcc.BuildTccBarrierReceiver("engine", tccContext.GlobalId, tccContext.BranchId, phase.branchType)
+			if _, err = kv.Get([]byte(barrier.Key)); !errors.Is(err, model.ErrNotFound) {
+				t.Fatalf("%s barrier written: %v", phase.name, err)
+			}
+			if _, err = kv.Get([]byte(walock.WalKey("alice", 3))); !errors.Is(err, model.ErrNotFound) {
+				t.Fatalf("%s wal written: %v", phase.name, err)
+			}
+
+			// the key is unlocked and still served from the cached value
+			tccCode, _, _, err = tccStore.Must(ctx, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "alice", int64(5))
+			if err != nil || tccCode != consts.TccCode_Success {
+				t.Fatalf("Must after the panic = %d, %v", tccCode, err)
+			}
+			if a := account(t, store, kv, "alice"); a.Available != 75 || a.Frozen != 30 || a.Seq != 3 {
+				t.Fatalf("alice has %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+			}
+		})
+	}
+}
@@ -1,12 +1,16 @@
 package walock
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/latifrons/walock/consts"
 	"github.com/latifrons/walock/model"
 	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"runtime/debug"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sync"
 )
 
@@ -38,23 +42,69 @@ type WalockStoreSqlDb struct {
 	BusinessProvider   BusinessProviderSql
 	BarrierName        string
 	BarrierDbTableName string
+	Logger             *zerolog.Logger // optional. defaults to the global zerolog logger
+	Tracer             trace.Tracer    // optional. defaults to the global OpenTelemetry tracer
+	TccBarrier         SqlTccBarrier   // optional. defaults to a tcc.TccBarrierSql on BarrierDbTableName
+	Lease              *SqlLease       // optional. serves writes only while holding the lease, fenced by its epoch. run it with SqlLease.Run
+	ActiveKeys         int             // optional. remembers up to this many recently used keys at each FlushDirty for PreloadActive. needs an ActiveKeysSql provider. 0 disables
 
-	tccBarrierSql tcc.TccBarrierSql
-	accounts      sync.Map // string:*model.Locker
+	accounts sync.Map // string:*model.Locker
 }
 
 func (f *WalockStoreSqlDb) InitDefault() {
-	f.tccBarrierSql = tcc.TccBarrierSql{
-		BarrierName: f.BarrierName,
-		DbTableName: f.BarrierDbTableName,
+	if f.Metrics == nil {
+		f.Metrics, _ = model.NewMetrics("walock", nil)
 	}
+	if f.Tracer == nil {
+		f.Tracer = defaultTracer()
+	}
+	if f.Logger == nil {
+		f.Logger = &log.Logger
+	}
+	if f.TccBarrier == nil {
+		tccBarrierSql := &tcc.TccBarrierSql{
+			BarrierName: f.BarrierName,
+			DbTableName: f.BarrierDbTableName,
+			Logger:      f.Logger,
+		}
+		tccBarrierSql.InitDefault()
+		f.TccBarrier = tccBarrierSql
+	}
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (f *WalockStoreSqlDb) logger() *zerolog.Logger {
+	if f.Logger == nil {
+		return &log.Logger
+	}
+	return f.Logger
+}
+
+// tracer returns Tracer, or the global OpenTelemetry tracer if InitDefault was not called
+func (f *WalockStoreSqlDb) tracer() trace.Tracer {
+	if f.Tracer == nil {
+		return defaultTracer()
+	}
+	return f.Tracer
+}
+
+// tccBarrier returns TccBarrier, or a tcc.TccBarrierSql on BarrierDbTableName if InitDefault was not called
+func (f *WalockStoreSqlDb) tccBarrier() SqlTccBarrier {
+	if f.TccBarrier == nil {
+		return &tcc.TccBarrierSql{
+			BarrierName: f.BarrierName,
+			DbTableName: f.BarrierDbTableName,
+			Logger:      f.logger(),
+		}
+	}
+	return f.TccBarrier
 }
 
 // ensureUserMiniLock retrieves an existing account or creates a new one
 func (f *WalockStoreSqlDb) ensureUserMiniLock(key model.LockerKey) *model.Locker {
 	account, loaded := f.accounts.LoadOrStore(string(key), &model.Locker{})
 	if !loaded {
-		log.Debug().Str("userId", string(key)).Msg("new account lock created")
+		f.logger().Debug().Str("userId", string(key)).Msg("new account lock created")
 	}
 
 	return account.(*model.Locker)
@@ -63,29 +113,47 @@ func (f *WalockStoreSqlDb) ensureUserMiniLock(key model.LockerKey) *model.Locker
 func (f *WalockStoreSqlDb) ensure(key model.LockerKey, tx *gorm.DB) (value model.LockerValue, err error) {
 	value, err = f.BusinessProvider.LoadPersistedValue(tx, key)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to load from persist")
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to load from persist")
 		return
 	}
+	err = f.settle(tx, key, value)
+	return
+
+}
+
+// settle replays the WALs above a loaded value and flushes it
+func (f *WalockStoreSqlDb) settle(tx *gorm.DB, key model.LockerKey, value model.LockerValue) (err error) {
 	// replay wals
-	err = f.BusinessProvider.CatchupWals(tx, key, value)
+	err = f.catchupWals(tx, key, value)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to catchup wals")
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to catchup wals")
 		return
 	}
 
-	err = f.BusinessProvider.Flush(tx, value)
-	if err != nil {
-		return
+	// the caught up value is flushed again by FlushDirty if this replica cannot flush it now
+	err = f.fenced(tx, key, func(tx *gorm.DB) error {
+		return f.BusinessProvider.Flush(tx, value)
+	})
+	var lost *LeaseLostError
+	if errors.As(err, &lost) {
+		err = nil
 	}
 	return
-
 }
 
-func (f *WalockStoreSqlDb) LoadAndLock(tx *gorm.DB, key model.LockerKey) (lockValue model.LockerValue, err error) {
+func (f *WalockStoreSqlDb) LoadAndLock(ctx context.Context, tx *gorm.DB, key model.LockerKey) (lockValue model.LockerValue, err error) {
+	_, lockSpan := f.tracer().Start(ctx, "walock.lock", trace.WithAttributes(attribute.String("walock.lock_key", string(key))))
 	startTime := time.Now()
-	lock := f.ensureUserMiniLock(key)
-	lock.Mu.Lock()
+	lock := lockFresh(f.ensureUserMiniLock, key)
 	lockedTime := time.Now()
+	lock.UsedAt.Store(lockedTime.UnixNano())
+	lockSpan.End()
+
+	// a value loaded under another epoch misses the writes of the holders in between
+	if epoch := f.leaseEpoch(); lock.Epoch != epoch {
+		lock.Value = nil
+		lock.Epoch = epoch
+	}
 
 	if f.Metrics.MetricsLockWaitTime != nil {
 		f.Metrics.MetricsLockWaitTime.Observe(lockedTime.Sub(startTime).Seconds())
@@ -93,9 +161,10 @@ func (f *WalockStoreSqlDb) LoadAndLock(tx *gorm.DB, key model.LockerKey) (lockVa
 
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("stacktrace from panic: \n" + string(debug.Stack()))
-			log.Error().Err(r.(error)).Stack().Msg("panic recovered")
-			err = r.(error)
+			panicErr := newPanicError(r)
+			f.logger().Error().Any("v", r).Str("key", string(key)).Str("stack", string(panicErr.Stack)).Msg("recovered from panic")
+			err = panicErr
+			lock.Value = nil // reload on next access
 			lock.Mu.Unlock()
 		} else if err != nil {
 			lock.Mu.Unlock()
@@ -104,13 +173,15 @@ func (f *WalockStoreSqlDb) LoadAndLock(tx *gorm.DB, key model.LockerKey) (lockVa
 
 	if lock.Value == nil {
 		// load from database
+		_, loadSpan := f.tracer().Start(ctx, "walock.load")
 		var newValue model.LockerValue
 		newValue, err = f.ensure(key, tx)
+		endSpan(loadSpan, err)
 		if err != nil {
 			return
 		}
 		lock.Value = newValue
-		log.Debug().Str("key", string(key)).Msg("persist loaded")
+		f.logger().Debug().Str("key", string(key)).Msg("persist loaded")
 	}
 	lockValue = lock.Value
 	return
@@ -126,15 +197,18 @@ func (f *WalockStoreSqlDb) Traverse(fun func(key model.LockerKey, value model.Lo
 
 	f.accounts.Range(func(key, value any) bool {
 		total += 1
-		lock := f.ensureUserMiniLock(model.LockerKey(key.(string)))
+		lock := value.(*model.Locker)
 		lock.Mu.Lock()
 
 		defer func() {
 			lock.Mu.Unlock()
 		}()
 
+		if lock.Evicted {
+			return true
+		}
 		if lock.Value == nil {
-			log.Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
+			f.logger().Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
 			return true
 		}
 
@@ -151,9 +225,34 @@ func (f *WalockStoreSqlDb) Keys() (keys []model.LockerKey) {
 	return keys
 }
 
-func (f *WalockStoreSqlDb) Get(key model.LockerKey) (value model.LockerValue, err error) {
+// applyWal applies WALs flushed in the current transaction to the cached value. The caller holds the key lock.
+// The WALs are committed with the transaction regardless of the result: if ApplyWal fails, panics or does not
+// move the version to the seq of a SeqWal, the cached value is dropped and the next access rebuilds it
+// from the persisted value and the WALs.
+func (f *WalockStoreSqlDb) applyWal(key model.LockerKey, value model.LockerValue, walis []interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := newPanicError(r)
+			f.logger().Error().Any("v", r).Str("key", string(key)).Str("stack", string(panicErr.Stack)).Msg("failed to apply wal. cached value dropped")
+			f.ensureUserMiniLock(key).Value = nil
+			err = panicErr
+		}
+	}()
+
+	err = f.BusinessProvider.ApplyWal(value, walis)
+	if err == nil {
+		err = checkSeq(key, value, walis)
+	}
+	if err != nil {
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to apply wal. cached value dropped")
+		f.ensureUserMiniLock(key).Value = nil
+	}
+	return
+}
+
+func (f *WalockStoreSqlDb) Get(ctx context.Context, key model.LockerKey) (value model.LockerValue, err error) {
 
-	valuePointer, err := f.LoadAndLock(f.DbRw, key)
+	valuePointer, err := f.LoadAndLock(ctx, f.DbRw, key)
 	if err != nil {
 		return
 	}
@@ -168,8 +267,18 @@ func (f *WalockStoreSqlDb) Get(key model.LockerKey) (value model.LockerValue, er
 	return
 }
 
-func (f *WalockStoreSqlDb) Must(tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	value, err := f.LoadAndLock(f.DbRw, lockKey)
+func (f *WalockStoreSqlDb) Must(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Must", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationMust, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
+
+	value, err := f.LoadAndLock(ctx, f.DbRw, lockKey)
 	if err != nil {
 		return
 	}
@@ -183,8 +292,14 @@ func (f *WalockStoreSqlDb) Must(tccContext *model.TccContext, lockKey model.Lock
 	exemptError := false // just to revert the transaction. do not return this error to caller
 
 	err = f.DbRw.Transaction(func(tx *gorm.DB) error {
+		err = f.fence(tx, lockKey)
+		if err != nil {
+			return err
+		}
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.tccBarrierSql.BarrierMust(tccContext, tx)
+		callIt, skipped, err = f.tccBarrier().BarrierMust(tccContext, tx)
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return err
 		}
@@ -194,7 +309,7 @@ func (f *WalockStoreSqlDb) Must(tccContext *model.TccContext, lockKey model.Lock
 			return nil
 		}
 
-		tccCode, code, message, err = f.DoMust(tx, tccContext, lockKey, value, mustBody)
+		tccCode, code, message, err = f.DoMust(ctx, tx, tccContext, lockKey, value, mustBody)
 		if err != nil {
 			return err
 		}
@@ -207,7 +322,7 @@ func (f *WalockStoreSqlDb) Must(tccContext *model.TccContext, lockKey model.Lock
 		return nil
 	})
 	if err != nil {
-		log.Debug().Str("gid", tccContext.GlobalId).Str("bid", tccContext.BranchId).Err(err).Msg("tx reverted Must")
+		logger.Debug().Err(err).Msg("tx reverted Must")
 		if exemptError {
 			// do not return this error to caller
 			// this is just to revert the transaction
@@ -219,8 +334,18 @@ func (f *WalockStoreSqlDb) Must(tccContext *model.TccContext, lockKey model.Lock
 
 }
 
-func (f *WalockStoreSqlDb) Try(tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	value, err := f.LoadAndLock(f.DbRw, lockKey)
+func (f *WalockStoreSqlDb) Try(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Try", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationTry, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
+
+	value, err := f.LoadAndLock(ctx, f.DbRw, lockKey)
 	if err != nil {
 		return
 	}
@@ -234,8 +359,14 @@ func (f *WalockStoreSqlDb) Try(tccContext *model.TccContext, lockKey model.Locke
 	exemptError := false // just to revert the transaction. do not return this error to caller
 
 	err = f.DbRw.Transaction(func(tx *gorm.DB) error {
+		err = f.fence(tx, lockKey)
+		if err != nil {
+			return err
+		}
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.tccBarrierSql.BarrierTry(tccContext, tx)
+		callIt, skipped, err = f.tccBarrier().BarrierTry(tccContext, tx)
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return err
 		}
@@ -245,7 +376,7 @@ func (f *WalockStoreSqlDb) Try(tccContext *model.TccContext, lockKey model.Locke
 			return nil
 		}
 
-		tccCode, code, message, err = f.DoTry(tx, tccContext, lockKey, value, tryBody)
+		tccCode, code, message, err = f.DoTry(ctx, tx, tccContext, lockKey, value, tryBody)
 		if err != nil {
 			return err
 		}
@@ -257,7 +388,7 @@ func (f *WalockStoreSqlDb) Try(tccContext *model.TccContext, lockKey model.Locke
 		return nil
 	})
 	if err != nil {
-		log.Debug().Str("gid", tccContext.GlobalId).Str("bid", tccContext.BranchId).Err(err).Msg("tx reverted Try")
+		logger.Debug().Err(err).Msg("tx reverted Try")
 		if exemptError {
 			// do not return this error to caller
 			// this is just to revert the transaction
@@ -268,12 +399,39 @@ func (f *WalockStoreSqlDb) Try(tccContext *model.TccContext, lockKey model.Locke
 	return
 }
 
-func (f *WalockStoreSqlDb) Confirm(tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+func (f *WalockStoreSqlDb) Confirm(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Confirm", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationConfirm, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
+
+	value, err := f.LoadAndLock(ctx, f.DbRw, lockKey)
+	if err != nil {
+		return
+	}
+
+	startTime := time.Now()
+	defer func() {
+		f.Metrics.LockHoldTime.WithLabelValues(f.Metrics.MetricsName + "_must").Observe(time.Now().Sub(startTime).Seconds())
+		f.Unlock(lockKey)
+	}()
+
 	exemptError := false // just to revert the transaction. do not return this error to caller
 
 	err = f.DbRw.Transaction(func(tx *gorm.DB) error {
+		err = f.fence(tx, lockKey)
+		if err != nil {
+			return err
+		}
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.tccBarrierSql.BarrierConfirm(tccContext, tx)
+		callIt, skipped, err = f.tccBarrier().BarrierConfirm(tccContext, tx)
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return err
 		}
@@ -283,7 +441,7 @@ func (f *WalockStoreSqlDb) Confirm(tccContext *model.TccContext, lockKey model.L
 			return nil
 		}
 
-		tccCode, code, message, err = f.DoConfirm(tx, tccContext, lockKey, nil, confirmBody)
+		tccCode, code, message, err = f.DoConfirm(ctx, tx, tccContext, lockKey, value, confirmBody)
 		if err != nil {
 			return err
 		}
@@ -295,7 +453,7 @@ func (f *WalockStoreSqlDb) Confirm(tccContext *model.TccContext, lockKey model.L
 		return nil
 	})
 	if err != nil {
-		log.Debug().Str("gid", tccContext.GlobalId).Str("bid", tccContext.BranchId).Err(err).Msg("tx reverted Confirm")
+		logger.Debug().Err(err).Msg("tx reverted Confirm")
 		if exemptError {
 			// do not return this error to caller
 			// this is just to revert the transaction
@@ -306,8 +464,18 @@ func (f *WalockStoreSqlDb) Confirm(tccContext *model.TccContext, lockKey model.L
 	return
 }
 
-func (f *WalockStoreSqlDb) Cancel(tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	value, err := f.LoadAndLock(f.DbRw, lockKey)
+func (f *WalockStoreSqlDb) Cancel(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, lockKey)
+	ctx, span := f.tracer().Start(ctx, "walock.Cancel", tccSpanAttributes(tccContext, lockKey))
+	var skipped string
+	defer func() {
+		outcome := tccOutcome(tccCode, err, skipped)
+		f.Metrics.ObserveTccOutcome(consts.TccOperationCancel, outcome)
+		span.SetAttributes(attribute.String("walock.tcc.outcome", outcome))
+		endSpan(span, err)
+	}()
+
+	value, err := f.LoadAndLock(ctx, f.DbRw, lockKey)
 	if err != nil {
 		return
 	}
@@ -321,8 +489,14 @@ func (f *WalockStoreSqlDb) Cancel(tccContext *model.TccContext, lockKey model.Lo
 	exemptError := false // just to revert the transaction. do not return this error to caller
 
 	err = f.DbRw.Transaction(func(tx *gorm.DB) error {
+		err = f.fence(tx, lockKey)
+		if err != nil {
+			return err
+		}
+		_, barrierSpan := f.tracer().Start(ctx, "walock.barrier")
 		var callIt bool
-		callIt, err = f.tccBarrierSql.BarrierCancel(tccContext, tx)
+		callIt, skipped, err = f.tccBarrier().BarrierCancel(tccContext, tx)
+		endSpan(barrierSpan, err)
 		if err != nil {
 			return err
 		}
@@ -331,7 +505,7 @@ func (f *WalockStoreSqlDb) Cancel(tccContext *model.TccContext, lockKey model.Lo
 			message = "duplicate call"
 			return nil
 		}
-		tccCode, code, message, err = f.DoCancel(tx, tccContext, lockKey, value, cancelBody)
+		tccCode, code, message, err = f.DoCancel(ctx, tx, tccContext, lockKey, value, cancelBody)
 
 		if err != nil {
 			return err
@@ -345,7 +519,7 @@ func (f *WalockStoreSqlDb) Cancel(tccContext *model.TccContext, lockKey model.Lo
 		return nil
 	})
 	if err != nil {
-		log.Debug().Str("gid", tccContext.GlobalId).Str("bid", tccContext.BranchId).Err(err).Msg("tx reverted Cancel")
+		logger.Debug().Err(err).Msg("tx reverted Cancel")
 		if exemptError {
 			// do not return this error to caller
 			// this is just to revert the transaction
@@ -356,9 +530,9 @@ func (f *WalockStoreSqlDb) Cancel(tccContext *model.TccContext, lockKey model.Lo
 	return
 }
 
-func (f *WalockStoreSqlDb) Update(lockKey model.LockerKey, updatedValue model.LockerValue,
+func (f *WalockStoreSqlDb) Update(ctx context.Context, lockKey model.LockerKey, updatedValue model.LockerValue,
 	updater func(baseV, updateV model.LockerValue) (updated bool)) (err error) {
-	baseValue, err := f.LoadAndLock(f.DbRw, lockKey)
+	baseValue, err := f.LoadAndLock(ctx, f.DbRw, lockKey)
 	if err != nil {
 		return
 	}
@@ -381,33 +555,40 @@ func (f *WalockStoreSqlDb) FlushDirty() (err error) {
 
 	f.accounts.Range(func(key, value interface{}) bool {
 		total += 1
-		lock := f.ensureUserMiniLock(model.LockerKey(key.(string)))
+		lock := value.(*model.Locker)
 		lock.Mu.Lock()
 
 		defer func() {
 			lock.Mu.Unlock()
 		}()
 
+		if lock.Evicted {
+			return true
+		}
 		if lock.Value == nil {
-			log.Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
+			f.logger().Warn().Any("key", key).Msg("for some reason value is nil. maybe it is being initialized")
 			return true
 		}
 
 		if lock.Value.IsDirty() || lock.Value.GetDbVersion() != lock.Value.GetVersion() {
-			err = f.BusinessProvider.Flush(f.DbRw, lock.Value)
+			err = f.flushValue(model.LockerKey(key.(string)), lock.Value)
 			if err != nil {
-				log.Error().Err(err).Msg("failed to flush back")
 				return false
 			}
-			lock.Value.SetDbVersion(lock.Value.GetVersion())
-			lock.Value.SetDirty(false)
-
 			refreshCount++
 		}
 
 		return true
 	})
-	log.Info().Int("mapSize", total).Int("refreshCount", refreshCount).Msg("flushing back")
+	f.logger().Info().Int("mapSize", total).Int("refreshCount", refreshCount).Msg("flushing back")
+
+	if f.ActiveKeys > 0 {
+		// losing the list only costs a colder start
+		activeErr := f.saveActiveKeys(f.DbRw)
+		if activeErr != nil {
+			f.logger().Warn().Err(activeErr).Msg("failed to save active keys")
+		}
+	}
 
 	if f.Metrics.MetricsMapCount != nil {
 		f.Metrics.MetricsMapCount.Set(float64(total))
@@ -416,9 +597,28 @@ func (f *WalockStoreSqlDb) FlushDirty() (err error) {
 	return
 }
 
-func (f *WalockStoreSqlDb) DoMust(tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	log.Trace().Str("tcc", tccContext.String()).Msg("DoMust")
+// flushValue persists a cached value through the business provider. The caller holds the key lock.
+func (f *WalockStoreSqlDb) flushValue(key model.LockerKey, value model.LockerValue) (err error) {
+	flushStartTime := time.Now()
+	err = f.fenced(f.DbRw, key, func(tx *gorm.DB) error {
+		return f.BusinessProvider.Flush(tx, value)
+	})
+	f.Metrics.ObserveFlush(flushStartTime)
+	if err != nil {
+		f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to flush back")
+		return
+	}
+	value.SetDbVersion(value.GetVersion())
+	value.SetDirty(false)
+	return
+}
+
+func (f *WalockStoreSqlDb) DoMust(ctx context.Context, tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, key)
+	logger.Trace().Msg("DoMust")
+	_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
 	ok, code, message, mustWali, err := f.BusinessProvider.GenerateWalMust(tccContext, key, value, mustBody)
+	endSpan(generateSpan, err)
 	if err != nil {
 		return
 	}
@@ -428,25 +628,31 @@ func (f *WalockStoreSqlDb) DoMust(tx *gorm.DB, tccContext *model.TccContext, key
 	}
 
 	//write wal first
+	_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+	writeStartTime := time.Now()
+	stampSeq(value, mustWali)
+	f.stampEpoch(key, mustWali)
 	err = f.BusinessProvider.FlushWal(tx, mustWali)
+	f.Metrics.ObserveWalWrite(writeStartTime)
+	endSpan(writeSpan, err)
 	if err != nil {
 		return
 	}
 
-	// update memory
-	err = f.BusinessProvider.ApplyWal(value, []interface{}{mustWali})
-	if err != nil {
-		log.Panic().Err(err).Msg("failed to apply mustWali")
-		return
-	}
+	// update memory. on failure the value is rebuilt from the committed wal on next access
+	_, applySpan := f.tracer().Start(ctx, "walock.apply")
+	endSpan(applySpan, f.applyWal(key, value, []interface{}{mustWali}))
 
 	tccCode = consts.TccCode_Success
 	return
 }
 
-func (f *WalockStoreSqlDb) DoTry(tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	log.Trace().Str("tcc", tccContext.String()).Msg("DoTry")
+func (f *WalockStoreSqlDb) DoTry(ctx context.Context, tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, key)
+	logger.Trace().Msg("DoTry")
+	_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
 	ok, code, message, tryWali, err := f.BusinessProvider.GenerateWalTry(tccContext, key, value, tryBody)
+	endSpan(generateSpan, err)
 	if err != nil {
 		return
 	}
@@ -456,23 +662,27 @@ func (f *WalockStoreSqlDb) DoTry(tx *gorm.DB, tccContext *model.TccContext, key
 	}
 
 	// write wal first
+	_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+	writeStartTime := time.Now()
+	stampSeq(value, tryWali)
+	f.stampEpoch(key, tryWali)
 	err = f.BusinessProvider.FlushWal(tx, tryWali)
+	f.Metrics.ObserveWalWrite(writeStartTime)
+	endSpan(writeSpan, err)
 	if err != nil {
 		return
 	}
 
-	// update memory
-	err = f.BusinessProvider.ApplyWal(value, []interface{}{tryWali})
-	if err != nil {
-		log.Panic().Err(err).Msg("failed to apply tryWali")
-		return
-	}
+	// update memory. on failure the value is rebuilt from the committed wal on next access
+	_, applySpan := f.tracer().Start(ctx, "walock.apply")
+	endSpan(applySpan, f.applyWal(key, value, []interface{}{tryWali}))
 	tccCode = consts.TccCode_Success
 	return
 }
 
-func (f *WalockStoreSqlDb) DoConfirm(tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	log.Trace().Str("tcc", tccContext.String()).Msg("DoConfirm")
+func (f *WalockStoreSqlDb) DoConfirm(ctx context.Context, tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, key)
+	logger.Trace().Msg("DoConfirm")
 
 	// check if reserved resource is there.
 	reservationWali, ok, code, message, err := f.BusinessProvider.LoadReservation(tx, tccContext)
@@ -485,30 +695,36 @@ func (f *WalockStoreSqlDb) DoConfirm(tx *gorm.DB, tccContext *model.TccContext,
 		return
 	}
 
+	_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
 	confirmWali := f.BusinessProvider.GenerateWalConfirm(tccContext, key, value, reservationWali)
+	generateSpan.End()
 	if confirmWali == nil {
 		tccCode = consts.TccCode_Success
 		return
 	}
 
 	// write wal first
+	_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+	writeStartTime := time.Now()
+	stampSeq(value, confirmWali)
+	f.stampEpoch(key, confirmWali)
 	err = f.BusinessProvider.FlushWal(tx, confirmWali)
+	f.Metrics.ObserveWalWrite(writeStartTime)
+	endSpan(writeSpan, err)
 	if err != nil {
 		return
 	}
 
-	// update memory
-	err = f.BusinessProvider.ApplyWal(value, []interface{}{confirmWali})
-	if err != nil {
-		log.Panic().Err(err).Msg("failed to apply confirmWali")
-		return
-	}
+	// update memory. on failure the value is rebuilt from the committed wal on next access
+	_, applySpan := f.tracer().Start(ctx, "walock.apply")
+	endSpan(applySpan, f.applyWal(key, value, []interface{}{confirmWali}))
 	tccCode = consts.TccCode_Success
 	return
 }
 
-func (f *WalockStoreSqlDb) DoCancel(tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
-	log.Trace().Str("tcc", tccContext.String()).Msg("DoCancel")
+func (f *WalockStoreSqlDb) DoCancel(ctx context.Context, tx *gorm.DB, tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	logger := callLogger(f.logger(), tccContext, key)
+	logger.Trace().Msg("DoCancel")
 
 	// check if reserved resource is there.
 	reservationWali, ok, code, message, err := f.BusinessProvider.LoadReservation(tx, tccContext)
@@ -517,24 +733,29 @@ func (f *WalockStoreSqlDb) DoCancel(tx *gorm.DB, tccContext *model.TccContext, k
 		return
 	}
 
+	_, generateSpan := f.tracer().Start(ctx, "walock.wal.generate")
 	revertWali := f.BusinessProvider.GenerateWalCancel(tccContext, key, value, reservationWali)
+	generateSpan.End()
 	if revertWali == nil {
 		tccCode = consts.TccCode_Success
 		return
 	}
 
 	// write wal first
+	_, writeSpan := f.tracer().Start(ctx, "walock.wal.write")
+	writeStartTime := time.Now()
+	stampSeq(value, revertWali)
+	f.stampEpoch(key, revertWali)
 	err = f.BusinessProvider.FlushWal(tx, revertWali)
+	f.Metrics.ObserveWalWrite(writeStartTime)
+	endSpan(writeSpan, err)
 	if err != nil {
 		return
 	}
 
-	// update memory
-	err = f.BusinessProvider.ApplyWal(value, []interface{}{revertWali})
-	if err != nil {
-		log.Panic().Err(err).Msg("failed to apply reservationWali")
-		return
-	}
+	// update memory. on failure the value is rebuilt from the committed wal on next access
+	_, applySpan := f.tracer().Start(ctx, "walock.apply")
+	endSpan(applySpan, f.applyWal(key, value, []interface{}{revertWali}))
 	tccCode = consts.TccCode_Success
 	return
 }
@@ -0,0 +1,97 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// frozenSqlProvider applies no WAL, leaving the version of the account behind
+type frozenSqlProvider struct {
+	*balance.SqlProvider
+}
+
+func (p *frozenSqlProvider) ApplyWal(load model.LockerValue, walis []interface{}) error {
+	return nil
+}
+
+func TestSqlWalSeq(t *testing.T) {
+	fixture, err := walocktest.NewSqlFixture(openSqlite(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTcc(t, fixture.Store)
+
+	var seqs []uint64
+	err = fixture.Db.Table(fixture.Provider.WalTableName).Where("lock_key = ?", "alice").Order("id").Pluck("seq", &seqs).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{1, 2, 3}) {
+		t.Fatalf("alice has wals %v", seqs)
+	}
+	value, err := fixture.Store.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := value.GetVersion(); version != 3 {
+		t.Fatalf("alice at version %d", version)
+	}
+}
+
+func TestSqlWalChain(t *testing.T) {
+	ctx := context.Background()
+	t.Run("gap", func(t *testing.T) {
+		db := openSqlite(t)
+		fixture, err := walocktest.NewSqlFixture(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tccCode, _, _, err := fixture.Store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+		if err != nil || tccCode != consts.TccCode_Success {
+			t.Fatalf("Must = %d, %v", tccCode, err)
+		}
+		err = db.Table(fixture.Provider.WalTableName).Create(&balance.WalRecord{
+			LockKey: "alice", Seq: 3, Op: balance.OpMust, GlobalId: "g2", BranchId: "b1", Amount: 5, CreateTime: time.Now(),
+		}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a store with a cold cache replays the wals from the persisted account
+		restarted, err := walocktest.NewSqlFixture(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = restarted.Store.Get(ctx, "alice")
+		var chainErr *walock.WalChainError
+		if !errors.As(err, &chainErr) || chainErr.Expected != 2 || chainErr.Found != 3 {
+			t.Fatalf("Get over a wal gap = %v", err)
+		}
+	})
+	t.Run("version not moved", func(t *testing.T) {
+		fixture, err := walocktest.NewSqlFixture(openSqlite(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixture.Store.BusinessProvider = &frozenSqlProvider{SqlProvider: fixture.Provider}
+
+		// the wal is committed and the cached value dropped
+		tccCode, _, _, err := fixture.Store.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+		if err != nil || tccCode != consts.TccCode_Success {
+			t.Fatalf("Must = %d, %v", tccCode, err)
+		}
+		_, err = fixture.Store.Get(ctx, "alice")
+		var chainErr *walock.WalChainError
+		if !errors.As(err, &chainErr) || chainErr.Expected != 1 || chainErr.Found != 0 {
+			t.Fatalf("Get after a wal left the version behind = %v", err)
+		}
+	})
+}
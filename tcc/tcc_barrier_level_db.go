@@ -2,44 +2,84 @@ package tcc
 
 import (
 	"errors"
+	"github.com/latifrons/walock/consts"
 	"github.com/latifrons/walock/model"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type TccBarrierLevelDb struct {
+	Logger *zerolog.Logger // optional. defaults to the global zerolog logger
 }
 
-func (f *TccBarrierLevelDb) CheckBarrierMust(tx model.LevelDbStoreOperator, mustKey []byte) (callIt bool, err error) {
+func (f *TccBarrierLevelDb) InitDefault() {
+	if f.Logger == nil {
+		f.Logger = &log.Logger
+	}
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (f *TccBarrierLevelDb) logger() *zerolog.Logger {
+	if f.Logger == nil {
+		return &log.Logger
+	}
+	return f.Logger
+}
+
+// CheckBarrierMust
+// skipped tells why the call should be skipped when callIt is false
+func (f *TccBarrierLevelDb) CheckBarrierMust(tx model.KvStoreOperator, mustKey []byte) (callIt bool, skipped string, err error) {
 	// 如果是Try分支，则那么insert ignore插入gid-branchid-try，如果成功插入，则调用屏障内逻辑
 	set, _, err := CheckNX(tx, mustKey)
 	if err != nil {
 		return
 	}
 	callIt = set
+	if !callIt {
+		skipped = consts.TccOutcomeDuplicate
+	}
 	return
 }
 
-func (f *TccBarrierLevelDb) CheckBarrierTry(tx model.LevelDbStoreOperator, tryKey []byte) (callIt bool, err error) {
+// CheckBarrierTry
+// A skipped Try is hanging-rejected if cancelKey exists, a duplicate otherwise
+func (f *TccBarrierLevelDb) CheckBarrierTry(tx model.KvStoreOperator, tryKey []byte, cancelKey []byte) (callIt bool, skipped string, err error) {
 	// 如果是Try分支，则那么insert ignore插入gid-branchid-try，如果成功插入，则调用屏障内逻辑
 	set, _, err := CheckNX(tx, tryKey)
 	if err != nil {
 		return
 	}
 	callIt = set
+	if callIt {
+		return
+	}
+	notCancelled, _, err := CheckNX(tx, cancelKey)
+	if err != nil {
+		return
+	}
+	if notCancelled {
+		skipped = consts.TccOutcomeDuplicate
+	} else {
+		skipped = consts.TccOutcomeHangingRejected
+	}
+	f.logger().Debug().Str("barrier", string(tryKey)).Str("skipped", skipped).Msg("try skipped by barrier")
 	return
 }
-func (f *TccBarrierLevelDb) CheckBarrierConfirm(tx model.LevelDbStoreOperator, confirmKey []byte) (callIt bool, err error) {
+
+func (f *TccBarrierLevelDb) CheckBarrierConfirm(tx model.KvStoreOperator, confirmKey []byte) (callIt bool, skipped string, err error) {
 	// 如果是Confirm分支，那么insert ignore插入gid-branchid-confirm，如果成功插入，则调用屏障内逻辑
 	set, _, err := CheckNX(tx, confirmKey)
 	if err != nil {
 		return
 	}
 	callIt = set
+	if !callIt {
+		skipped = consts.TccOutcomeDuplicate
+	}
 	return
 }
 
-func (f *TccBarrierLevelDb) CheckBarrierCancel(tx model.LevelDbStoreOperator, tryKey []byte, cancelKey []byte) (callIt bool, err error) {
+func (f *TccBarrierLevelDb) CheckBarrierCancel(tx model.KvStoreOperator, tryKey []byte, cancelKey []byte) (callIt bool, skipped string, err error) {
 	// 如果是Cancel分支，那么insert ignore插入gid-branchid-try，再插入gid-branchid-cancel，如果try未插入并且cancel插入成功，则调用屏障内逻辑
 	set, _, err := CheckNX(tx, tryKey)
 	if err != nil {
@@ -47,6 +87,8 @@ func (f *TccBarrierLevelDb) CheckBarrierCancel(tx model.LevelDbStoreOperator, tr
 	}
 	if set {
 		// try分支插入成功，直接返回
+		skipped = consts.TccOutcomeEmptyRollback
+		f.logger().Debug().Str("barrier", string(cancelKey)).Msg("empty rollback")
 		return
 	}
 
@@ -57,18 +99,19 @@ func (f *TccBarrierLevelDb) CheckBarrierCancel(tx model.LevelDbStoreOperator, tr
 	}
 	if set {
 		callIt = true
+	} else {
+		skipped = consts.TccOutcomeDuplicate
 	}
 	return
 }
 
 // CheckNX
 // It returns true if the key does not exist and false if it does exist
-func CheckNX(tx model.LevelDbStoreOperator, key []byte) (notExists bool, value []byte, err error) {
+func CheckNX(tx model.KvStoreOperator, key []byte) (notExists bool, value []byte, err error) {
 	// Try to get the existing value
-	log.Debug()
-	value, err = tx.Get(key, nil)
+	value, err = tx.Get(key)
 	if err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
+		if errors.Is(err, model.ErrNotFound) {
 			// Key does not exist, set the new value
 			notExists = true
 			err = nil
@@ -87,17 +130,17 @@ func CheckNX(tx model.LevelDbStoreOperator, key []byte) (notExists bool, value [
 
 // SetNX sets a key in the database if it does not exist
 // It returns true if the key was set, or false if it already existed
-func SetNX(tx model.LevelDbStoreOperator, key []byte, setValue []byte) (set bool, value []byte, err error) {
-	log.Debug().Str("key", string(key)).Msg("Get LevelDB")
+func SetNX(logger *zerolog.Logger, tx model.KvStoreOperator, key []byte, setValue []byte) (set bool, value []byte, err error) {
+	logger.Debug().Str("key", string(key)).Msg("Get LevelDB")
 
 	// Try to get the existing value
-	value, err = tx.Get(key, nil)
+	value, err = tx.Get(key)
 	if err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
+		if errors.Is(err, model.ErrNotFound) {
 			// Key does not exist, set the new value
 			set = true
-			log.Debug().Str("key", string(key)).Msg("Put LevelDB")
-			err = tx.Put(key, setValue, nil)
+			logger.Debug().Str("key", string(key)).Msg("Put LevelDB")
+			err = tx.Put(key, setValue)
 			if err != nil {
 				return
 			}
@@ -3,22 +3,51 @@ package tcc
 import (
 	"github.com/latifrons/walock/consts"
 	"github.com/latifrons/walock/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
 type TccBarrierSql struct {
-	BarrierName string
-	DbTableName string
+	BarrierName  string
+	DbTableName  string
+	Logger       *zerolog.Logger   // optional. defaults to the global zerolog logger
+	InsertIgnore clause.Expression // optional. defaults to MySQL INSERT IGNORE. use clause.OnConflict{DoNothing: true} on SQLite or PostgreSQL
+}
+
+func (f *TccBarrierSql) InitDefault() {
+	if f.Logger == nil {
+		f.Logger = &log.Logger
+	}
+	if f.InsertIgnore == nil {
+		f.InsertIgnore = clause.Insert{Modifier: "IGNORE"}
+	}
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (f *TccBarrierSql) logger() *zerolog.Logger {
+	if f.Logger == nil {
+		return &log.Logger
+	}
+	return f.Logger
+}
+
+// insertIgnore returns InsertIgnore, or MySQL INSERT IGNORE if InitDefault was not called
+func (f *TccBarrierSql) insertIgnore() clause.Expression {
+	if f.InsertIgnore == nil {
+		return clause.Insert{Modifier: "IGNORE"}
+	}
+	return f.InsertIgnore
 }
 
 // BarrierMust is protected by a lockKey level mutex
-func (f *TccBarrierSql) BarrierMust(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, err error) {
+func (f *TccBarrierSql) BarrierMust(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
 	pbtx := persistentContext.(*gorm.DB)
 
 	// 如果是Try分支，则那么insert ignore插入gid-branchid-try，如果成功插入，则调用屏障内逻辑
 	v := BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, consts.TccBranchTypeMust)
-	result := pbtx.Clauses(clause.Insert{Modifier: "IGNORE"}).Table(f.DbTableName).Create(&v)
+	result := pbtx.Clauses(f.insertIgnore()).Table(f.DbTableName).Create(&v)
 
 	if result.Error != nil {
 		err = result.Error
@@ -28,16 +57,17 @@ func (f *TccBarrierSql) BarrierMust(tccHeader *model.TccContext, persistentConte
 		callIt = true
 		return
 	}
+	skipped = consts.TccOutcomeDuplicate
 	return
 }
 
 // BarrierTry is protected by a lockKey level mutex
-func (f *TccBarrierSql) BarrierTry(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, err error) {
+func (f *TccBarrierSql) BarrierTry(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
 	pbtx := persistentContext.(*gorm.DB)
 
 	// 如果是Try分支，则那么insert ignore插入gid-branchid-try，如果成功插入，则调用屏障内逻辑
 	v := BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, consts.TccBranchTypeTry)
-	result := pbtx.Clauses(clause.Insert{Modifier: "IGNORE"}).Table(f.DbTableName).Create(&v)
+	result := pbtx.Clauses(f.insertIgnore()).Table(f.DbTableName).Create(&v)
 
 	if result.Error != nil {
 		err = result.Error
@@ -47,16 +77,30 @@ func (f *TccBarrierSql) BarrierTry(tccHeader *model.TccContext, persistentContex
 		callIt = true
 		return
 	}
+
+	// skipped either way. a Try arriving after the Cancel of its branch is hanging-rejected
+	vCancel := BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, consts.TccBranchTypeCancel)
+	var count int64
+	err = pbtx.Table(f.DbTableName).Where(clause.Eq{Column: clause.Column{Name: "key"}, Value: vCancel.Key}).Count(&count).Error
+	if err != nil {
+		return
+	}
+	if count != 0 {
+		skipped = consts.TccOutcomeHangingRejected
+	} else {
+		skipped = consts.TccOutcomeDuplicate
+	}
+	f.logger().Debug().Str("tcc", tccHeader.String()).Str("skipped", skipped).Msg("try skipped by barrier")
 	return
 }
 
 // BarrierConfirm is protected by a lockKey level mutex
-func (f *TccBarrierSql) BarrierConfirm(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, err error) {
+func (f *TccBarrierSql) BarrierConfirm(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
 	pbtx := persistentContext.(*gorm.DB)
 
 	// 如果是Confirm分支，那么insert ignore插入gid-branchid-confirm，如果成功插入，则调用屏障内逻辑
 	v := BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, consts.TccBranchTypeConfirm)
-	result := pbtx.Clauses(clause.Insert{Modifier: "IGNORE"}).Table(f.DbTableName).Create(&v)
+	result := pbtx.Clauses(f.insertIgnore()).Table(f.DbTableName).Create(&v)
 
 	if result.Error != nil {
 		err = result.Error
@@ -64,29 +108,33 @@ func (f *TccBarrierSql) BarrierConfirm(tccHeader *model.TccContext, persistentCo
 	}
 	if result.RowsAffected == 1 {
 		callIt = true
+		return
 	}
+	skipped = consts.TccOutcomeDuplicate
 	return
 }
 
 // BarrierCancel is protected by a lockKey level mutex
-func (f *TccBarrierSql) BarrierCancel(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, err error) {
+func (f *TccBarrierSql) BarrierCancel(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
 	pbtx := persistentContext.(*gorm.DB)
 
 	// 如果是Cancel分支，那么insert ignore插入gid-branchid-try，再插入gid-branchid-cancel，如果try未插入并且cancel插入成功，则调用屏障内逻辑
 	v := BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, consts.TccBranchTypeTry)
-	result := pbtx.Clauses(clause.Insert{Modifier: "IGNORE"}).Table(f.DbTableName).Create(&v)
+	result := pbtx.Clauses(f.insertIgnore()).Table(f.DbTableName).Create(&v)
 
 	if result.Error != nil {
 		err = result.Error
 		return
 	}
 	if result.RowsAffected != 0 { // must be 0 to continue
+		skipped = consts.TccOutcomeEmptyRollback
+		f.logger().Debug().Str("tcc", tccHeader.String()).Msg("empty rollback")
 		return
 	}
 
 	// check if the branch is cancelled
 	v = BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, consts.TccBranchTypeCancel)
-	result = pbtx.Clauses(clause.Insert{Modifier: "IGNORE"}).Table(f.DbTableName).Create(&v)
+	result = pbtx.Clauses(f.insertIgnore()).Table(f.DbTableName).Create(&v)
 
 	if result.Error != nil {
 		err = result.Error
@@ -94,7 +142,8 @@ func (f *TccBarrierSql) BarrierCancel(tccHeader *model.TccContext, persistentCon
 	}
 	if result.RowsAffected == 1 {
 		callIt = true
+		return
 	}
-
+	skipped = consts.TccOutcomeDuplicate
 	return
 }
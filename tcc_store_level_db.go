@@ -0,0 +1,28 @@
+package walock
+
+import (
+	"context"
+	"github.com/latifrons/walock/model"
+)
+
+// LevelDbTccStore binds a WalockStoreLevelDb to the operator it writes to, so that it can be used as a TccStore
+type LevelDbTccStore struct {
+	Store *WalockStoreLevelDb
+	Tx    model.KvStoreOperator
+}
+
+func (s *LevelDbTccStore) Try(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	return s.Store.Try(ctx, s.Tx, tccContext, lockKey, tryBody)
+}
+
+func (s *LevelDbTccStore) Confirm(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	return s.Store.Confirm(ctx, s.Tx, tccContext, lockKey, confirmBody)
+}
+
+func (s *LevelDbTccStore) Cancel(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	return s.Store.Cancel(ctx, s.Tx, tccContext, lockKey, cancelBody)
+}
+
+func (s *LevelDbTccStore) Must(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (tccCode model.TccCode, code string, message string, err error) {
+	return s.Store.Must(ctx, s.Tx, tccContext, lockKey, mustBody)
+}
@@ -0,0 +1,134 @@
+package tccgrpc
+
+import (
+	"context"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tccgrpc/tccpb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BodyDecoder converts the opaque request body into what the business provider expects.
+// branchType is one of consts.TccBranchType*.
+type BodyDecoder func(branchType string, body []byte) (interface{}, error)
+
+// TccServer serves tccpb.TccServiceServer on top of a walock.TccStore.
+// Business failures are returned as codes.Aborted with the TccResponse attached as status detail,
+// so that the caller (usually the TCC coordinator) does not retry them.
+type TccServer struct {
+	tccpb.UnimplementedTccServiceServer
+
+	Store       walock.TccStore // injected by outside to serve the calls
+	BodyDecoder BodyDecoder     // optional. raw []byte is passed to the store if nil
+	Logger      *zerolog.Logger // optional. defaults to the global zerolog logger
+}
+
+func (s *TccServer) InitDefault() {
+	if s.Logger == nil {
+		s.Logger = &log.Logger
+	}
+}
+
+// logger returns Logger, or the global zerolog logger if InitDefault was not called
+func (s *TccServer) logger() *zerolog.Logger {
+	if s.Logger == nil {
+		return &log.Logger
+	}
+	return s.Logger
+}
+
+func (s *TccServer) Try(ctx context.Context, req *tccpb.TccRequest) (*tccpb.TccResponse, error) {
+	return s.handle(ctx, req, consts.TccBranchTypeTry, s.Store.Try)
+}
+
+func (s *TccServer) Confirm(ctx context.Context, req *tccpb.TccRequest) (*tccpb.TccResponse, error) {
+	return s.handle(ctx, req, consts.TccBranchTypeConfirm, s.Store.Confirm)
+}
+
+func (s *TccServer) Cancel(ctx context.Context, req *tccpb.TccRequest) (*tccpb.TccResponse, error) {
+	return s.handle(ctx, req, consts.TccBranchTypeCancel, s.Store.Cancel)
+}
+
+func (s *TccServer) Must(ctx context.Context, req *tccpb.TccRequest) (*tccpb.TccResponse, error) {
+	return s.handle(ctx, req, consts.TccBranchTypeMust, s.Store.Must)
+}
+
+type tccCall func(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, body interface{}) (tccCode model.TccCode, code string, message string, err error)
+
+func (s *TccServer) handle(ctx context.Context, req *tccpb.TccRequest, branchType string, call tccCall) (*tccpb.TccResponse, error) {
+	if req.GetGlobalId() == "" || req.GetBranchId() == "" || req.GetLockKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "global_id, branch_id and lock_key are required")
+	}
+
+	var body interface{} = req.GetBody()
+	if s.BodyDecoder != nil {
+		var err error
+		body, err = s.BodyDecoder(branchType, req.GetBody())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "failed to decode body: "+err.Error())
+		}
+	}
+
+	tccContext := &model.TccContext{
+		GlobalId: req.GetGlobalId(),
+		BranchId: req.GetBranchId(),
+	}
+
+	tccCode, code, message, err := call(ctx, tccContext, model.LockerKey(req.GetLockKey()), body)
+	if err != nil {
+		s.logger().Error().Err(err).Str("tcc", tccContext.String()).Str("branchType", branchType).Msg("tcc call failed")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &tccpb.TccResponse{
+		TccCode: int32(tccCode),
+		Code:    code,
+		Message: message,
+	}
+	st := ToStatus(resp)
+	if st.Code() != codes.OK {
+		return nil, st.Err()
+	}
+	return resp, nil
+}
+
+// ToStatus maps a TccResponse to the gRPC status returned to the caller.
+func ToStatus(resp *tccpb.TccResponse) *status.Status {
+	var c codes.Code
+	switch model.TccCode(resp.GetTccCode()) {
+	case consts.TccCode_Success:
+		return status.New(codes.OK, "")
+	case consts.TccCode_Failed:
+		c = codes.Aborted
+	case consts.TccCode_Timeout:
+		c = codes.DeadlineExceeded
+	default:
+		c = codes.Unknown
+	}
+
+	st := status.New(c, resp.GetCode()+": "+resp.GetMessage())
+	detailed, err := st.WithDetails(resp)
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+// FromStatus extracts the TccResponse from an error returned by a TccServiceClient.
+// ok is false if err does not carry a TccResponse, e.g. transport or internal errors.
+func FromStatus(err error) (resp *tccpb.TccResponse, ok bool) {
+	st, isStatus := status.FromError(err)
+	if !isStatus {
+		return
+	}
+	for _, d := range st.Details() {
+		if r, isResp := d.(*tccpb.TccResponse); isResp {
+			return r, true
+		}
+	}
+	return
+}
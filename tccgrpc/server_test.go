@@ -0,0 +1,167 @@
+package tccgrpc
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tccgrpc/tccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+)
+
+// stubStore answers every call with the outcome configured for its lock key and records the calls
+type stubStore struct {
+	calls    []string
+	outcomes map[model.LockerKey]stubOutcome
+}
+
+type stubOutcome struct {
+	tccCode model.TccCode
+	code    string
+	message string
+	err     error
+}
+
+func (s *stubStore) call(branchType string, tccContext *model.TccContext, lockKey model.LockerKey, body interface{}) (model.TccCode, string, string, error) {
+	s.calls = append(s.calls, branchType+" "+tccContext.String()+" "+string(lockKey)+" "+string(body.([]byte)))
+	o := s.outcomes[lockKey]
+	return o.tccCode, o.code, o.message, o.err
+}
+
+func (s *stubStore) Try(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, tryBody interface{}) (model.TccCode, string, string, error) {
+	return s.call(consts.TccBranchTypeTry, tccContext, lockKey, tryBody)
+}
+
+func (s *stubStore) Confirm(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, confirmBody interface{}) (model.TccCode, string, string, error) {
+	return s.call(consts.TccBranchTypeConfirm, tccContext, lockKey, confirmBody)
+}
+
+func (s *stubStore) Cancel(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, cancelBody interface{}) (model.TccCode, string, string, error) {
+	return s.call(consts.TccBranchTypeCancel, tccContext, lockKey, cancelBody)
+}
+
+func (s *stubStore) Must(ctx context.Context, tccContext *model.TccContext, lockKey model.LockerKey, mustBody interface{}) (model.TccCode, string, string, error) {
+	return s.call(consts.TccBranchTypeMust, tccContext, lockKey, mustBody)
+}
+
+// dial serves tccServer over an in-memory connection and returns a client of it
+func dial(t *testing.T, tccServer *TccServer) tccpb.TccServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	tccpb.RegisterTccServiceServer(server, tccServer)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return tccpb.NewTccServiceClient(conn)
+}
+
+func TestTccServerRoundTrip(t *testing.T) {
+	store := &stubStore{outcomes: map[model.LockerKey]stubOutcome{
+		"ok":      {tccCode: consts.TccCode_Success, code: "ok", message: "done"},
+		"failed":  {tccCode: consts.TccCode_Failed, code: "insufficient", message: "not enough balance"},
+		"timeout": {tccCode: consts.TccCode_Timeout, code: "timeout", message: "too late"},
+		"unknown": {tccCode: 42, code: "odd", message: "unexpected"},
+		"broken":  {err: errors.New("disk is gone")},
+	}}
+	tccServer := &TccServer{Store: store}
+	tccServer.InitDefault()
+	client := dial(t, tccServer)
+	ctx := context.Background()
+
+	methods := []struct {
+		branchType string
+		call       func(ctx context.Context, in *tccpb.TccRequest, opts ...grpc.CallOption) (*tccpb.TccResponse, error)
+	}{
+		{consts.TccBranchTypeTry, client.Try},
+		{consts.TccBranchTypeConfirm, client.Confirm},
+		{consts.TccBranchTypeCancel, client.Cancel},
+		{consts.TccBranchTypeMust, client.Must},
+	}
+	cases := []struct {
+		lockKey  string
+		code     codes.Code
+		detailed bool
+	}{
+		{"ok", codes.OK, false},
+		{"failed", codes.Aborted, true},
+		{"timeout", codes.DeadlineExceeded, true},
+		{"unknown", codes.Unknown, true},
+		{"broken", codes.Internal, false},
+	}
+	for _, m := range methods {
+		for _, c := range cases {
+			t.Run(m.branchType+"/"+c.lockKey, func(t *testing.T) {
+				store.calls = nil
+				resp, err := m.call(ctx, &tccpb.TccRequest{GlobalId: "g1", BranchId: "b1", LockKey: c.lockKey, Body: []byte("body")})
+				if len(store.calls) != 1 {
+					t.Fatalf("store got %d calls, want 1", len(store.calls))
+				}
+				want := m.branchType + " g1-b1 " + c.lockKey + " body"
+				if store.calls[0] != want {
+					t.Fatalf("store got %q, want %q", store.calls[0], want)
+				}
+				if got := status.Code(err); got != c.code {
+					t.Fatalf("status code %v, want %v (err %v)", got, c.code, err)
+				}
+
+				outcome := store.outcomes[model.LockerKey(c.lockKey)]
+				if c.code == codes.OK {
+					if resp.GetCode() != outcome.code || resp.GetMessage() != outcome.message {
+						t.Fatalf("response %v, want %+v", resp, outcome)
+					}
+					return
+				}
+				detail, ok := FromStatus(err)
+				if ok != c.detailed {
+					t.Fatalf("FromStatus ok = %v, want %v", ok, c.detailed)
+				}
+				if ok && (model.TccCode(detail.GetTccCode()) != outcome.tccCode || detail.GetCode() != outcome.code || detail.GetMessage() != outcome.message) {
+					t.Fatalf("detail %v, want %+v", detail, outcome)
+				}
+			})
+		}
+	}
+}
+
+func TestTccServerInvalidArgument(t *testing.T) {
+	store := &stubStore{}
+	tccServer := &TccServer{Store: store}
+	tccServer.InitDefault()
+	client := dial(t, tccServer)
+
+	_, err := client.Try(context.Background(), &tccpb.TccRequest{GlobalId: "g1", LockKey: "ok"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("status code %v, want InvalidArgument", status.Code(err))
+	}
+	if len(store.calls) != 0 {
+		t.Fatalf("store got %d calls, want 0", len(store.calls))
+	}
+}
+
+func TestTccServerWithoutInitDefault(t *testing.T) {
+	store := &stubStore{outcomes: map[model.LockerKey]stubOutcome{"broken": {err: errors.New("disk is gone")}}}
+	client := dial(t, &TccServer{Store: store})
+
+	_, err := client.Cancel(context.Background(), &tccpb.TccRequest{GlobalId: "g1", BranchId: "b1", LockKey: "broken", Body: []byte("body")})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("status code %v, want Internal", status.Code(err))
+	}
+}
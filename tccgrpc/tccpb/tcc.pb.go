@@ -0,0 +1,229 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: tcc.proto
+
+package tccpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type TccRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	GlobalId      string                 `protobuf:"bytes,1,opt,name=global_id,json=globalId,proto3" json:"global_id,omitempty"`
+	BranchId      string                 `protobuf:"bytes,2,opt,name=branch_id,json=branchId,proto3" json:"branch_id,omitempty"`
+	LockKey       string                 `protobuf:"bytes,3,opt,name=lock_key,json=lockKey,proto3" json:"lock_key,omitempty"`
+	Body          []byte                 `protobuf:"bytes,4,opt,name=body,proto3" json:"body,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TccRequest) Reset() {
+	*x = TccRequest{}
+	mi := &file_tcc_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TccRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TccRequest) ProtoMessage() {}
+
+func (x *TccRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tcc_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TccRequest.ProtoReflect.Descriptor instead.
+func (*TccRequest) Descriptor() ([]byte, []int) {
+	return file_tcc_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *TccRequest) GetGlobalId() string {
+	if x != nil {
+		return x.GlobalId
+	}
+	return ""
+}
+
+func (x *TccRequest) GetBranchId() string {
+	if x != nil {
+		return x.BranchId
+	}
+	return ""
+}
+
+func (x *TccRequest) GetLockKey() string {
+	if x != nil {
+		return x.LockKey
+	}
+	return ""
+}
+
+func (x *TccRequest) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+type TccResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TccCode       int32                  `protobuf:"varint,1,opt,name=tcc_code,json=tccCode,proto3" json:"tcc_code,omitempty"`
+	Code          string                 `protobuf:"bytes,2,opt,name=code,proto3" json:"code,omitempty"`
+	Message       string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TccResponse) Reset() {
+	*x = TccResponse{}
+	mi := &file_tcc_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TccResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TccResponse) ProtoMessage() {}
+
+func (x *TccResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tcc_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TccResponse.ProtoReflect.Descriptor instead.
+func (*TccResponse) Descriptor() ([]byte, []int) {
+	return file_tcc_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *TccResponse) GetTccCode() int32 {
+	if x != nil {
+		return x.TccCode
+	}
+	return 0
+}
+
+func (x *TccResponse) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+func (x *TccResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+var File_tcc_proto protoreflect.FileDescriptor
+
+const file_tcc_proto_rawDesc = "" +
+	"\n" +
+	"\ttcc.proto\x12\rwalock.tcc.v1\"u\n" +
+	"\n" +
+	"TccRequest\x12\x1b\n" +
+	"\tglobal_id\x18\x01 \x01(\tR\bglobalId\x12\x1b\n" +
+	"\tbranch_id\x18\x02 \x01(\tR\bbranchId\x12\x19\n" +
+	"\block_key\x18\x03 \x01(\tR\alockKey\x12\x12\n" +
+	"\x04body\x18\x04 \x01(\fR\x04body\"V\n" +
+	"\vTccResponse\x12\x19\n" +
+	"\btcc_code\x18\x01 \x01(\x05R\atccCode\x12\x12\n" +
+	"\x04code\x18\x02 \x01(\tR\x04code\x12\x18\n" +
+	"\amessage\x18\x03 \x01(\tR\amessage2\x8c\x02\n" +
+	"\n" +
+	"TccService\x12<\n" +
+	"\x03Try\x12\x19.walock.tcc.v1.TccRequest\x1a\x1a.walock.tcc.v1.TccResponse\x12@\n" +
+	"\aConfirm\x12\x19.walock.tcc.v1.TccRequest\x1a\x1a.walock.tcc.v1.TccResponse\x12?\n" +
+	"\x06Cancel\x12\x19.walock.tcc.v1.TccRequest\x1a\x1a.walock.tcc.v1.TccResponse\x12=\n" +
+	"\x04Must\x12\x19.walock.tcc.v1.TccRequest\x1a\x1a.walock.tcc.v1.TccResponseB+Z)github.com/latifrons/walock/tccgrpc/tccpbb\x06proto3"
+
+var (
+	file_tcc_proto_rawDescOnce sync.Once
+	file_tcc_proto_rawDescData []byte
+)
+
+func file_tcc_proto_rawDescGZIP() []byte {
+	file_tcc_proto_rawDescOnce.Do(func() {
+		file_tcc_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_tcc_proto_rawDesc), len(file_tcc_proto_rawDesc)))
+	})
+	return file_tcc_proto_rawDescData
+}
+
+var file_tcc_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_tcc_proto_goTypes = []any{
+	(*TccRequest)(nil),  // 0: walock.tcc.v1.TccRequest
+	(*TccResponse)(nil), // 1: walock.tcc.v1.TccResponse
+}
+var file_tcc_proto_depIdxs = []int32{
+	0, // 0: walock.tcc.v1.TccService.Try:input_type -> walock.tcc.v1.TccRequest
+	0, // 1: walock.tcc.v1.TccService.Confirm:input_type -> walock.tcc.v1.TccRequest
+	0, // 2: walock.tcc.v1.TccService.Cancel:input_type -> walock.tcc.v1.TccRequest
+	0, // 3: walock.tcc.v1.TccService.Must:input_type -> walock.tcc.v1.TccRequest
+	1, // 4: walock.tcc.v1.TccService.Try:output_type -> walock.tcc.v1.TccResponse
+	1, // 5: walock.tcc.v1.TccService.Confirm:output_type -> walock.tcc.v1.TccResponse
+	1, // 6: walock.tcc.v1.TccService.Cancel:output_type -> walock.tcc.v1.TccResponse
+	1, // 7: walock.tcc.v1.TccService.Must:output_type -> walock.tcc.v1.TccResponse
+	4, // [4:8] is the sub-list for method output_type
+	0, // [0:4] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_tcc_proto_init() }
+func file_tcc_proto_init() {
+	if File_tcc_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_tcc_proto_rawDesc), len(file_tcc_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_tcc_proto_goTypes,
+		DependencyIndexes: file_tcc_proto_depIdxs,
+		MessageInfos:      file_tcc_proto_msgTypes,
+	}.Build()
+	File_tcc_proto = out.File
+	file_tcc_proto_goTypes = nil
+	file_tcc_proto_depIdxs = nil
+}
@@ -0,0 +1,235 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: tcc.proto
+
+package tccpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	TccService_Try_FullMethodName     = "/walock.tcc.v1.TccService/Try"
+	TccService_Confirm_FullMethodName = "/walock.tcc.v1.TccService/Confirm"
+	TccService_Cancel_FullMethodName  = "/walock.tcc.v1.TccService/Cancel"
+	TccService_Must_FullMethodName    = "/walock.tcc.v1.TccService/Must"
+)
+
+// TccServiceClient is the client API for TccService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TccServiceClient interface {
+	Try(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error)
+	Confirm(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error)
+	Cancel(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error)
+	Must(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error)
+}
+
+type tccServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTccServiceClient(cc grpc.ClientConnInterface) TccServiceClient {
+	return &tccServiceClient{cc}
+}
+
+func (c *tccServiceClient) Try(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TccResponse)
+	err := c.cc.Invoke(ctx, TccService_Try_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tccServiceClient) Confirm(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TccResponse)
+	err := c.cc.Invoke(ctx, TccService_Confirm_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tccServiceClient) Cancel(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TccResponse)
+	err := c.cc.Invoke(ctx, TccService_Cancel_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tccServiceClient) Must(ctx context.Context, in *TccRequest, opts ...grpc.CallOption) (*TccResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TccResponse)
+	err := c.cc.Invoke(ctx, TccService_Must_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TccServiceServer is the server API for TccService service.
+// All implementations must embed UnimplementedTccServiceServer
+// for forward compatibility.
+type TccServiceServer interface {
+	Try(context.Context, *TccRequest) (*TccResponse, error)
+	Confirm(context.Context, *TccRequest) (*TccResponse, error)
+	Cancel(context.Context, *TccRequest) (*TccResponse, error)
+	Must(context.Context, *TccRequest) (*TccResponse, error)
+	mustEmbedUnimplementedTccServiceServer()
+}
+
+// UnimplementedTccServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTccServiceServer struct{}
+
+func (UnimplementedTccServiceServer) Try(context.Context, *TccRequest) (*TccResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Try not implemented")
+}
+func (UnimplementedTccServiceServer) Confirm(context.Context, *TccRequest) (*TccResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Confirm not implemented")
+}
+func (UnimplementedTccServiceServer) Cancel(context.Context, *TccRequest) (*TccResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Cancel not implemented")
+}
+func (UnimplementedTccServiceServer) Must(context.Context, *TccRequest) (*TccResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Must not implemented")
+}
+func (UnimplementedTccServiceServer) mustEmbedUnimplementedTccServiceServer() {}
+func (UnimplementedTccServiceServer) testEmbeddedByValue()                    {}
+
+// UnsafeTccServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TccServiceServer will
+// result in compilation errors.
+type UnsafeTccServiceServer interface {
+	mustEmbedUnimplementedTccServiceServer()
+}
+
+func RegisterTccServiceServer(s grpc.ServiceRegistrar, srv TccServiceServer) {
+	// If the following call pancis, it indicates UnimplementedTccServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&TccService_ServiceDesc, srv)
+}
+
+func _TccService_Try_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TccRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TccServiceServer).Try(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TccService_Try_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TccServiceServer).Try(ctx, req.(*TccRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TccService_Confirm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TccRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TccServiceServer).Confirm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TccService_Confirm_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TccServiceServer).Confirm(ctx, req.(*TccRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TccService_Cancel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TccRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TccServiceServer).Cancel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TccService_Cancel_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TccServiceServer).Cancel(ctx, req.(*TccRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TccService_Must_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TccRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TccServiceServer).Must(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TccService_Must_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TccServiceServer).Must(ctx, req.(*TccRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// TccService_ServiceDesc is the grpc.ServiceDesc for TccService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var TccService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "walock.tcc.v1.TccService",
+	HandlerType: (*TccServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Try",
+			Handler:    _TccService_Try_Handler,
+		},
+		{
+			MethodName: "Confirm",
+			Handler:    _TccService_Confirm_Handler,
+		},
+		{
+			MethodName: "Cancel",
+			Handler:    _TccService_Cancel_Handler,
+		},
+		{
+			MethodName: "Must",
+			Handler:    _TccService_Must_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "tcc.proto",
+}
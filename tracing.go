@@ -0,0 +1,31 @@
+package walock
+
+import (
+	"github.com/latifrons/walock/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TracerName = "github.com/latifrons/walock"
+
+func defaultTracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+func tccSpanAttributes(tccContext *model.TccContext, lockKey model.LockerKey) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("walock.tcc.global_id", tccContext.GlobalId),
+		attribute.String("walock.tcc.branch_id", tccContext.BranchId),
+		attribute.String("walock.lock_key", string(lockKey)),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,154 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+// failingKv fails every batch write once err is set
+type failingKv struct {
+	*memkv.MemKv
+	err error
+}
+
+func (o *failingKv) Write(batch *model.KvBatch) error {
+	if o.err != nil {
+		return o.err
+	}
+	return o.MemKv.Write(batch)
+}
+
+func tracedFixture(t *testing.T) (*walocktest.LevelDbFixture, *tracetest.SpanRecorder) {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	f := walocktest.NewLevelDbFixture()
+	f.Store.Tracer = provider.Tracer("walock-test")
+	f.Provider.SetPersisted(walocktest.Account{Key: "alice", Available: 100})
+	return f, recorder
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	m := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		m[s.Name()] = s
+	}
+	return m
+}
+
+func attributesOf(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestTracingTry(t *testing.T) {
+	f, recorder := tracedFixture(t)
+	tccCode, _, _, err := f.Store.Try(context.Background(), f.Kv, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+	if err != nil || tccCode != consts.TccCode_Success {
+		t.Fatalf("Try = %d, %v", tccCode, err)
+	}
+
+	spans := spansByName(recorder.Ended())
+	root, ok := spans["walock.Try"]
+	if !ok {
+		t.Fatalf("no walock.Try span in %v", spans)
+	}
+	attrs := attributesOf(root)
+	want := map[attribute.Key]string{
+		"walock.tcc.global_id": "g1",
+		"walock.tcc.branch_id": "b1",
+		"walock.lock_key":      "alice",
+		"walock.tcc.outcome":   consts.TccOutcomeSuccess,
+	}
+	for k, v := range want {
+		if attrs[k].AsString() != v {
+			t.Errorf("walock.Try %s = %q, want %q", k, attrs[k].AsString(), v)
+		}
+	}
+	if root.Status().Code != codes.Unset {
+		t.Errorf("walock.Try status %v, want Unset", root.Status())
+	}
+
+	for _, name := range []string{"walock.lock", "walock.load", "walock.barrier", "walock.wal.generate", "walock.wal.write", "walock.apply"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of walock.Try", name)
+		}
+		if s.Status().Code != codes.Unset {
+			t.Errorf("%s status %v, want Unset", name, s.Status())
+		}
+	}
+	if attributesOf(spans["walock.lock"])["walock.lock_key"].AsString() != "alice" {
+		t.Errorf("walock.lock has no lock key")
+	}
+}
+
+func TestTracingBusinessFailure(t *testing.T) {
+	f, recorder := tracedFixture(t)
+	tccCode, _, _, err := f.Store.Try(context.Background(), f.Kv, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(300))
+	if err != nil || tccCode != consts.TccCode_Failed {
+		t.Fatalf("Try = %d, %v", tccCode, err)
+	}
+
+	root := spansByName(recorder.Ended())["walock.Try"]
+	if got := attributesOf(root)["walock.tcc.outcome"].AsString(); got != consts.TccOutcomeBusinessFailed {
+		t.Errorf("walock.Try outcome %q, want %q", got, consts.TccOutcomeBusinessFailed)
+	}
+	// a business failure is an answer, not an error
+	if root.Status().Code != codes.Unset {
+		t.Errorf("walock.Try status %v, want Unset", root.Status())
+	}
+}
+
+func TestTracingError(t *testing.T) {
+	f, recorder := tracedFixture(t)
+	writeErr := errors.New("disk is gone")
+	kv := &failingKv{MemKv: f.Kv, err: writeErr}
+	_, _, _, err := f.Store.Try(context.Background(), kv, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+	if !errors.Is(err, writeErr) {
+		t.Fatalf("Try err = %v, want %v", err, writeErr)
+	}
+
+	spans := spansByName(recorder.Ended())
+	for _, name := range []string{"walock.Try", "walock.wal.write"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if s.Status().Code != codes.Error || s.Status().Description != writeErr.Error() {
+			t.Errorf("%s status %v, want Error %q", name, s.Status(), writeErr)
+		}
+		recorded := false
+		for _, e := range s.Events() {
+			recorded = recorded || e.Name == "exception"
+		}
+		if !recorded {
+			t.Errorf("%s has no exception event", name)
+		}
+	}
+	if got := attributesOf(spans["walock.Try"])["walock.tcc.outcome"].AsString(); got != consts.TccOutcomeSystemError {
+		t.Errorf("walock.Try outcome %q, want %q", got, consts.TccOutcomeSystemError)
+	}
+	if _, ok := spans["walock.apply"]; ok {
+		t.Errorf("walock.apply traced after a failed write")
+	}
+}
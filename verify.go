@@ -0,0 +1,96 @@
+package walock
+
+import (
+	"github.com/latifrons/walock/model"
+	"gorm.io/gorm"
+	"reflect"
+)
+
+// ValueComparator tells whether the replayed value matches the persisted one
+type ValueComparator func(persisted, replayed model.LockerValue) bool
+
+// DefaultValueComparator compares the values field by field
+func DefaultValueComparator(persisted, replayed model.LockerValue) bool {
+	return reflect.DeepEqual(persisted, replayed)
+}
+
+type VerifyResult struct {
+	Key       model.LockerKey
+	Persisted model.LockerValue // snapshot loaded by the business provider
+	Replayed  model.LockerValue // snapshot + the WALs above its version. nil if Err is set
+	Updated   bool              // whether catchup applied any WAL
+	Match     bool
+	Err       error
+}
+
+// VerifyWals replays the WALs above the persisted version of each key onto a scratch copy of the persisted value,
+// as a Get would, and compares it with the persisted value. WALs already folded into the snapshot are not replayed,
+// so a mismatch is a key with unflushed WALs, or WALs which do not apply. It neither touches the cached values nor takes the key locks, so it is meant to run against an offline copy of the database.
+// Only mismatching keys are returned. tx may be read-only.
+func (f *WalockStoreLevelDb) VerifyWals(tx model.KvStoreOperator, keys []model.LockerKey, equal ValueComparator) (mismatches []VerifyResult, err error) {
+	if equal == nil {
+		equal = DefaultValueComparator
+	}
+	for _, key := range keys {
+		result := VerifyResult{Key: key}
+
+		result.Persisted, err = f.BusinessProvider.LoadPersistedValue(key)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to load from persist")
+			return
+		}
+
+		// load again as scratch so that the persisted snapshot is kept intact
+		var scratch model.LockerValue
+		scratch, err = f.BusinessProvider.LoadPersistedValue(key)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to load from persist")
+			return
+		}
+
+		result.Updated, result.Err = f.catchupWals(tx, key, scratch)
+		if result.Err == nil {
+			result.Replayed = scratch
+			result.Match = equal(result.Persisted, result.Replayed)
+		}
+		if !result.Match {
+			mismatches = append(mismatches, result)
+		}
+	}
+	return
+}
+
+// VerifyWals replays the WALs above the persisted version of each key onto a scratch copy of the persisted value
+// and compares it with the persisted value. See WalockStoreLevelDb.VerifyWals. Only mismatching keys are returned.
+func (f *WalockStoreSqlDb) VerifyWals(tx *gorm.DB, keys []model.LockerKey, equal ValueComparator) (mismatches []VerifyResult, err error) {
+	if equal == nil {
+		equal = DefaultValueComparator
+	}
+	for _, key := range keys {
+		result := VerifyResult{Key: key}
+
+		result.Persisted, err = f.BusinessProvider.LoadPersistedValue(tx, key)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to load from persist")
+			return
+		}
+
+		var scratch model.LockerValue
+		scratch, err = f.BusinessProvider.LoadPersistedValue(tx, key)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to load from persist")
+			return
+		}
+
+		result.Err = f.catchupWals(tx, key, scratch)
+		if result.Err == nil {
+			result.Replayed = scratch
+			result.Updated = scratch.GetVersion() != result.Persisted.GetVersion()
+			result.Match = equal(result.Persisted, result.Replayed)
+		}
+		if !result.Match {
+			mismatches = append(mismatches, result)
+		}
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"testing"
+	"time"
+)
+
+func TestVerifyWalsLevelDb(t *testing.T) {
+	kv := &memkv.MemKv{}
+	store := newEngineStore(kv, false)
+	tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+	tccCode, _, _, err := tccStore.Must(context.Background(), &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	mustTcc(t, "Must", tccCode, err)
+
+	// the wal of alice is not flushed yet. bob has none
+	keys := []model.LockerKey{"alice", "bob"}
+	mismatches, err := newEngineStore(kv, false).VerifyWals(kv, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Key != "alice" || !mismatches[0].Updated || mismatches[0].Err != nil ||
+		mismatches[0].Replayed.(*balance.Account).Available != 100 || mismatches[0].Persisted.(*balance.Account).Available != 0 {
+		t.Fatalf("VerifyWals before the flush = %+v", mismatches)
+	}
+
+	// the flushed snapshot holds the wal, which is not replayed again
+	if err = store.FlushDirty(kv); err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err = newEngineStore(kv, false).VerifyWals(kv, keys, nil)
+	if err != nil || len(mismatches) != 0 {
+		t.Fatalf("VerifyWals after the flush = %+v, %v", mismatches, err)
+	}
+
+	// a wal which does not decode is reported with its error
+	if err = kv.Put([]byte(walock.WalKey("alice", 2)), []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err = newEngineStore(kv, false).VerifyWals(kv, keys, nil)
+	var corruption *walock.WalCorruptionError
+	if err != nil || len(mismatches) != 1 || mismatches[0].Replayed != nil || !errors.As(mismatches[0].Err, &corruption) {
+		t.Fatalf("VerifyWals over a corrupted wal = %+v, %v", mismatches, err)
+	}
+}
+
+func TestVerifyWalsSql(t *testing.T) {
+	db := openSqlite(t)
+	fixture, err := walocktest.NewSqlFixture(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tccCode, _, _, err := fixture.Store.Must(context.Background(), &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	mustTcc(t, "Must", tccCode, err)
+
+	keys := []model.LockerKey{"alice", "bob"}
+	verify := func() []walock.VerifyResult {
+		t.Helper()
+		restarted, err := walocktest.NewSqlFixture(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mismatches, err := restarted.Store.VerifyWals(db, keys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mismatches
+	}
+
+	if mismatches := verify(); len(mismatches) != 1 || mismatches[0].Key != "alice" || !mismatches[0].Updated ||
+		mismatches[0].Err != nil || mismatches[0].Replayed.(*balance.Account).Available != 100 {
+		t.Fatalf("VerifyWals before the flush = %+v", mismatches)
+	}
+
+	if err = fixture.Store.FlushDirty(); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches := verify(); len(mismatches) != 0 {
+		t.Fatalf("VerifyWals after the flush = %+v", mismatches)
+	}
+
+	// a wal past a gap breaks the chain
+	err = db.Table(fixture.Provider.WalTableName).Create(&balance.WalRecord{
+		LockKey: "alice", Seq: 3, Op: balance.OpMust, GlobalId: "g2", BranchId: "b1", Amount: 5, CreateTime: time.Now(),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chainErr *walock.WalChainError
+	if mismatches := verify(); len(mismatches) != 1 || mismatches[0].Replayed != nil || !errors.As(mismatches[0].Err, &chainErr) {
+		t.Fatalf("VerifyWals over a wal gap = %+v", mismatches)
+	}
+}
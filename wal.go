@@ -0,0 +1,115 @@
+package walock
+
+import (
+	"fmt"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"strconv"
+	"strings"
+)
+
+// WALs of WalockStoreLevelDb live under consts.WalKeyPrefix + lock key + "#" + zero padded seq,
+// so that a prefix scan returns the WALs of a key in seq order.
+// The seq of a WAL is the version of the value once the WAL is applied: the chain of a key is version+1, version+2, ...
+
+const walSeqDigits = 20
+
+// WalKey is the KV key of the WAL of the lock key with the seq
+func WalKey(key model.LockerKey, seq uint64) string {
+	return fmt.Sprintf("%s%s#%0*d", consts.WalKeyPrefix, key, walSeqDigits, seq)
+}
+
+func walKeyPrefix(key model.LockerKey) []byte {
+	return []byte(consts.WalKeyPrefix + string(key) + "#")
+}
+
+// ParseWalKey splits a key built by WalKey
+func ParseWalKey(walKey string) (key model.LockerKey, seq uint64, err error) {
+	i := strings.LastIndex(walKey, "#")
+	if !strings.HasPrefix(walKey, consts.WalKeyPrefix) || i < len(consts.WalKeyPrefix) || len(walKey)-i-1 != walSeqDigits {
+		err = fmt.Errorf("not a wal key: %s", walKey)
+		return
+	}
+	seq, err = strconv.ParseUint(walKey[i+1:], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("not a wal key: %s", walKey)
+		return
+	}
+	key = model.LockerKey(walKey[len(consts.WalKeyPrefix):i])
+	return
+}
+
+// ScanWals calls fun in seq order with the WALs of the lock key whose seq is above after, until fun returns false.
+// WalBytes are passed as stored, in their envelope, and copied out of the scan so that fun may keep them.
+func ScanWals(tx model.KvStoreOperator, key model.LockerKey, after uint64, fun func(wal model.Wal) bool) (err error) {
+	var parseErr error
+	err = tx.Scan(walKeyPrefix(key), func(k, v []byte) bool {
+		var walKey model.LockerKey
+		var seq uint64
+		walKey, seq, parseErr = ParseWalKey(string(k))
+		if parseErr != nil {
+			return false
+		}
+		if walKey != key || seq <= after {
+			// a lock key containing "#" shares the prefix
+			return true
+		}
+		// the engine may reuse v once the callback returns
+		return fun(model.Wal{Key: string(k), Seq: seq, WalBytes: append([]byte(nil), v...)})
+	})
+	if err == nil {
+		err = parseErr
+	}
+	return
+}
+
+// catchupWals applies the WALs above the version of value, which must form an unbroken chain.
+// A panic of the business provider is returned as a PanicError.
+func (f *WalockStoreLevelDb) catchupWals(tx model.KvStoreOperator, key model.LockerKey, value model.LockerValue) (updated bool, err error) {
+	err = f.checkLegacyWals(tx)
+	if err != nil {
+		return
+	}
+	version := value.GetVersion()
+	var wals []model.Wal
+	var openErr error
+	err = ScanWals(tx, key, version, func(wal model.Wal) bool {
+		openErr = f.openWal(&wal)
+		wals = append(wals, wal)
+		return openErr == nil
+	})
+	if err == nil {
+		err = openErr
+	}
+	if err != nil {
+		return
+	}
+	for i, wal := range wals {
+		if wal.Seq != version+uint64(i)+1 {
+			err = &WalChainError{Key: key, Expected: version + uint64(i) + 1, Found: wal.Seq}
+			return
+		}
+	}
+	if len(wals) == 0 {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+	f.BusinessProvider.MustApplyWal(value, wals)
+	if value.GetVersion() != wals[len(wals)-1].Seq {
+		err = &WalChainError{Key: key, Expected: wals[len(wals)-1].Seq, Found: value.GetVersion()}
+		return
+	}
+	updated = true
+	return
+}
+
+// nextWal places the WAL generated by the business provider right after the version of value
+func nextWal(key model.LockerKey, value model.LockerValue, wal *model.Wal) {
+	wal.Seq = value.GetVersion() + 1
+	wal.Key = WalKey(key, wal.Seq)
+}
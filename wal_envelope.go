@@ -0,0 +1,225 @@
+package walock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walcodec"
+	"hash/crc32"
+	"time"
+)
+
+// A WAL written by WalockStoreLevelDb is framed as
+//
+//	version 1: magic "WL" | 1 | CRC32C uint32 | unix nano int64 | branch type | global id | branch id | payload
+//	version 2: magic "WL" | 2 | CRC32C uint32 | codec uint8 | unix nano int64 | branch type | global id | branch id | payload
+//	version 3: magic "WL" | 3 | CRC32C uint32 | codec uint8 | flags uint8 | unix nano int64 | ... as version 2
+//
+// Integers are big endian. The three strings are prefixed with their uvarint length. The CRC covers everything after it.
+// The codec is a walcodec id. Version 1 carries none: a typed WAL in it is JSON, as written before the codecs.
+// Flag walEnvelopeEncrypted marks a payload encrypted by the store. The header stays in clear for inspection.
+
+const (
+	WalEnvelopeVersion1   uint8 = 1
+	WalEnvelopeVersion2   uint8 = 2
+	WalEnvelopeVersion3   uint8 = 3
+	walEnvelopeHeaderSize       = 2 + 1 + 4
+
+	walEnvelopeEncrypted uint8 = 1 << 0
+)
+
+var (
+	walEnvelopeMagic = [2]byte{'W', 'L'}
+	castagnoli       = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WalCorruptionError is returned when a WAL read back from the KV store fails the envelope checks
+type WalCorruptionError struct {
+	Key    string
+	Reason string
+}
+
+func (e *WalCorruptionError) Error() string {
+	return fmt.Sprintf("wal %s corrupted: %s", e.Key, e.Reason)
+}
+
+// EncodeWalEnvelope frames the envelope in its Version, the latest one if 0.
+// Codec is dropped in version 1. Encrypted payloads need version 3.
+func EncodeWalEnvelope(envelope *model.WalEnvelope) (b []byte, err error) {
+	version := envelope.Version
+	if version == 0 {
+		version = WalEnvelopeVersion3
+	}
+	if envelope.Encrypted && version < WalEnvelopeVersion3 {
+		err = fmt.Errorf("wal envelope version %d cannot hold an encrypted payload", version)
+		return
+	}
+	b = make([]byte, walEnvelopeHeaderSize, walEnvelopeHeaderSize+2+8+3*binary.MaxVarintLen64+
+		len(envelope.BranchType)+len(envelope.TccContext.GlobalId)+len(envelope.TccContext.BranchId)+len(envelope.Payload))
+	b[0], b[1] = walEnvelopeMagic[0], walEnvelopeMagic[1]
+	b[2] = version
+	if version >= WalEnvelopeVersion2 {
+		b = append(b, envelope.Codec)
+	}
+	if version >= WalEnvelopeVersion3 {
+		var flags uint8
+		if envelope.Encrypted {
+			flags |= walEnvelopeEncrypted
+		}
+		b = append(b, flags)
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(envelope.Time.UnixNano()))
+	for _, s := range []string{envelope.BranchType, envelope.TccContext.GlobalId, envelope.TccContext.BranchId} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	b = append(b, envelope.Payload...)
+	binary.BigEndian.PutUint32(b[3:walEnvelopeHeaderSize], crc32.Checksum(b[walEnvelopeHeaderSize:], castagnoli))
+	return
+}
+
+// IsWalEnvelope tells whether b starts like an envelope. It does not verify it.
+func IsWalEnvelope(b []byte) bool {
+	return len(b) >= 2 && b[0] == walEnvelopeMagic[0] && b[1] == walEnvelopeMagic[1]
+}
+
+// DecodeWalEnvelope verifies and unframes the WAL stored under key
+func DecodeWalEnvelope(key string, b []byte) (envelope *model.WalEnvelope, err error) {
+	corrupted := func(format string, a ...interface{}) (*model.WalEnvelope, error) {
+		return nil, &WalCorruptionError{Key: key, Reason: fmt.Sprintf(format, a...)}
+	}
+	if len(b) < walEnvelopeHeaderSize {
+		return corrupted("%d bytes is shorter than the header", len(b))
+	}
+	if !IsWalEnvelope(b) {
+		return corrupted("bad magic %x", b[:2])
+	}
+	if b[2] < WalEnvelopeVersion1 || b[2] > WalEnvelopeVersion3 {
+		return corrupted("unknown format version %d", b[2])
+	}
+	if sum := crc32.Checksum(b[walEnvelopeHeaderSize:], castagnoli); sum != binary.BigEndian.Uint32(b[3:walEnvelopeHeaderSize]) {
+		return corrupted("checksum mismatch")
+	}
+
+	rest := b[walEnvelopeHeaderSize:]
+	var codec uint8
+	if b[2] >= WalEnvelopeVersion2 {
+		if len(rest) < 1 {
+			return corrupted("truncated codec")
+		}
+		codec, rest = rest[0], rest[1:]
+	}
+	var flags uint8
+	if b[2] >= WalEnvelopeVersion3 {
+		if len(rest) < 1 {
+			return corrupted("truncated flags")
+		}
+		flags, rest = rest[0], rest[1:]
+	}
+	if len(rest) < 8 {
+		return corrupted("truncated timestamp")
+	}
+	envelope = &model.WalEnvelope{
+		Version:   b[2],
+		Codec:     codec,
+		Encrypted: flags&walEnvelopeEncrypted != 0,
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(rest))),
+	}
+	rest = rest[8:]
+	var fields [3]string
+	for i := range fields {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || uint64(len(rest)-size) < n {
+			return corrupted("truncated header field %d", i)
+		}
+		fields[i] = string(rest[size : size+int(n)])
+		rest = rest[size+int(n):]
+	}
+	envelope.BranchType = fields[0]
+	envelope.TccContext = model.TccContext{GlobalId: fields[1], BranchId: fields[2]}
+	envelope.Payload = rest
+	return
+}
+
+// writeCodec returns the codec typed WALs are written with: the one of the store, or JSON in version 1 envelopes
+func (f *WalockStoreLevelDb) writeCodec() walcodec.WalCodec {
+	if f.WalEnvelopeVersion == WalEnvelopeVersion1 {
+		return walcodec.Json{}
+	}
+	return f.walCodec()
+}
+
+// encodeWal marshals the typed WAL of the business provider with the write codec of the store.
+// WalBytes marshalled by the provider are kept as is.
+func (f *WalockStoreLevelDb) encodeWal(wal *model.Wal) (err error) {
+	if wal.Value == nil || wal.WalBytes != nil {
+		return
+	}
+	wal.WalBytes, err = f.writeCodec().Marshal(wal.Value)
+	return
+}
+
+// sealWal returns the WalBytes wrapped in an envelope, encrypted if the store has a KeyProvider
+func (f *WalockStoreLevelDb) sealWal(wal model.Wal, tccContext *model.TccContext, branchType string) (b []byte, err error) {
+	envelope := &model.WalEnvelope{
+		Version:    f.WalEnvelopeVersion,
+		Codec:      walcodec.CodecRaw,
+		Time:       time.Now(),
+		TccContext: *tccContext,
+		BranchType: branchType,
+		Payload:    wal.WalBytes,
+	}
+	if wal.Value != nil {
+		envelope.Codec = f.writeCodec().Id()
+	}
+	if f.KeyProvider != nil {
+		envelope.Encrypted = true
+		envelope.Payload, err = f.encrypt(wal.Key, wal.WalBytes)
+		if err != nil {
+			return
+		}
+	}
+	return EncodeWalEnvelope(envelope)
+}
+
+// openWal replaces the WalBytes read back from the KV store by the payload of the envelope,
+// and decodes it into Value if the business provider is a WalFactory.
+// WALs written before the envelope are passed through as is if the store accepts them.
+func (f *WalockStoreLevelDb) openWal(wal *model.Wal) (err error) {
+	if f.AcceptLegacyWals && !IsWalEnvelope(wal.WalBytes) {
+		return
+	}
+	envelope, err := DecodeWalEnvelope(wal.Key, wal.WalBytes)
+	if err != nil {
+		return
+	}
+	wal.WalBytes = envelope.Payload
+	if envelope.Encrypted {
+		wal.WalBytes, err = f.decrypt(wal.Key, envelope.Payload)
+		if err != nil {
+			return
+		}
+	}
+
+	factory, ok := f.BusinessProvider.(WalFactory)
+	if !ok {
+		return
+	}
+	codec := f.walCodec()
+	switch {
+	case envelope.Version == WalEnvelopeVersion1:
+		codec = walcodec.Json{}
+	case envelope.Codec != walcodec.CodecRaw:
+		codec, err = walcodec.ById(envelope.Codec)
+		if err != nil {
+			return &WalCorruptionError{Key: wal.Key, Reason: err.Error()}
+		}
+	}
+	value := factory.NewWal()
+	err = codec.Unmarshal(wal.WalBytes, value)
+	if err != nil {
+		return &WalCorruptionError{Key: wal.Key, Reason: fmt.Sprintf("%s codec: %v", codec.Name(), err)}
+	}
+	wal.Value = value
+	return
+}
@@ -0,0 +1,125 @@
+package walock_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walcodec"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEnvelope = model.WalEnvelope{
+	Codec:      walcodec.CodecMsgpack,
+	Time:       time.Unix(0, 1700000000123456789),
+	TccContext: model.TccContext{GlobalId: "g1", BranchId: "b1"},
+	BranchType: consts.TccBranchTypeTry,
+	Payload:    []byte("payload"),
+}
+
+// reseal recomputes the CRC of b, so that the other checks are reached
+func reseal(b []byte) []byte {
+	b = append([]byte(nil), b...)
+	binary.BigEndian.PutUint32(b[3:7], crc32.Checksum(b[7:], crc32.MakeTable(crc32.Castagnoli)))
+	return b
+}
+
+func TestWalEnvelopeRoundTrip(t *testing.T) {
+	versions := []struct {
+		version   uint8
+		codec     uint8
+		encrypted bool
+	}{
+		{walock.WalEnvelopeVersion1, 0, false}, // version 1 carries no codec
+		{walock.WalEnvelopeVersion2, walcodec.CodecMsgpack, false},
+		{walock.WalEnvelopeVersion3, walcodec.CodecMsgpack, false},
+		{walock.WalEnvelopeVersion3, walcodec.CodecMsgpack, true},
+	}
+	for _, v := range versions {
+		envelope := testEnvelope
+		envelope.Version = v.version
+		envelope.Encrypted = v.encrypted
+		b, err := walock.EncodeWalEnvelope(&envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := walock.DecodeWalEnvelope("WAL-alice#1", b)
+		if err != nil {
+			t.Fatalf("version %d: %v", v.version, err)
+		}
+		want := envelope
+		want.Codec = v.codec
+		if !reflect.DeepEqual(*decoded, want) {
+			t.Fatalf("version %d decoded as %+v, want %+v", v.version, *decoded, want)
+		}
+	}
+
+	// the latest version by default. an encrypted payload needs it
+	b, err := walock.EncodeWalEnvelope(&testEnvelope)
+	if err != nil || b[2] != walock.WalEnvelopeVersion3 {
+		t.Fatalf("default version %d, %v", b[2], err)
+	}
+	envelope := testEnvelope
+	envelope.Version, envelope.Encrypted = walock.WalEnvelopeVersion2, true
+	if _, err = walock.EncodeWalEnvelope(&envelope); err == nil {
+		t.Fatal("encoded an encrypted payload in version 2")
+	}
+}
+
+func TestDecodeWalEnvelopeCorruption(t *testing.T) {
+	valid, err := walock.EncodeWalEnvelope(&testEnvelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withVersion := func(version uint8) []byte {
+		b := append([]byte(nil), valid...)
+		b[2] = version
+		return b
+	}
+	cases := []struct {
+		name   string
+		b      []byte
+		reason string
+	}{
+		{"empty", nil, "shorter than the header"},
+		{"short header", valid[:6], "shorter than the header"},
+		{"bad magic", append([]byte("WX"), valid[2:]...), "bad magic"},
+		{"version 0", withVersion(0), "unknown format version 0"},
+		{"version 4", withVersion(4), "unknown format version 4"},
+		{"checksum mismatch", append(append([]byte(nil), valid[:len(valid)-1]...), valid[len(valid)-1]^1), "checksum mismatch"},
+		// magic, version and CRC take 7 bytes, then codec, flags, an 8 bytes timestamp and
+		// "T", "g1" and "b1", each after its length
+		{"no codec", reseal(valid[:7]), "truncated codec"},
+		{"no flags", reseal(valid[:8]), "truncated flags"},
+		{"no timestamp", reseal(valid[:9]), "truncated timestamp"},
+		{"truncated timestamp", reseal(valid[:16]), "truncated timestamp"},
+		{"no branch type", reseal(valid[:17]), "truncated header field 0"},
+		{"truncated branch type", reseal(valid[:18]), "truncated header field 0"},
+		{"no global id", reseal(valid[:19]), "truncated header field 1"},
+		{"truncated global id", reseal(valid[:21]), "truncated header field 1"},
+		{"no branch id", reseal(valid[:22]), "truncated header field 2"},
+		{"truncated branch id", reseal(valid[:24]), "truncated header field 2"},
+	}
+	for _, c := range cases {
+		_, err := walock.DecodeWalEnvelope("WAL-alice#1", c.b)
+		var corruption *walock.WalCorruptionError
+		if !errors.As(err, &corruption) || corruption.Key != "WAL-alice#1" || !strings.Contains(corruption.Reason, c.reason) {
+			t.Errorf("%s: %v, want a WalCorruptionError on WAL-alice#1: %s", c.name, err, c.reason)
+		}
+	}
+
+	// the header ends right before the payload, which may be empty
+	envelope, err := walock.DecodeWalEnvelope("WAL-alice#1", reseal(valid[:25]))
+	if err != nil || len(envelope.Payload) != 0 || envelope.TccContext.BranchId != "b1" {
+		t.Fatalf("envelope without payload = %+v, %v", envelope, err)
+	}
+	if !bytes.Equal(valid[25:], testEnvelope.Payload) {
+		t.Fatalf("payload at %q", valid[25:])
+	}
+}
@@ -0,0 +1,98 @@
+package walock
+
+import (
+	"errors"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"time"
+)
+
+// Before the store numbered WALs under WalKey, the business provider chose the WAL keys and caught them up itself,
+// with versions of its own. Those WALs are invisible to catchupWals. MigrateLegacyWals folds them once into the
+// persisted values, so that the store numbers the next WALs from there.
+
+// MigrateLegacyWals applies and deletes the legacy WALs of a LegacyWalMigrator provider, persisting the values they
+// lead to, then marks the KV store as migrated. Run it before serving, while no value is cached. It does nothing for
+// other providers, or once the KV store is marked. A migration stopped by a crash can be run again: the legacy WALs
+// of a key are only deleted after its value is persisted, and those below the persisted version are skipped.
+func (f *WalockStoreLevelDb) MigrateLegacyWals(tx model.KvStoreOperator) (migrated int, err error) {
+	migrator, ok := f.BusinessProvider.(LegacyWalMigrator)
+	if !ok {
+		return
+	}
+	done, err := legacyWalsMigrated(tx)
+	if err != nil || done {
+		return
+	}
+	startTime := time.Now()
+	keys, err := migrator.LegacyWalKeys(tx)
+	if err != nil {
+		f.logger().Error().Err(err).Msg("failed to list legacy wals")
+		return
+	}
+	for _, key := range keys {
+		err = f.migrateLegacyWals(tx, migrator, key)
+		if err != nil {
+			f.logger().Error().Err(err).Str("key", string(key)).Msg("failed to migrate legacy wals")
+			return
+		}
+		migrated++
+	}
+	err = tx.Put([]byte(consts.LegacyWalsMigratedKey), []byte{})
+	if err != nil {
+		return
+	}
+	f.legacyWalsDone.Store(true)
+	f.logger().Info().Int("keys", migrated).Dur("took", time.Since(startTime)).Msg("legacy wals migrated")
+	return
+}
+
+func (f *WalockStoreLevelDb) migrateLegacyWals(tx model.KvStoreOperator, migrator LegacyWalMigrator, key model.LockerKey) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+	value, err := f.BusinessProvider.LoadPersistedValue(key)
+	if err != nil {
+		return
+	}
+	updated, err := migrator.CatchupLegacyWals(tx, key, value)
+	if err != nil {
+		return
+	}
+	if updated {
+		err = f.BusinessProvider.PersistValue(value)
+		if err != nil {
+			return
+		}
+	}
+	return migrator.DeleteLegacyWals(tx, key)
+}
+
+// checkLegacyWals returns ErrLegacyWalsNotMigrated while a LegacyWalMigrator provider has not been migrated
+func (f *WalockStoreLevelDb) checkLegacyWals(tx model.KvStoreOperator) (err error) {
+	if f.legacyWalsDone.Load() {
+		return
+	}
+	if _, ok := f.BusinessProvider.(LegacyWalMigrator); ok {
+		var done bool
+		done, err = legacyWalsMigrated(tx)
+		if err != nil {
+			return
+		}
+		if !done {
+			return ErrLegacyWalsNotMigrated
+		}
+	}
+	f.legacyWalsDone.Store(true)
+	return
+}
+
+func legacyWalsMigrated(tx model.KvStoreOperator) (done bool, err error) {
+	_, err = tx.Get([]byte(consts.LegacyWalsMigratedKey))
+	if errors.Is(err, model.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
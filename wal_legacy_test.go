@@ -0,0 +1,146 @@
+package walock_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"strings"
+	"testing"
+)
+
+// legacyProvider is the balance provider as released before the store numbered WALs: it kept them under
+// "OLD-<key>-<seq>" and caught them up itself
+type legacyProvider struct {
+	*balance.LevelDbProvider
+}
+
+func legacyWalKey(key model.LockerKey, seq uint64) string {
+	return fmt.Sprintf("OLD-%s-%03d", key, seq)
+}
+
+func (p *legacyProvider) LegacyWalKeys(tx model.KvStoreOperator) (keys []model.LockerKey, err error) {
+	seen := make(map[model.LockerKey]bool)
+	err = tx.Scan([]byte("OLD-"), func(k, v []byte) bool {
+		s := string(k)
+		key := model.LockerKey(s[len("OLD-"):strings.LastIndex(s, "-")])
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return
+}
+
+func (p *legacyProvider) CatchupLegacyWals(tx model.KvStoreOperator, key model.LockerKey, load model.LockerValue) (updated bool, err error) {
+	account := load.(*balance.Account)
+	version := account.Seq
+	scanErr := tx.Scan([]byte("OLD-"+string(key)+"-"), func(k, v []byte) bool {
+		var wal *balance.Wal
+		wal, err = balance.DecodeWal(v)
+		if err == nil {
+			err = account.Apply(wal)
+		}
+		return err == nil
+	})
+	if err == nil {
+		err = scanErr
+	}
+	updated = account.Seq != version
+	return
+}
+
+func (p *legacyProvider) DeleteLegacyWals(tx model.KvStoreOperator, key model.LockerKey) error {
+	b := &model.KvBatch{}
+	err := tx.Scan([]byte("OLD-"+string(key)+"-"), func(k, v []byte) bool {
+		b.Delete(append([]byte(nil), k...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Write(b)
+}
+
+func newLegacyStore(kv model.KvStoreOperator) *walock.WalockStoreLevelDb {
+	logger := zerolog.Nop()
+	persister := &balance.KvPersister{Kv: kv}
+	persister.InitDefault()
+	provider := &balance.LevelDbProvider{Persister: persister}
+	provider.InitDefault()
+	store := &walock.WalockStoreLevelDb{
+		BusinessProvider:  &legacyProvider{provider},
+		TccBarrierLevelDb: &tcc.TccBarrierLevelDb{Logger: &logger},
+		BarrierName:       "legacy",
+		Logger:            &logger,
+	}
+	store.InitDefault()
+	return store
+}
+
+func TestMigrateLegacyWals(t *testing.T) {
+	kv := &memkv.MemKv{}
+	persister := &balance.KvPersister{Kv: kv}
+	persister.InitDefault()
+	err := persister.Save(&balance.Account{Key: "alice", Available: 100, Seq: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wal := range []*balance.Wal{
+		{Key: "alice", Seq: 2, Op: balance.OpTry, GlobalId: "g1", BranchId: "b1", Amount: 30},
+		{Key: "alice", Seq: 3, Op: balance.OpConfirm, GlobalId: "g1", BranchId: "b1", Amount: 30},
+	} {
+		bytes, _ := balance.EncodeWal(wal)
+		err = kv.Put([]byte(legacyWalKey(wal.Key, wal.Seq)), bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := newLegacyStore(kv)
+	ctx := context.Background()
+	_, err = store.Get(ctx, kv, "alice")
+	if !errors.Is(err, walock.ErrLegacyWalsNotMigrated) {
+		t.Fatalf("Get before migration err = %v, want ErrLegacyWalsNotMigrated", err)
+	}
+
+	migrated, err := store.MigrateLegacyWals(kv)
+	if err != nil || migrated != 1 {
+		t.Fatalf("MigrateLegacyWals = %d, %v", migrated, err)
+	}
+	a := account(t, store, kv, "alice")
+	if a.Available != 70 || a.Frozen != 0 || a.Seq != 3 {
+		t.Fatalf("alice migrated to %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+	}
+	legacy, err := store.BusinessProvider.(walock.LegacyWalMigrator).LegacyWalKeys(kv)
+	if err != nil || len(legacy) != 0 {
+		t.Fatalf("legacy wals left on %v, %v", legacy, err)
+	}
+
+	// the store numbers the next WALs from the migrated version
+	tccCode, _, _, err := store.Try(ctx, kv, &model.TccContext{GlobalId: "g2", BranchId: "b1"}, "alice", int64(20))
+	if err != nil || tccCode != consts.TccCode_Success {
+		t.Fatalf("Try = %d, %v", tccCode, err)
+	}
+	_, err = kv.Get([]byte(walock.WalKey("alice", 4)))
+	if err != nil {
+		t.Fatalf("no wal at seq 4: %v", err)
+	}
+
+	restarted := newLegacyStore(kv)
+	migrated, err = restarted.MigrateLegacyWals(kv)
+	if err != nil || migrated != 0 {
+		t.Fatalf("MigrateLegacyWals again = %d, %v", migrated, err)
+	}
+	a = account(t, restarted, kv, "alice")
+	if a.Available != 50 || a.Frozen != 20 || a.Seq != 4 {
+		t.Fatalf("alice replayed to %d available, %d frozen at seq %d", a.Available, a.Frozen, a.Seq)
+	}
+}
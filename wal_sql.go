@@ -0,0 +1,54 @@
+package walock
+
+import (
+	"fmt"
+	"github.com/latifrons/walock/model"
+	"gorm.io/gorm"
+)
+
+// WALs of WalockStoreSqlDb are kept by the business provider. If they are SeqWal, the store numbers them
+// as WalockStoreLevelDb does: the seq of a WAL is the version of the value once the WAL is applied.
+
+// stampSeq places a SeqWal right after the version of value
+func stampSeq(value model.LockerValue, wali interface{}) {
+	if w, ok := wali.(SeqWal); ok {
+		w.SetSeq(value.GetVersion() + 1)
+	}
+}
+
+// checkSeq returns a WalChainError if value was not moved to the seq of the last of walis, when it is a SeqWal
+func checkSeq(key model.LockerKey, value model.LockerValue, walis []interface{}) error {
+	last, ok := walis[len(walis)-1].(SeqWal)
+	if ok && value.GetVersion() != last.GetSeq() {
+		return &WalChainError{Key: key, Expected: last.GetSeq(), Found: value.GetVersion()}
+	}
+	return nil
+}
+
+// catchupWals applies the WALs above the version of value. The WALs of a WalLoaderSql provider must form
+// an unbroken chain. Other providers catch up through CatchupWals.
+func (f *WalockStoreSqlDb) catchupWals(tx *gorm.DB, key model.LockerKey, value model.LockerValue) (err error) {
+	loader, ok := f.BusinessProvider.(WalLoaderSql)
+	if !ok {
+		return f.BusinessProvider.CatchupWals(tx, key, value)
+	}
+	version := value.GetVersion()
+	walis, err := loader.LoadWals(tx, key, version)
+	if err != nil || len(walis) == 0 {
+		return
+	}
+	for i, wali := range walis {
+		w, ok := wali.(SeqWal)
+		if !ok {
+			return fmt.Errorf("wal %T of %s is not a SeqWal", wali, key)
+		}
+		if w.GetSeq() != version+uint64(i)+1 {
+			return &WalChainError{Key: key, Expected: version + uint64(i) + 1, Found: w.GetSeq()}
+		}
+	}
+	err = f.BusinessProvider.ApplyWal(value, walis)
+	if err != nil {
+		return
+	}
+	return checkSeq(key, value, walis)
+}
@@ -0,0 +1,52 @@
+// Package walcodec encodes the typed WALs of business providers.
+// The id of the codec is written in the WAL envelope, so that a store reads WALs written with another codec
+// during a rolling upgrade.
+package walcodec
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	CodecRaw      uint8 = 0 // WalBytes marshalled by the provider itself, or an envelope without codec id
+	CodecJson     uint8 = 1
+	CodecProtobuf uint8 = 2
+	CodecMsgpack  uint8 = 3
+)
+
+type WalCodec interface {
+	Id() uint8 // written in the envelope. must not be CodecRaw
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[uint8]WalCodec{}
+)
+
+func init() {
+	Register(Json{})
+	Register(Protobuf{})
+	Register(Msgpack{})
+}
+
+// Register makes the codec available to ById. It replaces a codec with the same id.
+func Register(codec WalCodec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Id()] = codec
+}
+
+// ById returns the codec with the id written in an envelope
+func ById(id uint8) (codec WalCodec, err error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[id]
+	if !ok {
+		err = fmt.Errorf("unknown wal codec %d", id)
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package walcodec_test
+
+import (
+	"github.com/latifrons/walock/walcodec"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"reflect"
+	"testing"
+)
+
+type wal struct {
+	Key    string
+	Seq    uint64
+	Amount int64
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := &wal{Key: "alice", Seq: 3, Amount: -30}
+	for _, codec := range []walcodec.WalCodec{walcodec.Json{}, walcodec.Msgpack{}} {
+		b, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		out := &wal{}
+		err = codec.Unmarshal(b, out)
+		if err != nil || !reflect.DeepEqual(out, in) {
+			t.Fatalf("%s decoded %+v, %v", codec.Name(), out, err)
+		}
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	in, err := structpb.NewStruct(map[string]interface{}{"key": "alice", "amount": 30.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := walcodec.Protobuf{}
+	b, err := codec.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &structpb.Struct{}
+	err = codec.Unmarshal(b, out)
+	if err != nil || !proto.Equal(out, in) {
+		t.Fatalf("decoded %v, %v", out, err)
+	}
+
+	if _, err = codec.Marshal(&wal{}); err == nil {
+		t.Fatal("marshalled a struct which is not a proto.Message")
+	}
+	if err = codec.Unmarshal(b, &wal{}); err == nil {
+		t.Fatal("unmarshalled into a struct which is not a proto.Message")
+	}
+}
+
+func TestById(t *testing.T) {
+	for _, want := range []walcodec.WalCodec{walcodec.Json{}, walcodec.Protobuf{}, walcodec.Msgpack{}} {
+		codec, err := walcodec.ById(want.Id())
+		if err != nil || codec.Name() != want.Name() {
+			t.Fatalf("ById(%d) = %v, %v", want.Id(), codec, err)
+		}
+	}
+	for _, id := range []uint8{walcodec.CodecRaw, 200} {
+		if codec, err := walcodec.ById(id); err == nil {
+			t.Fatalf("ById(%d) = %s", id, codec.Name())
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package walcodec
+
+import "encoding/json"
+
+type Json struct{}
+
+func (Json) Id() uint8 {
+	return CodecJson
+}
+
+func (Json) Name() string {
+	return "json"
+}
+
+func (Json) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (Json) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,21 @@
+package walcodec
+
+import "github.com/vmihailenco/msgpack/v5"
+
+type Msgpack struct{}
+
+func (Msgpack) Id() uint8 {
+	return CodecMsgpack
+}
+
+func (Msgpack) Name() string {
+	return "msgpack"
+}
+
+func (Msgpack) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (Msgpack) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
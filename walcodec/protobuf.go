@@ -0,0 +1,33 @@
+package walcodec
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// Protobuf encodes WALs that are proto.Message
+type Protobuf struct{}
+
+func (Protobuf) Id() uint8 {
+	return CodecProtobuf
+}
+
+func (Protobuf) Name() string {
+	return "protobuf"
+}
+
+func (Protobuf) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (Protobuf) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
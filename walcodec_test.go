@@ -0,0 +1,93 @@
+package walock_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walcodec"
+	"testing"
+	"time"
+)
+
+func TestWalCodecs(t *testing.T) {
+	ctx := context.Background()
+	for _, codec := range []walcodec.WalCodec{walcodec.Json{}, walcodec.Msgpack{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			kv := &memkv.MemKv{}
+			store := newEngineStore(kv, false)
+			store.WalCodec = codec
+			tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+			tccCode, _, _, err := tccStore.Must(ctx, &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+			mustTcc(t, "Must", tccCode, err)
+			if envelope := decodeWal(t, kv, walock.WalKey("alice", 1)); envelope.Codec != codec.Id() {
+				t.Fatalf("wal written with codec %d", envelope.Codec)
+			}
+
+			// a store configured for JSON reads the wals by the codec of their envelope
+			if a := account(t, newEngineStore(kv, false), kv, "alice"); a.Available != 100 || a.Seq != 1 {
+				t.Fatalf("alice has %d available at seq %d", a.Available, a.Seq)
+			}
+		})
+	}
+}
+
+func TestWalCodecUnknown(t *testing.T) {
+	kv := &memkv.MemKv{}
+	store := &walock.LevelDbTccStore{Store: newEngineStore(kv, false), Tx: kv}
+	tccCode, _, _, err := store.Must(context.Background(), &model.TccContext{GlobalId: "g0", BranchId: "b1"}, "alice", int64(100))
+	mustTcc(t, "Must", tccCode, err)
+	envelope := decodeWal(t, kv, walock.WalKey("alice", 1))
+	envelope.Codec = 200
+	putWal(t, kv, walock.WalKey("alice", 1), envelope)
+
+	_, err = newEngineStore(kv, false).Get(context.Background(), kv, "alice")
+	var corruption *walock.WalCorruptionError
+	if !errors.As(err, &corruption) || corruption.Key != walock.WalKey("alice", 1) {
+		t.Fatalf("Get with an unknown codec = %v", err)
+	}
+}
+
+func TestWalCodecVersion1(t *testing.T) {
+	ctx := context.Background()
+	kv := &memkv.MemKv{}
+	// a version 1 envelope has no codec id. its typed WAL is JSON
+	payload, err := json.Marshal(&balance.Wal{Key: "alice", Seq: 1, Op: balance.OpMust, GlobalId: "g0", BranchId: "b1", Amount: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putWal(t, kv, walock.WalKey("alice", 1), &model.WalEnvelope{
+		Version:    walock.WalEnvelopeVersion1,
+		Time:       time.Now(),
+		TccContext: model.TccContext{GlobalId: "g0", BranchId: "b1"},
+		BranchType: consts.TccBranchTypeMust,
+		Payload:    payload,
+	})
+	err = kv.Put([]byte(consts.DirtyKeyPrefix+"alice"), []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and stays JSON from a store writing version 1 envelopes with another codec
+	store := newEngineStore(kv, false)
+	store.WalCodec = walcodec.Msgpack{}
+	store.WalEnvelopeVersion = walock.WalEnvelopeVersion1
+	tccStore := &walock.LevelDbTccStore{Store: store, Tx: kv}
+	tccCode, _, _, err := tccStore.Must(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(5))
+	mustTcc(t, "Must", tccCode, err)
+	envelope := decodeWal(t, kv, walock.WalKey("alice", 2))
+	var wal balance.Wal
+	if err = json.Unmarshal(envelope.Payload, &wal); err != nil || wal.Amount != 5 {
+		t.Fatalf("version 1 wal holds %q: %v", envelope.Payload, err)
+	}
+
+	reader := newEngineStore(kv, false)
+	reader.WalCodec = walcodec.Msgpack{}
+	if a := account(t, reader, kv, "alice"); a.Available != 105 || a.Seq != 2 {
+		t.Fatalf("alice has %d available at seq %d", a.Available, a.Seq)
+	}
+}
@@ -0,0 +1,51 @@
+package walocktest
+
+import (
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/model"
+	"sort"
+	"sync"
+)
+
+// Account and BalanceWal are the value and WAL of the balance providers. Try and Must bodies are the amount as int64.
+type (
+	Account    = balance.Account
+	BalanceWal = balance.Wal
+)
+
+// MemPersister is a balance.Persister on memory
+type MemPersister struct {
+	mu       sync.Mutex
+	accounts map[model.LockerKey]Account
+}
+
+func (p *MemPersister) Load(key model.LockerKey) (account *Account, found bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a, found := p.accounts[key]
+	if found {
+		account = &a
+	}
+	return
+}
+
+func (p *MemPersister) Save(account *Account) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.accounts == nil {
+		p.accounts = make(map[model.LockerKey]Account)
+	}
+	p.accounts[account.Key] = *account
+	return nil
+}
+
+func (p *MemPersister) Keys() ([]model.LockerKey, error) {
+	p.mu.Lock()
+	keys := make([]model.LockerKey, 0, len(p.accounts))
+	for key := range p.accounts {
+		keys = append(keys, key)
+	}
+	p.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
@@ -0,0 +1,83 @@
+package walocktest
+
+import (
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"gorm.io/gorm"
+)
+
+// MemSqlBarrier is the walock.SqlTccBarrier of a MemSqlDb. It follows tcc.TccBarrierSql row for row.
+type MemSqlBarrier struct {
+	BarrierName string
+	TableName   string // defaults to "tcc_barrier"
+}
+
+func (f *MemSqlBarrier) InitDefault() {
+	if f.TableName == "" {
+		f.TableName = "tcc_barrier"
+	}
+}
+
+func (f *MemSqlBarrier) insert(tccHeader *model.TccContext, persistentContext interface{}, branchType string) (inserted bool, err error) {
+	tx, err := MemSqlTxOf(persistentContext.(*gorm.DB))
+	if err != nil {
+		return
+	}
+	v := tcc.BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, branchType)
+	return tx.Insert(f.TableName, v.Key, v)
+}
+
+func (f *MemSqlBarrier) BarrierMust(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
+	callIt, err = f.insert(tccHeader, persistentContext, consts.TccBranchTypeMust)
+	if err == nil && !callIt {
+		skipped = consts.TccOutcomeDuplicate
+	}
+	return
+}
+
+func (f *MemSqlBarrier) BarrierTry(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
+	callIt, err = f.insert(tccHeader, persistentContext, consts.TccBranchTypeTry)
+	if err != nil || callIt {
+		return
+	}
+	tx, err := MemSqlTxOf(persistentContext.(*gorm.DB))
+	if err != nil {
+		return
+	}
+	v := tcc.BuildTccBarrierReceiver(f.BarrierName, tccHeader.GlobalId, tccHeader.BranchId, consts.TccBranchTypeCancel)
+	cancelled, err := tx.Get(f.TableName, v.Key, &model.TccBarrierReceiver{})
+	if err != nil {
+		return
+	}
+	if cancelled {
+		skipped = consts.TccOutcomeHangingRejected
+	} else {
+		skipped = consts.TccOutcomeDuplicate
+	}
+	return
+}
+
+func (f *MemSqlBarrier) BarrierConfirm(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
+	callIt, err = f.insert(tccHeader, persistentContext, consts.TccBranchTypeConfirm)
+	if err == nil && !callIt {
+		skipped = consts.TccOutcomeDuplicate
+	}
+	return
+}
+
+func (f *MemSqlBarrier) BarrierCancel(tccHeader *model.TccContext, persistentContext interface{}) (callIt bool, skipped string, err error) {
+	emptyRollback, err := f.insert(tccHeader, persistentContext, consts.TccBranchTypeTry)
+	if err != nil {
+		return
+	}
+	if emptyRollback {
+		skipped = consts.TccOutcomeEmptyRollback
+		return
+	}
+	callIt, err = f.insert(tccHeader, persistentContext, consts.TccBranchTypeCancel)
+	if err == nil && !callIt {
+		skipped = consts.TccOutcomeDuplicate
+	}
+	return
+}
@@ -0,0 +1,162 @@
+package walocktest
+
+import (
+	"errors"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/model"
+	"gorm.io/gorm"
+	"sync"
+)
+
+// ErrCrashed is returned by every durable write from the crash point on
+var ErrCrashed = errors.New("walocktest: crashed")
+
+// Crasher simulates a process kill at the CrashAt-th write boundary (1-based).
+// From then on all writes fail with ErrCrashed, so the durable state is frozen as the kill left it,
+// until Restart. The crash fires once; 0 never crashes and only counts the boundaries.
+type Crasher struct {
+	CrashAt int
+
+	mu      sync.Mutex
+	hits    int
+	crashed bool
+	point   string
+}
+
+// Hit is called before each durable write. point names the write boundary.
+func (c *Crasher) Hit(point string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crashed {
+		return ErrCrashed
+	}
+	c.hits++
+	if c.hits == c.CrashAt {
+		c.crashed = true
+		c.point = point
+		return ErrCrashed
+	}
+	return nil
+}
+
+// Crashed tells whether the process is dead
+func (c *Crasher) Crashed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.crashed
+}
+
+// Restart brings the process back. Writes go through again.
+func (c *Crasher) Restart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crashed = false
+}
+
+// Hits returns the number of write boundaries passed so far
+func (c *Crasher) Hits() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+// Point returns the boundary the crash fired at
+func (c *Crasher) Point() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.point
+}
+
+// CrashKv is a model.KvStoreOperator failing with ErrCrashed once its Crasher crashed.
+// Each Write, Put and Delete is a write boundary: a batch is written entirely or not at all.
+type CrashKv struct {
+	Kv      model.KvStoreOperator
+	Crasher *Crasher
+}
+
+func (o *CrashKv) Get(key []byte) ([]byte, error) {
+	if o.Crasher.Crashed() {
+		return nil, ErrCrashed
+	}
+	return o.Kv.Get(key)
+}
+
+func (o *CrashKv) Write(batch *model.KvBatch) error {
+	if err := o.Crasher.Hit("kv.write"); err != nil {
+		return err
+	}
+	return o.Kv.Write(batch)
+}
+
+func (o *CrashKv) Put(key, value []byte) error {
+	if err := o.Crasher.Hit("kv.put:" + string(key)); err != nil {
+		return err
+	}
+	return o.Kv.Put(key, value)
+}
+
+func (o *CrashKv) Delete(key []byte) error {
+	if err := o.Crasher.Hit("kv.delete:" + string(key)); err != nil {
+		return err
+	}
+	return o.Kv.Delete(key)
+}
+
+func (o *CrashKv) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	if o.Crasher.Crashed() {
+		return ErrCrashed
+	}
+	return o.Kv.Scan(prefix, fn)
+}
+
+// CrashPersister is a balance.Persister whose Save is a write boundary
+type CrashPersister struct {
+	Persister balance.Persister
+	Crasher   *Crasher
+}
+
+func (p *CrashPersister) Load(key model.LockerKey) (account *Account, found bool, err error) {
+	if p.Crasher.Crashed() {
+		err = ErrCrashed
+		return
+	}
+	return p.Persister.Load(key)
+}
+
+func (p *CrashPersister) Save(account *Account) error {
+	if err := p.Crasher.Hit("persist:" + string(account.Key)); err != nil {
+		return err
+	}
+	return p.Persister.Save(account)
+}
+
+func (p *CrashPersister) Keys() ([]model.LockerKey, error) {
+	return p.Persister.Keys()
+}
+
+// loaderProviderSql is balance.SqlProvider or BalanceProviderSql
+type loaderProviderSql interface {
+	walock.BusinessProviderSql
+	walock.WalLoaderSql
+}
+
+// crashProviderSql makes FlushWal and Flush write boundaries. The commit is one too, through crashDb or MemSqlDb.BeforeCommit.
+type crashProviderSql struct {
+	loaderProviderSql
+	crasher *Crasher
+}
+
+func (f *crashProviderSql) FlushWal(tx *gorm.DB, wali interface{}) error {
+	if err := f.crasher.Hit("sql.flush_wal"); err != nil {
+		return err
+	}
+	return f.loaderProviderSql.FlushWal(tx, wali)
+}
+
+func (f *crashProviderSql) Flush(tx *gorm.DB, value model.LockerValue) error {
+	if err := f.crasher.Hit("sql.flush:" + string(value.(*Account).Key)); err != nil {
+		return err
+	}
+	return f.loaderProviderSql.Flush(tx, value)
+}
@@ -0,0 +1,574 @@
+package walocktest
+
+import (
+	"context"
+	"fmt"
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"math/rand"
+)
+
+// CrashTest runs a random Try/Confirm/Cancel/Must/FlushDirty workload once without faults to count the write boundaries,
+// then once per boundary with a crash there. After each crash the store is rebuilt on the durable state and the
+// interrupted call is delivered again, as a TCC coordinator would. It checks that
+//   - the recovered account is the replay of the durable WAL chain, each WAL once, with no seq gap
+//   - the final balances match the acknowledged results, and the flushed accounts match the cached ones
+//   - money is conserved: credited by Must minus deducted by Confirm
+//
+// The workload is deterministic for a Seed.
+type CrashTest struct {
+	Seed    int64
+	Steps   int   // workload length. defaults to 100
+	Keys    int   // number of accounts. defaults to 3
+	Initial int64 // credited by Must to each account first. defaults to 100
+	Compact bool  // LevelDb only: keeps local snapshots and compacts the WALs at each flush
+	RawWals bool  // LevelDb only: hides the walock.WalFactory of the provider, which then decodes the WalBytes itself. not with Compact, whose snapshots need the hidden walock.ValueFactory
+	// optional. LevelDb only: returns an empty KV store for each run, e.g. on goleveldb. defaults to memkv
+	Kv func() (model.KvStoreOperator, error)
+}
+
+// CrashFailure lists the invariants broken by the run crashing at CrashAt. CrashAt 0 is the run without crash.
+type CrashFailure struct {
+	CrashAt    int
+	Point      string
+	Violations []string
+}
+
+func (f CrashFailure) String() string {
+	return fmt.Sprintf("crash at %d (%s): %v", f.CrashAt, f.Point, f.Violations)
+}
+
+func (t *CrashTest) InitDefault() {
+	if t.Steps == 0 {
+		t.Steps = 100
+	}
+	if t.Keys == 0 {
+		t.Keys = 3
+	}
+	if t.Initial == 0 {
+		t.Initial = 100
+	}
+}
+
+// RunLevelDb runs the test on WalockStoreLevelDb with a balance.LevelDbProvider
+func (t *CrashTest) RunLevelDb() (boundaries int, failures []CrashFailure) {
+	return t.run(false, func(crasher *Crasher) crashSystem {
+		return &levelDbCrashSystem{crasher: crasher, compact: t.Compact, rawWals: t.RawWals, open: t.Kv}
+	})
+}
+
+// RunSql runs the test on WalockStoreSqlDb with a balance.SqlProvider. open returns an empty database for each run,
+// usually an in-memory SQLite. See NewSqlBalance. A nil open runs it on a MemSqlDb with a BalanceProviderSql instead.
+func (t *CrashTest) RunSql(open func() (*gorm.DB, error)) (boundaries int, failures []CrashFailure) {
+	return t.run(true, func(crasher *Crasher) crashSystem {
+		return &sqlCrashSystem{crasher: crasher, open: open}
+	})
+}
+
+// run checks the store built by newSystem. barsTry tells whether an empty rollback of the store leaves the try barrier
+// behind, as the SQL barrier does, so that the hanging try is skipped as a duplicate. Otherwise the hanging try reserves.
+func (t *CrashTest) run(barsTry bool, newSystem func(crasher *Crasher) crashSystem) (boundaries int, failures []CrashFailure) {
+	steps := t.workload()
+
+	crasher := &Crasher{}
+	violations := t.execute(barsTry, newSystem(crasher), crasher, steps)
+	if len(violations) != 0 {
+		failures = append(failures, CrashFailure{Violations: violations})
+	}
+	boundaries = crasher.Hits()
+
+	for i := 1; i <= boundaries; i++ {
+		crasher = &Crasher{CrashAt: i}
+		violations = t.execute(barsTry, newSystem(crasher), crasher, steps)
+		if len(violations) != 0 {
+			failures = append(failures, CrashFailure{CrashAt: i, Point: crasher.Point(), Violations: violations})
+		}
+	}
+	return
+}
+
+type crashStep struct {
+	op     string // consts.TccOperation* or "flush"
+	tcc    model.TccContext
+	key    model.LockerKey
+	amount int64
+}
+
+func (s crashStep) String() string {
+	return fmt.Sprintf("%s %s %s %d", s.op, s.tcc.String(), s.key, s.amount)
+}
+
+const crashOpFlush = "flush"
+
+func (t *CrashTest) workload() (steps []crashStep) {
+	rnd := rand.New(rand.NewSource(t.Seed))
+	keys := make([]model.LockerKey, t.Keys)
+	for i := range keys {
+		keys[i] = model.LockerKey(fmt.Sprintf("account-%d", i))
+	}
+	branch := 0
+	newTcc := func() model.TccContext {
+		branch++
+		return model.TccContext{GlobalId: fmt.Sprintf("g%d", branch), BranchId: "b1"}
+	}
+
+	for _, key := range keys {
+		steps = append(steps, crashStep{op: consts.TccOperationMust, tcc: newTcc(), key: key, amount: t.Initial})
+	}
+	var open []crashStep // tried and not settled yet
+	for len(steps) < t.Steps {
+		key := keys[rnd.Intn(len(keys))]
+		p := rnd.Intn(100)
+		switch {
+		case p < 20:
+			steps = append(steps, crashStep{op: consts.TccOperationMust, tcc: newTcc(), key: key, amount: 1 + rnd.Int63n(20)})
+		case p < 50:
+			st := crashStep{op: consts.TccOperationTry, tcc: newTcc(), key: key, amount: 1 + rnd.Int63n(60)}
+			steps = append(steps, st)
+			open = append(open, st)
+		case p < 80 && len(open) != 0:
+			i := rnd.Intn(len(open))
+			st := open[i]
+			open = append(open[:i], open[i+1:]...)
+			st.op = consts.TccOperationConfirm
+			if p >= 65 {
+				st.op = consts.TccOperationCancel
+			}
+			steps = append(steps, st)
+		case p < 85:
+			// empty rollback, then the hanging try
+			st := crashStep{op: consts.TccOperationCancel, tcc: newTcc(), key: key, amount: 1}
+			steps = append(steps, st)
+			st.op = consts.TccOperationTry
+			steps = append(steps, st)
+		case p < 95:
+			// deliver an earlier call again
+			steps = append(steps, steps[rnd.Intn(len(steps))])
+		default:
+			steps = append(steps, crashStep{op: crashOpFlush})
+		}
+	}
+	// settle what is left
+	for _, st := range open {
+		st.op = consts.TccOperationCancel
+		steps = append(steps, st)
+	}
+	steps = append(steps, crashStep{op: crashOpFlush})
+	return
+}
+
+func (t *CrashTest) execute(barsTry bool, sys crashSystem, crasher *Crasher, steps []crashStep) (violations []string) {
+	ctx := context.Background()
+	report := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+
+	err := sys.start()
+	if err != nil {
+		report("start: %v", err)
+		return
+	}
+
+	m := newCrashModel(barsTry)
+	keys := make(map[model.LockerKey]bool)
+	for i, st := range steps {
+		if st.key != "" {
+			keys[st.key] = true
+		}
+		for attempt := 0; attempt < 2; attempt++ {
+			var tccCode model.TccCode
+			var code string
+			tccCode, code, err = sys.call(ctx, st)
+			if crasher.Crashed() {
+				crasher.Restart()
+				err = sys.start()
+				if err != nil {
+					report("recover after step %d %s: %v", i, st, err)
+					return
+				}
+				for key := range keys {
+					violations = append(violations, checkWalChain(sys, key)...)
+				}
+				continue
+			}
+			if err != nil {
+				report("step %d %s: %v", i, st, err)
+				break
+			}
+			if v := m.observe(st, tccCode, code); v != "" {
+				report("step %d %s: %s", i, st, v)
+			}
+			break
+		}
+	}
+
+	var credited, deducted int64
+	var total int64
+	for key := range keys {
+		violations = append(violations, checkWalChain(sys, key)...)
+
+		account, err := sys.get(key)
+		if err != nil {
+			report("get %s: %v", key, err)
+			continue
+		}
+		if account.Available != m.available[key] || account.Frozen != m.frozen[key] {
+			report("%s: got available %d frozen %d, acknowledged results give %d %d", key, account.Available, account.Frozen, m.available[key], m.frozen[key])
+		}
+		persisted, err := sys.persisted(key)
+		if err != nil {
+			report("persisted %s: %v", key, err)
+		} else if persisted.Available != account.Available || persisted.Frozen != account.Frozen || persisted.Seq != account.Seq {
+			report("%s: flushed %+v, cached %+v", key, persisted, *account)
+		}
+		total += account.Available + account.Frozen
+		credited += m.credited[key]
+		deducted += m.deducted[key]
+	}
+	if total != credited-deducted {
+		report("money not conserved: total %d, credited %d, deducted %d", total, credited, deducted)
+	}
+	return
+}
+
+// checkWalChain tells whether the account is the replay of its durable WALs, each once.
+// Compacted WALs are replaced by the persisted account.
+func checkWalChain(sys crashSystem, key model.LockerKey) (violations []string) {
+	wals, err := sys.wals(key)
+	if err != nil {
+		return []string{fmt.Sprintf("wals %s: %v", key, err)}
+	}
+	replayed := &Account{Key: key}
+	if len(wals) == 0 || wals[0].Seq > 1 {
+		var persisted Account
+		persisted, err = sys.persisted(key)
+		if err != nil {
+			return []string{fmt.Sprintf("persisted %s: %v", key, err)}
+		}
+		replayed = &persisted
+	}
+	for _, wal := range wals {
+		if wal.Seq <= replayed.Seq {
+			continue
+		}
+		if wal.Seq != replayed.Seq+1 {
+			violations = append(violations, fmt.Sprintf("%s: wal seq %d after %d", key, wal.Seq, replayed.Seq))
+		}
+		if err = replayed.Apply(wal); err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	account, err := sys.get(key)
+	if err != nil {
+		return append(violations, fmt.Sprintf("get %s: %v", key, err))
+	}
+	if account.Seq != replayed.Seq || account.Available != replayed.Available || account.Frozen != replayed.Frozen {
+		violations = append(violations, fmt.Sprintf("%s: recovered %+v, wal replay %+v", key, *account, *replayed))
+	}
+	return
+}
+
+// crashModel tracks the balances implied by the acknowledged results
+type crashModel struct {
+	available map[model.LockerKey]int64
+	frozen    map[model.LockerKey]int64
+	credited  map[model.LockerKey]int64
+	deducted  map[model.LockerKey]int64
+	musts     map[string]bool
+	tries     map[string]string // branch -> "" while frozen, then confirm or cancel
+	emptied   map[string]bool   // an empty rollback left the try barrier behind
+	barsTry   bool
+}
+
+func newCrashModel(barsTry bool) *crashModel {
+	return &crashModel{
+		barsTry:   barsTry,
+		available: make(map[model.LockerKey]int64),
+		frozen:    make(map[model.LockerKey]int64),
+		credited:  make(map[model.LockerKey]int64),
+		deducted:  make(map[model.LockerKey]int64),
+		musts:     make(map[string]bool),
+		tries:     make(map[string]string),
+		emptied:   make(map[string]bool),
+	}
+}
+
+// observe applies an acknowledged result. It returns a violation if the result contradicts the model.
+func (m *crashModel) observe(st crashStep, tccCode model.TccCode, code string) string {
+	branch := st.tcc.String()
+	success := tccCode == consts.TccCode_Success
+	switch st.op {
+	case consts.TccOperationMust:
+		if !success {
+			return fmt.Sprintf("must failed: %s", code)
+		}
+		if !m.musts[branch] {
+			m.musts[branch] = true
+			m.available[st.key] += st.amount
+			m.credited[st.key] += st.amount
+		}
+	case consts.TccOperationTry:
+		state, tried := m.tries[branch]
+		switch {
+		case m.emptied[branch] && !tried:
+			if !success {
+				return fmt.Sprintf("hanging try after empty rollback failed: %s", code)
+			}
+		case tried:
+			if !success && state == "" {
+				return fmt.Sprintf("duplicate try failed: %s", code)
+			}
+		case success:
+			if m.available[st.key] < st.amount {
+				return fmt.Sprintf("try succeeded with available %d", m.available[st.key])
+			}
+			m.tries[branch] = ""
+			m.available[st.key] -= st.amount
+			m.frozen[st.key] += st.amount
+		case code == balance.ErrInsufficientBalance:
+			if m.available[st.key] >= st.amount {
+				return fmt.Sprintf("try rejected with available %d", m.available[st.key])
+			}
+		default:
+			return fmt.Sprintf("try failed: %s", code)
+		}
+	case consts.TccOperationConfirm, consts.TccOperationCancel:
+		state, tried := m.tries[branch]
+		if !success {
+			if tried {
+				return fmt.Sprintf("%s failed: %s", st.op, code)
+			}
+			return ""
+		}
+		if !tried {
+			if st.op == consts.TccOperationCancel && m.barsTry {
+				m.emptied[branch] = true
+			}
+			if st.op == consts.TccOperationConfirm {
+				return "confirm succeeded without reservation"
+			}
+			return ""
+		}
+		if state != "" {
+			if state != st.op {
+				return fmt.Sprintf("%s succeeded after %s", st.op, state)
+			}
+			return ""
+		}
+		m.tries[branch] = st.op
+		m.frozen[st.key] -= st.amount
+		if st.op == consts.TccOperationConfirm {
+			m.deducted[st.key] += st.amount
+		} else {
+			m.available[st.key] += st.amount
+		}
+	}
+	return ""
+}
+
+type crashSystem interface {
+	// start drops the store and builds a new one on the durable state, running the recovery of the store
+	start() error
+	call(ctx context.Context, st crashStep) (tccCode model.TccCode, code string, err error)
+	get(key model.LockerKey) (*Account, error)
+	persisted(key model.LockerKey) (Account, error)
+	wals(key model.LockerKey) ([]*BalanceWal, error)
+}
+
+func callTccStore(ctx context.Context, store walock.TccStore, flush func() error, st crashStep) (tccCode model.TccCode, code string, err error) {
+	switch st.op {
+	case consts.TccOperationTry:
+		tccCode, code, _, err = store.Try(ctx, &st.tcc, st.key, st.amount)
+	case consts.TccOperationConfirm:
+		tccCode, code, _, err = store.Confirm(ctx, &st.tcc, st.key, nil)
+	case consts.TccOperationCancel:
+		tccCode, code, _, err = store.Cancel(ctx, &st.tcc, st.key, nil)
+	case consts.TccOperationMust:
+		tccCode, code, _, err = store.Must(ctx, &st.tcc, st.key, st.amount)
+	case crashOpFlush:
+		err = flush()
+	}
+	return
+}
+
+type levelDbCrashSystem struct {
+	crasher  *Crasher
+	compact  bool
+	rawWals  bool
+	open     func() (model.KvStoreOperator, error)
+	kv       model.KvStoreOperator // durable
+	accounts MemPersister          // durable
+
+	provider *balance.LevelDbProvider
+	store    *walock.WalockStoreLevelDb
+	tx       *CrashKv
+}
+
+func (s *levelDbCrashSystem) start() (err error) {
+	if s.kv == nil {
+		s.kv = &memkv.MemKv{}
+		if s.open != nil {
+			s.kv, err = s.open()
+			if err != nil {
+				return
+			}
+		}
+	}
+	logger := zerolog.Nop()
+	s.provider = &balance.LevelDbProvider{Persister: &CrashPersister{Persister: &s.accounts, Crasher: s.crasher}}
+	s.provider.InitDefault()
+	barrier := &tcc.TccBarrierLevelDb{Logger: &logger}
+	barrier.InitDefault()
+	s.store = &walock.WalockStoreLevelDb{
+		BusinessProvider:  s.provider,
+		TccBarrierLevelDb: barrier,
+		BarrierName:       "walocktest",
+		Logger:            &logger,
+		Snapshots:         s.compact,
+	}
+	if s.rawWals {
+		s.store.BusinessProvider = &rawWalProvider{s.provider}
+	}
+	s.store.InitDefault()
+	s.tx = &CrashKv{Kv: s.kv, Crasher: s.crasher}
+	return s.store.ClearDirtyRecords(context.Background(), s.tx)
+}
+
+// rawWalProvider only has the methods of walock.BusinessProviderLevelDb
+type rawWalProvider struct {
+	walock.BusinessProviderLevelDb
+}
+
+func (s *levelDbCrashSystem) call(ctx context.Context, st crashStep) (model.TccCode, string, error) {
+	store := &walock.LevelDbTccStore{Store: s.store, Tx: s.tx}
+	return callTccStore(ctx, store, func() error {
+		err := s.store.FlushDirty(s.tx)
+		if err == nil && s.compact {
+			_, err = s.store.CompactWals(s.tx)
+		}
+		return err
+	}, st)
+}
+
+func (s *levelDbCrashSystem) get(key model.LockerKey) (*Account, error) {
+	v, err := s.store.Get(context.Background(), s.tx, key)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Account), nil
+}
+
+func (s *levelDbCrashSystem) persisted(key model.LockerKey) (Account, error) {
+	account, found, err := s.accounts.Load(key)
+	if err != nil || !found {
+		return Account{Key: key}, err
+	}
+	return *account, nil
+}
+
+func (s *levelDbCrashSystem) wals(key model.LockerKey) (wals []*BalanceWal, err error) {
+	var decodeErr error
+	err = walock.ScanWals(s.kv, key, 0, func(w model.Wal) bool {
+		var envelope *model.WalEnvelope
+		envelope, decodeErr = walock.DecodeWalEnvelope(w.Key, w.WalBytes)
+		if decodeErr != nil {
+			return false
+		}
+		var wal *BalanceWal
+		wal, decodeErr = balance.DecodeWal(envelope.Payload)
+		wals = append(wals, wal)
+		return decodeErr == nil
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	return
+}
+
+type sqlCrashSystem struct {
+	crasher *Crasher
+	open    func() (*gorm.DB, error)
+	db      *gorm.DB // durable
+	crashDb *gorm.DB // db with commits as write boundaries
+
+	provider    loaderProviderSql
+	barrier     walock.SqlTccBarrier
+	barrierName string
+	store       *walock.WalockStoreSqlDb
+}
+
+func (s *sqlCrashSystem) start() (err error) {
+	if s.db == nil {
+		err = s.create()
+		if err != nil {
+			return
+		}
+	}
+	logger := zerolog.Nop()
+	s.store = &walock.WalockStoreSqlDb{
+		DbRw:             s.crashDb,
+		BusinessProvider: &crashProviderSql{loaderProviderSql: s.provider, crasher: s.crasher},
+		BarrierName:      s.barrierName,
+		Logger:           &logger,
+		TccBarrier:       s.barrier,
+	}
+	s.store.InitDefault()
+	return
+}
+
+// create creates the durable state, on open or on a MemSqlDb
+func (s *sqlCrashSystem) create() (err error) {
+	if s.open == nil {
+		db := NewMemSqlDb()
+		db.BeforeCommit = func() error {
+			return s.crasher.Hit("sql.commit")
+		}
+		s.db, s.crashDb = db.Gorm(), db.Gorm()
+		provider, barrier := NewMemSqlBalance(db)
+		s.provider, s.barrier, s.barrierName = provider, barrier, barrier.BarrierName
+		return
+	}
+	s.db, err = s.open()
+	if err != nil {
+		return
+	}
+	s.crashDb = crashDb(s.db, s.crasher)
+	provider, barrier, err := NewSqlBalance(s.db)
+	s.provider, s.barrier, s.barrierName = provider, barrier, barrier.BarrierName
+	return
+}
+
+func (s *sqlCrashSystem) call(ctx context.Context, st crashStep) (model.TccCode, string, error) {
+	return callTccStore(ctx, s.store, s.store.FlushDirty, st)
+}
+
+func (s *sqlCrashSystem) get(key model.LockerKey) (*Account, error) {
+	v, err := s.store.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Account), nil
+}
+
+func (s *sqlCrashSystem) persisted(key model.LockerKey) (account Account, err error) {
+	v, err := s.provider.LoadPersistedValue(s.db, key)
+	if err != nil {
+		return
+	}
+	account = *v.(*Account)
+	return
+}
+
+func (s *sqlCrashSystem) wals(key model.LockerKey) (wals []*BalanceWal, err error) {
+	walis, err := s.provider.LoadWals(s.db, key, 0)
+	for _, wali := range walis {
+		wals = append(wals, wali.(*BalanceWal))
+	}
+	return
+}
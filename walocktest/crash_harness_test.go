@@ -0,0 +1,110 @@
+package walocktest_test
+
+import (
+	"fmt"
+	"github.com/glebarez/sqlite"
+	"github.com/latifrons/walock/kv/leveldbkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"testing"
+)
+
+var crashSeeds = []int64{1, 2, 3}
+
+// openLevelDb returns an empty goleveldb. The small write buffer moves the writes into table files early,
+// whose iterators reuse their buffers, unlike memkv.
+func openLevelDb(t *testing.T) func() (model.KvStoreOperator, error) {
+	return func() (model.KvStoreOperator, error) {
+		db, err := leveldb.Open(storage.NewMemStorage(), &opt.Options{WriteBuffer: 1024})
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return &leveldbkv.LevelDbKv{Db: db}, nil
+	}
+}
+
+func openSqlite(t *testing.T) func() (*gorm.DB, error) {
+	return func() (*gorm.DB, error) {
+		db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+		if err != nil {
+			return nil, err
+		}
+		sqlDb, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { _ = sqlDb.Close() })
+		// one connection keeps the in-memory database alive
+		sqlDb.SetMaxOpenConns(1)
+		return db, nil
+	}
+}
+
+func checkCrashRun(t *testing.T, boundaries int, failures []walocktest.CrashFailure) {
+	t.Helper()
+	if boundaries == 0 {
+		t.Fatal("no write boundary crossed")
+	}
+	for i, failure := range failures {
+		if i == 5 {
+			t.Fatalf("... %d failures out of %d boundaries", len(failures), boundaries)
+		}
+		t.Error(failure)
+	}
+}
+
+func TestCrashLevelDb(t *testing.T) {
+	kvs := []struct {
+		name string
+		open func(t *testing.T) func() (model.KvStoreOperator, error)
+	}{
+		{"memkv", func(t *testing.T) func() (model.KvStoreOperator, error) { return nil }},
+		{"goleveldb", openLevelDb},
+	}
+	options := []struct {
+		compact bool
+		rawWals bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+	}
+	for _, kv := range kvs {
+		for _, o := range options {
+			for _, seed := range crashSeeds {
+				t.Run(fmt.Sprintf("%s/compact=%v/raw=%v/seed=%d", kv.name, o.compact, o.rawWals, seed), func(t *testing.T) {
+					ct := &walocktest.CrashTest{Seed: seed, Compact: o.compact, RawWals: o.rawWals, Kv: kv.open(t)}
+					ct.InitDefault()
+					boundaries, failures := ct.RunLevelDb()
+					checkCrashRun(t, boundaries, failures)
+				})
+			}
+		}
+	}
+}
+
+func TestCrashSql(t *testing.T) {
+	dbs := []struct {
+		name string
+		open func(t *testing.T) func() (*gorm.DB, error)
+	}{
+		{"memsql", func(t *testing.T) func() (*gorm.DB, error) { return nil }},
+		{"sqlite", openSqlite},
+	}
+	for _, db := range dbs {
+		for _, seed := range crashSeeds {
+			t.Run(fmt.Sprintf("%s/seed=%d", db.name, seed), func(t *testing.T) {
+				ct := &walocktest.CrashTest{Seed: seed}
+				ct.InitDefault()
+				boundaries, failures := ct.RunSql(db.open(t))
+				checkCrashRun(t, boundaries, failures)
+			})
+		}
+	}
+}
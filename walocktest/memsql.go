@@ -0,0 +1,341 @@
+package walocktest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrSqlNotSupported is returned when SQL reaches a MemSqlDb. Code running on it must use MemSqlTxOf instead of gorm queries.
+var ErrSqlNotSupported = errors.New("walocktest: MemSqlDb does not run SQL")
+
+// ErrDuplicateKey is returned by MemSqlTx.Commit if a row inserted by the transaction was committed by another one meanwhile,
+// and by BalanceProviderSql.FlushWal for a WAL written twice
+var ErrDuplicateKey = errors.New("walocktest: duplicate key")
+
+var errTxDone = errors.New("walocktest: transaction already committed or rolled back")
+
+// MemSqlDb is an in-memory stand-in for the SQL database behind WalockStoreSqlDb, needing neither a database
+// nor a SQL driver. It keeps JSON rows in named tables and has no SQL engine: WalockStoreSqlDb takes a *gorm.DB,
+// so the one from Gorm only carries the transaction. Business providers and barriers reach the rows with MemSqlTxOf,
+// and any SQL reaching it fails with ErrSqlNotSupported.
+// Code running its own queries needs a real database instead, e.g. the in-memory SQLite of NewSqlFixture.
+type MemSqlDb struct {
+	BeforeCommit func() error // optional. a returned error rolls the transaction back, as if the process died before COMMIT
+
+	mu     sync.Mutex
+	tables map[string]map[string][]byte // table -> primary key -> JSON row
+
+	gormDb *gorm.DB
+}
+
+func NewMemSqlDb() *MemSqlDb {
+	d := &MemSqlDb{tables: make(map[string]map[string][]byte)}
+	db, err := gorm.Open(&memSqlDialector{db: d}, &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		// the dialector does not fail
+		panic(err)
+	}
+	d.gormDb = db
+	return d
+}
+
+// Gorm returns the *gorm.DB whose transactions are MemSqlDb transactions
+func (d *MemSqlDb) Gorm() *gorm.DB {
+	return d.gormDb
+}
+
+// Tx returns an auto-commit handle: every write is visible at once
+func (d *MemSqlDb) Tx() *MemSqlTx {
+	return &MemSqlTx{db: d, autoCommit: true}
+}
+
+// Begin starts a transaction. Writes are buffered until Commit.
+func (d *MemSqlDb) Begin() *MemSqlTx {
+	return &MemSqlTx{db: d, writes: make(map[string]map[string][]byte), inserts: make(map[string]map[string]bool)}
+}
+
+// MemSqlTxOf returns the MemSqlTx behind tx, which must come from MemSqlDb.Gorm or one of its transactions
+func MemSqlTxOf(tx *gorm.DB) (*MemSqlTx, error) {
+	switch pool := tx.Statement.ConnPool.(type) {
+	case *MemSqlTx:
+		return pool, nil
+	case *memSqlPool:
+		return pool.db.Tx(), nil
+	default:
+		return nil, fmt.Errorf("walocktest: %T is not a MemSqlDb connection", tx.Statement.ConnPool)
+	}
+}
+
+// MemSqlTx reads and writes JSON rows. It is not safe for concurrent use.
+type MemSqlTx struct {
+	db         *MemSqlDb
+	autoCommit bool
+	done       bool
+	writes     map[string]map[string][]byte // nil row means deleted
+	inserts    map[string]map[string]bool   // rows that must not exist on commit
+}
+
+// Get decodes the row into row. found is false if it does not exist.
+func (t *MemSqlTx) Get(table string, key string, row interface{}) (found bool, err error) {
+	bytes, found, err := t.get(table, key)
+	if err != nil || !found {
+		return
+	}
+	err = json.Unmarshal(bytes, row)
+	return
+}
+
+// Put inserts or replaces the row
+func (t *MemSqlTx) Put(table string, key string, row interface{}) (err error) {
+	bytes, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	return t.write(table, key, bytes)
+}
+
+// Insert inserts the row unless the key exists, like INSERT IGNORE. inserted tells whether it was written.
+func (t *MemSqlTx) Insert(table string, key string, row interface{}) (inserted bool, err error) {
+	_, found, err := t.get(table, key)
+	if err != nil || found {
+		return
+	}
+	bytes, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	if t.autoCommit {
+		t.db.mu.Lock()
+		defer t.db.mu.Unlock()
+		if _, found = t.db.tables[table][key]; found {
+			return
+		}
+		t.db.putLocked(table, key, bytes)
+		inserted = true
+		return
+	}
+	if t.inserts[table] == nil {
+		t.inserts[table] = make(map[string]bool)
+	}
+	t.inserts[table][key] = true
+	err = t.write(table, key, bytes)
+	inserted = err == nil
+	return
+}
+
+func (t *MemSqlTx) Delete(table string, key string) error {
+	return t.write(table, key, nil)
+}
+
+// Keys returns the keys of the table starting with prefix in ascending order
+func (t *MemSqlTx) Keys(table string, prefix string) (keys []string, err error) {
+	if t.done {
+		err = errTxDone
+		return
+	}
+	exists := make(map[string]bool)
+	t.db.mu.Lock()
+	for k := range t.db.tables[table] {
+		if strings.HasPrefix(k, prefix) {
+			exists[k] = true
+		}
+	}
+	t.db.mu.Unlock()
+	for k, row := range t.writes[table] {
+		if strings.HasPrefix(k, prefix) {
+			exists[k] = row != nil
+		}
+	}
+	for k, ok := range exists {
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func (t *MemSqlTx) Commit() error {
+	if t.done {
+		return errTxDone
+	}
+	t.done = true
+	if t.autoCommit {
+		return nil
+	}
+	if t.db.BeforeCommit != nil {
+		if err := t.db.BeforeCommit(); err != nil {
+			return err
+		}
+	}
+
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	for table, keys := range t.inserts {
+		for key := range keys {
+			if _, found := t.db.tables[table][key]; found {
+				return ErrDuplicateKey
+			}
+		}
+	}
+	for table, rows := range t.writes {
+		for key, row := range rows {
+			if row == nil {
+				delete(t.db.tables[table], key)
+			} else {
+				t.db.putLocked(table, key, row)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *MemSqlTx) Rollback() error {
+	if t.done {
+		return errTxDone
+	}
+	t.done = true
+	return nil
+}
+
+func (t *MemSqlTx) get(table string, key string) (row []byte, found bool, err error) {
+	if t.done {
+		err = errTxDone
+		return
+	}
+	if row, found = t.writes[table][key]; found {
+		found = row != nil
+		return
+	}
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	row, found = t.db.tables[table][key]
+	return
+}
+
+func (t *MemSqlTx) write(table string, key string, row []byte) error {
+	if t.done {
+		return errTxDone
+	}
+	if t.autoCommit {
+		t.db.mu.Lock()
+		defer t.db.mu.Unlock()
+		if row == nil {
+			delete(t.db.tables[table], key)
+		} else {
+			t.db.putLocked(table, key, row)
+		}
+		return nil
+	}
+	if t.writes[table] == nil {
+		t.writes[table] = make(map[string][]byte)
+	}
+	t.writes[table][key] = row
+	return nil
+}
+
+func (d *MemSqlDb) putLocked(table string, key string, row []byte) {
+	if d.tables[table] == nil {
+		d.tables[table] = make(map[string][]byte)
+	}
+	d.tables[table][key] = row
+}
+
+// gorm.ConnPool methods. MemSqlTx is the ConnPool of transactions started by gorm.
+
+func (t *MemSqlTx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, ErrSqlNotSupported
+}
+
+func (t *MemSqlTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, ErrSqlNotSupported
+}
+
+func (t *MemSqlTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, ErrSqlNotSupported
+}
+
+func (t *MemSqlTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+// memSqlPool is the ConnPool of MemSqlDb.Gorm. It must not implement gorm.TxCommitter,
+// otherwise gorm takes every transaction for a nested one.
+type memSqlPool struct {
+	db *MemSqlDb
+}
+
+func (p *memSqlPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	return p.db.Begin(), nil
+}
+
+func (p *memSqlPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, ErrSqlNotSupported
+}
+
+func (p *memSqlPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, ErrSqlNotSupported
+}
+
+func (p *memSqlPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, ErrSqlNotSupported
+}
+
+func (p *memSqlPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+// memSqlDialector registers the default callbacks so that gorm queries fail with ErrSqlNotSupported instead of doing nothing
+type memSqlDialector struct {
+	db *MemSqlDb
+}
+
+func (m *memSqlDialector) Name() string {
+	return "walocktest"
+}
+
+func (m *memSqlDialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool = &memSqlPool{db: m.db}
+	return nil
+}
+
+func (m *memSqlDialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return nil
+}
+
+func (m *memSqlDialector) DataTypeOf(field *schema.Field) string {
+	return string(field.DataType)
+}
+
+func (m *memSqlDialector) DefaultValueOf(field *schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (m *memSqlDialector) BindVarTo(writer clause.Writer, stmt *gorm.Statement, v interface{}) {
+	writer.WriteByte('?')
+}
+
+func (m *memSqlDialector) QuoteTo(writer clause.Writer, str string) {
+	writer.WriteByte('`')
+	writer.WriteString(str)
+	writer.WriteByte('`')
+}
+
+func (m *memSqlDialector) Explain(sql string, vars ...interface{}) string {
+	return sql
+}
@@ -0,0 +1,35 @@
+package walocktest
+
+import (
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/model"
+)
+
+// BalanceProviderLevelDb is a balance.LevelDbProvider keeping the persisted accounts in memory.
+// WALs go to the model.KvStoreOperator of the store.
+type BalanceProviderLevelDb struct {
+	balance.LevelDbProvider
+	Accounts *MemPersister
+}
+
+func (f *BalanceProviderLevelDb) InitDefault() {
+	if f.Accounts == nil {
+		f.Accounts = &MemPersister{}
+	}
+	f.Persister = f.Accounts
+	f.LevelDbProvider.InitDefault()
+}
+
+// SetPersisted overwrites the persisted account, as if an earlier PersistValue had stored it
+func (f *BalanceProviderLevelDb) SetPersisted(account Account) {
+	_ = f.Accounts.Save(&account)
+}
+
+// Persisted returns a copy of the persisted account
+func (f *BalanceProviderLevelDb) Persisted(key model.LockerKey) Account {
+	account, found, _ := f.Accounts.Load(key)
+	if !found {
+		return Account{Key: key}
+	}
+	return *account
+}
@@ -0,0 +1,208 @@
+package walocktest
+
+import (
+	"fmt"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"gorm.io/gorm"
+)
+
+// BalanceProviderSql is a walock.BusinessProviderSql and a walock.WalLoaderSql on a MemSqlDb, with the rules and
+// the accounts of balance.SqlProvider. Accounts, WALs and reservations are rows of the tables named by the provider.
+// As with the unique (lock_key, seq) index of balance.SqlProvider, a WAL written twice fails the transaction.
+type BalanceProviderSql struct {
+	balance.Rules
+	Db                   *MemSqlDb
+	AccountTableName     string // defaults to "accounts"
+	WalTableName         string // defaults to "wals"
+	ReservationTableName string // defaults to "reservations"
+}
+
+func (f *BalanceProviderSql) InitDefault() {
+	f.Rules.InitDefault()
+	if f.AccountTableName == "" {
+		f.AccountTableName = "accounts"
+	}
+	if f.WalTableName == "" {
+		f.WalTableName = "wals"
+	}
+	if f.ReservationTableName == "" {
+		f.ReservationTableName = "reservations"
+	}
+}
+
+// SetPersisted overwrites the persisted account outside any transaction
+func (f *BalanceProviderSql) SetPersisted(account Account) error {
+	return f.Db.Tx().Put(f.AccountTableName, string(account.Key), account)
+}
+
+// Persisted returns the persisted account
+func (f *BalanceProviderSql) Persisted(key model.LockerKey) (account Account, err error) {
+	account.Key = key
+	_, err = f.Db.Tx().Get(f.AccountTableName, string(key), &account)
+	return
+}
+
+func walRowKey(key model.LockerKey, seq uint64) string {
+	return fmt.Sprintf("%s#%020d", key, seq)
+}
+
+func reservationRowKey(tccContext *model.TccContext) string {
+	return tccContext.GlobalId + "-" + tccContext.BranchId
+}
+
+func (f *BalanceProviderSql) LoadPersistedValue(tx *gorm.DB, key model.LockerKey) (v model.LockerValue, err error) {
+	mtx, err := MemSqlTxOf(tx)
+	if err != nil {
+		return
+	}
+	account := &Account{Key: key}
+	_, err = mtx.Get(f.AccountTableName, string(key), account)
+	if err != nil {
+		return
+	}
+	account.DbVersion = account.Seq
+	v = account
+	return
+}
+
+func (f *BalanceProviderSql) GenerateWalTry(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, tryBody interface{}) (ok bool, code string, message string, tryWali interface{}, err error) {
+	ok, code, message, wal := f.Rules.Try(tccContext, value.(*Account), tryBody)
+	if ok {
+		tryWali = wal
+	}
+	return
+}
+
+func (f *BalanceProviderSql) GenerateWalConfirm(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali interface{}) (confirmWali interface{}) {
+	return f.Rules.Confirm(tccContext, value.(*Account), reservationWali.(*BalanceWal))
+}
+
+func (f *BalanceProviderSql) GenerateWalCancel(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, reservationWali interface{}) (revertWali interface{}) {
+	return f.Rules.Cancel(tccContext, value.(*Account), reservationWali.(*BalanceWal))
+}
+
+func (f *BalanceProviderSql) GenerateWalMust(tccContext *model.TccContext, key model.LockerKey, value model.LockerValue, mustBody interface{}) (ok bool, code string, message string, mustWali interface{}, err error) {
+	ok, code, message, wal := f.Rules.Must(tccContext, value.(*Account), mustBody)
+	if ok {
+		mustWali = wal
+	}
+	return
+}
+
+func (f *BalanceProviderSql) LoadReservation(tx *gorm.DB, tccContext *model.TccContext) (wal interface{}, ok bool, code string, message string, err error) {
+	mtx, err := MemSqlTxOf(tx)
+	if err != nil {
+		return
+	}
+	reservation := &BalanceWal{}
+	ok, err = mtx.Get(f.ReservationTableName, reservationRowKey(tccContext), reservation)
+	if err != nil {
+		return
+	}
+	if !ok {
+		code = consts.ErrReservationNotFound
+		message = "reservation not found: " + tccContext.String()
+		return
+	}
+	wal = reservation
+	return
+}
+
+// LoadWals returns the WALs of the key with a seq above after, in seq order
+func (f *BalanceProviderSql) LoadWals(tx *gorm.DB, key model.LockerKey, after uint64) (walis []interface{}, err error) {
+	mtx, err := MemSqlTxOf(tx)
+	if err != nil {
+		return
+	}
+	rowKeys, err := mtx.Keys(f.WalTableName, string(key)+"#")
+	if err != nil {
+		return
+	}
+	for _, rowKey := range rowKeys {
+		wal := &BalanceWal{}
+		_, err = mtx.Get(f.WalTableName, rowKey, wal)
+		if err != nil {
+			return
+		}
+		if wal.Seq > after {
+			walis = append(walis, wal)
+		}
+	}
+	return
+}
+
+// CatchupWals applies the WALs with a seq above the one of the account.
+// WalockStoreSqlDb calls LoadWals instead.
+func (f *BalanceProviderSql) CatchupWals(tx *gorm.DB, key model.LockerKey, load model.LockerValue) (err error) {
+	walis, err := f.LoadWals(tx, key, load.GetVersion())
+	if err != nil {
+		return
+	}
+	return f.ApplyWal(load, walis)
+}
+
+func (f *BalanceProviderSql) ApplyWal(load model.LockerValue, walis []interface{}) (err error) {
+	account := load.(*Account)
+	for _, wali := range walis {
+		err = account.Apply(wali.(*BalanceWal))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (f *BalanceProviderSql) FlushWal(tx *gorm.DB, wali interface{}) (err error) {
+	mtx, err := MemSqlTxOf(tx)
+	if err != nil {
+		return
+	}
+	wal := wali.(*BalanceWal)
+	inserted, err := mtx.Insert(f.WalTableName, walRowKey(wal.Key, wal.Seq), wal)
+	if err != nil {
+		return
+	}
+	if !inserted {
+		return ErrDuplicateKey
+	}
+	if wal.Op == balance.OpTry {
+		err = mtx.Put(f.ReservationTableName, reservationRowKey(&model.TccContext{GlobalId: wal.GlobalId, BranchId: wal.BranchId}), wal)
+	}
+	return
+}
+
+// FlushDirty does nothing. WalockStoreSqlDb.FlushDirty flushes through Flush.
+func (f *BalanceProviderSql) FlushDirty(tx *gorm.DB) (err error) {
+	return
+}
+
+func (f *BalanceProviderSql) Traverse(fun func(key model.LockerKey, value model.LockerValue) bool) {
+	for _, key := range f.Keys() {
+		account, err := f.Persisted(key)
+		if err != nil {
+			return
+		}
+		if !fun(key, &account) {
+			return
+		}
+	}
+}
+
+func (f *BalanceProviderSql) Keys() []model.LockerKey {
+	rowKeys, _ := f.Db.Tx().Keys(f.AccountTableName, "")
+	keys := make([]model.LockerKey, 0, len(rowKeys))
+	for _, rowKey := range rowKeys {
+		keys = append(keys, model.LockerKey(rowKey))
+	}
+	return keys
+}
+
+func (f *BalanceProviderSql) Flush(tx *gorm.DB, value model.LockerValue) (err error) {
+	mtx, err := MemSqlTxOf(tx)
+	if err != nil {
+		return
+	}
+	return mtx.Put(f.AccountTableName, string(value.(*Account).Key), value)
+}
@@ -0,0 +1,87 @@
+package walocktest
+
+import (
+	"context"
+	"database/sql"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MemSqlDb runs no SQL, so balance.SqlProvider and tcc.TccBarrierSql need a real database behind gorm.
+// An in-memory SQLite keeps the tests fast and free of MySQL. walocktest does not import a driver itself:
+//
+//	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard}) // github.com/glebarez/sqlite
+//	sqlDb, _ := db.DB()
+//	sqlDb.SetMaxOpenConns(1) // SQLite has a single writer. one connection also keeps the in-memory database alive
+
+// NewSqlBalance returns the balance.SqlProvider and the tcc.TccBarrierSql of the SQL fixtures on db, creating their tables.
+// The barrier inserts with ON CONFLICT DO NOTHING, understood by SQLite and PostgreSQL.
+func NewSqlBalance(db *gorm.DB) (provider *balance.SqlProvider, barrier *tcc.TccBarrierSql, err error) {
+	logger := zerolog.Nop()
+	provider = &balance.SqlProvider{DbRw: db}
+	provider.InitDefault()
+	err = provider.AutoMigrate(db)
+	if err != nil {
+		return
+	}
+	barrier = &tcc.TccBarrierSql{
+		BarrierName:  "walocktest",
+		DbTableName:  "tcc_barrier",
+		Logger:       &logger,
+		InsertIgnore: clause.OnConflict{DoNothing: true},
+	}
+	barrier.InitDefault()
+	err = db.Table(barrier.DbTableName).AutoMigrate(&model.TccBarrierReceiver{})
+	return
+}
+
+// NewMemSqlBalance returns the BalanceProviderSql and the MemSqlBarrier of the MemSqlDb fixtures, the stand-ins of NewSqlBalance
+func NewMemSqlBalance(db *MemSqlDb) (provider *BalanceProviderSql, barrier *MemSqlBarrier) {
+	provider = &BalanceProviderSql{Db: db}
+	provider.InitDefault()
+	barrier = &MemSqlBarrier{BarrierName: "walocktest"}
+	barrier.InitDefault()
+	return
+}
+
+// crashDb returns a session of db whose transaction commits are a write boundary of the crasher.
+// A crashed commit rolls the transaction back, as if the process died before COMMIT.
+func crashDb(db *gorm.DB, crasher *Crasher) *gorm.DB {
+	session := db.Session(&gorm.Session{NewDB: true, Context: context.Background()})
+	session.Statement.ConnPool = &crashConnPool{ConnPool: db.Statement.ConnPool, crasher: crasher}
+	return session
+}
+
+type crashConnPool struct {
+	gorm.ConnPool
+	crasher *Crasher
+}
+
+func (p *crashConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	beginner, ok := p.ConnPool.(gorm.TxBeginner)
+	if !ok {
+		return nil, gorm.ErrInvalidTransaction
+	}
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &crashTx{Tx: tx, crasher: p.crasher}, nil
+}
+
+type crashTx struct {
+	*sql.Tx
+	crasher *Crasher
+}
+
+func (t *crashTx) Commit() error {
+	if err := t.crasher.Hit("sql.commit"); err != nil {
+		_ = t.Tx.Rollback()
+		return err
+	}
+	return t.Tx.Commit()
+}
@@ -0,0 +1,161 @@
+// Package walocktest provides fixtures to test code built on walock without LevelDB or MySQL:
+// WalockStoreLevelDb on an in-memory model.KvStoreOperator, WalockStoreSqlDb on MemSqlDb, a gorm-free in-memory
+// stand-in for the SQL database, or on a database opened by the test, usually an in-memory SQLite,
+// and the balance providers of package balance on top of them. All fixtures implement Fixture.
+//
+//	f := walocktest.NewLevelDbFixture()
+//	f.Provider.SetPersisted(walocktest.Account{Key: "alice", Available: 100})
+//	tccCode, code, message, err := f.TccStore().Try(ctx, &model.TccContext{GlobalId: "g1", BranchId: "b1"}, "alice", int64(30))
+package walocktest
+
+import (
+	"github.com/latifrons/walock"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/kv/memkv"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/tcc"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// Fixture is a TCC store on a persisted state which the test can set and read, whatever the store
+type Fixture interface {
+	TccStore() walock.TccStore
+	// SetPersisted overwrites the persisted account outside any transaction
+	SetPersisted(account Account) error
+	// Persisted returns the persisted account
+	Persisted(key model.LockerKey) (Account, error)
+}
+
+// LevelDbFixture is a WalockStoreLevelDb on an in-memory KV store with a BalanceProviderLevelDb
+type LevelDbFixture struct {
+	Store    *walock.WalockStoreLevelDb
+	Kv       *memkv.MemKv
+	Provider *BalanceProviderLevelDb
+}
+
+func NewLevelDbFixture() *LevelDbFixture {
+	logger := zerolog.Nop()
+	provider := &BalanceProviderLevelDb{}
+	provider.InitDefault()
+
+	barrier := &tcc.TccBarrierLevelDb{Logger: &logger}
+	barrier.InitDefault()
+
+	store := &walock.WalockStoreLevelDb{
+		BusinessProvider:  provider,
+		TccBarrierLevelDb: barrier,
+		BarrierName:       "walocktest",
+		Logger:            &logger,
+	}
+	store.InitDefault()
+
+	return &LevelDbFixture{
+		Store:    store,
+		Kv:       &memkv.MemKv{},
+		Provider: provider,
+	}
+}
+
+func (f *LevelDbFixture) TccStore() walock.TccStore {
+	return &walock.LevelDbTccStore{Store: f.Store, Tx: f.Kv}
+}
+
+func (f *LevelDbFixture) SetPersisted(account Account) error {
+	f.Provider.SetPersisted(account)
+	return nil
+}
+
+func (f *LevelDbFixture) Persisted(key model.LockerKey) (Account, error) {
+	return f.Provider.Persisted(key), nil
+}
+
+// MemSqlFixture is a WalockStoreSqlDb on a MemSqlDb with a BalanceProviderSql
+type MemSqlFixture struct {
+	Store    *walock.WalockStoreSqlDb
+	Db       *MemSqlDb
+	Provider *BalanceProviderSql
+}
+
+func NewMemSqlFixture() *MemSqlFixture {
+	logger := zerolog.Nop()
+	db := NewMemSqlDb()
+	provider, barrier := NewMemSqlBalance(db)
+
+	store := &walock.WalockStoreSqlDb{
+		DbRw:             db.Gorm(),
+		BusinessProvider: provider,
+		BarrierName:      barrier.BarrierName,
+		Logger:           &logger,
+		TccBarrier:       barrier,
+	}
+	store.InitDefault()
+
+	return &MemSqlFixture{
+		Store:    store,
+		Db:       db,
+		Provider: provider,
+	}
+}
+
+func (f *MemSqlFixture) TccStore() walock.TccStore {
+	return f.Store
+}
+
+func (f *MemSqlFixture) SetPersisted(account Account) error {
+	return f.Provider.SetPersisted(account)
+}
+
+func (f *MemSqlFixture) Persisted(key model.LockerKey) (Account, error) {
+	return f.Provider.Persisted(key)
+}
+
+// SqlFixture is a WalockStoreSqlDb with a balance.SqlProvider on a database opened by the test
+type SqlFixture struct {
+	Store    *walock.WalockStoreSqlDb
+	Db       *gorm.DB
+	Provider *balance.SqlProvider
+}
+
+// NewSqlFixture creates the tables of the fixture in db. See NewSqlBalance.
+func NewSqlFixture(db *gorm.DB) (*SqlFixture, error) {
+	logger := zerolog.Nop()
+	provider, barrier, err := NewSqlBalance(db)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &walock.WalockStoreSqlDb{
+		DbRw:             db,
+		BusinessProvider: provider,
+		BarrierName:      barrier.BarrierName,
+		Logger:           &logger,
+		TccBarrier:       barrier,
+	}
+	store.InitDefault()
+
+	return &SqlFixture{
+		Store:    store,
+		Db:       db,
+		Provider: provider,
+	}, nil
+}
+
+func (f *SqlFixture) TccStore() walock.TccStore {
+	return f.Store
+}
+
+// SetPersisted overwrites the persisted account outside any transaction
+func (f *SqlFixture) SetPersisted(account Account) error {
+	return f.Provider.Flush(f.Db, &account)
+}
+
+// Persisted returns the persisted account
+func (f *SqlFixture) Persisted(key model.LockerKey) (account Account, err error) {
+	v, err := f.Provider.LoadPersistedValue(f.Db, key)
+	if err != nil {
+		return
+	}
+	account = *v.(*Account)
+	return
+}
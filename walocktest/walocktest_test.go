@@ -0,0 +1,85 @@
+package walocktest_test
+
+import (
+	"context"
+	"github.com/latifrons/walock/balance"
+	"github.com/latifrons/walock/consts"
+	"github.com/latifrons/walock/model"
+	"github.com/latifrons/walock/walocktest"
+	"testing"
+)
+
+func TestFixtures(t *testing.T) {
+	fixtures := []struct {
+		name string
+		new  func(t *testing.T) walocktest.Fixture
+	}{
+		{"leveldb", func(t *testing.T) walocktest.Fixture { return walocktest.NewLevelDbFixture() }},
+		{"memsql", func(t *testing.T) walocktest.Fixture { return walocktest.NewMemSqlFixture() }},
+		{"sqlite", func(t *testing.T) walocktest.Fixture {
+			db, err := openSqlite(t)()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := walocktest.NewSqlFixture(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}},
+	}
+	ctx := context.Background()
+	for _, fixture := range fixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			f := fixture.new(t)
+			err := f.SetPersisted(walocktest.Account{Key: "alice", Available: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := f.TccStore()
+			g1 := &model.TccContext{GlobalId: "g1", BranchId: "b1"}
+			g2 := &model.TccContext{GlobalId: "g2", BranchId: "b1"}
+			calls := []struct {
+				name    string
+				call    func() (model.TccCode, string, string, error)
+				tccCode model.TccCode
+				code    string
+			}{
+				{"try", func() (model.TccCode, string, string, error) {
+					return store.Try(ctx, g1, "alice", int64(30))
+				}, consts.TccCode_Success, ""},
+				{"duplicate try", func() (model.TccCode, string, string, error) {
+					return store.Try(ctx, g1, "alice", int64(30))
+				}, consts.TccCode_Success, ""},
+				{"confirm", func() (model.TccCode, string, string, error) {
+					return store.Confirm(ctx, g1, "alice", nil)
+				}, consts.TccCode_Success, ""},
+				{"empty rollback", func() (model.TccCode, string, string, error) {
+					return store.Cancel(ctx, g2, "alice", nil)
+				}, consts.TccCode_Success, ""},
+				{"must", func() (model.TccCode, string, string, error) {
+					return store.Must(ctx, &model.TccContext{GlobalId: "g3", BranchId: "b1"}, "alice", int64(5))
+				}, consts.TccCode_Success, ""},
+				{"insufficient try", func() (model.TccCode, string, string, error) {
+					return store.Try(ctx, &model.TccContext{GlobalId: "g4", BranchId: "b1"}, "alice", int64(76))
+				}, consts.TccCode_Failed, balance.ErrInsufficientBalance},
+				{"try all", func() (model.TccCode, string, string, error) {
+					return store.Try(ctx, &model.TccContext{GlobalId: "g5", BranchId: "b1"}, "alice", int64(75))
+				}, consts.TccCode_Success, ""},
+			}
+			for _, c := range calls {
+				tccCode, code, message, err := c.call()
+				if err != nil || tccCode != c.tccCode || code != c.code {
+					t.Fatalf("%s = %d %s %s, %v", c.name, tccCode, code, message, err)
+				}
+			}
+			persisted, err := f.Persisted("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if persisted.Available != 100 || persisted.Frozen != 0 {
+				t.Fatalf("persisted alice has %d available, %d frozen before any flush", persisted.Available, persisted.Frozen)
+			}
+		})
+	}
+}